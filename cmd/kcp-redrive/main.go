@@ -0,0 +1,61 @@
+// Command kcp-redrive produces visit events from dead letter topic back to their original topic.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/platform/async"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/config"
+)
+
+func main() {
+	if err := runApp(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func runApp() error {
+	fs := flag.NewFlagSet("kcp-redrive", flag.ExitOnError)
+	idle := fs.Duration("idle", time.Second*10, "stop after no dead letters are received for this duration")
+	cfg, err := config.Load(fs, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig,
+		syscall.SIGINT,
+		syscall.SIGQUIT,
+	)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	broker := async.KafkaBroker{Host: cfg.Kafka.Host}
+	prod, err := broker.NewProducer()
+	if err != nil {
+		return err
+	}
+	defer prod.Close()
+
+	cons, err := broker.NewConsumer("redrive", true)
+	if err != nil {
+		return err
+	}
+	defer cons.Close()
+
+	n, err := async.RedriveDeadLetters(ctx, cons, prod, cfg.Kafka.DeadLetter(), cfg.Kafka.Topic, *idle)
+	fmt.Printf("Redriven %v dead letters\n", n)
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/async"
+)
+
+// runConsume runs workers of consumer groups given by -group flag, all groups by default.
+func runConsume(args []string) error {
+	fs := flag.NewFlagSet("kcp consume", flag.ExitOnError)
+	group := fs.String("group", "", "comma separated consumer groups, all groups if empty")
+	workers := fs.Int("workers", 0, "number of workers of each group, inserters of configuration or 1 if 0")
+	cfg, ok, err := loadConfig(fs, args)
+	if err != nil || !ok {
+		return err
+	}
+	var groups []string
+	for _, g := range strings.Split(*group, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+
+	k, broker, prod, closeKcp, err := openKcp(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer closeKcp()
+
+	r := newRole(cfg)
+	defer r.stop()
+	if err := consume(r, k, broker, &async.DeadLetter{Producer: prod, Topic: cfg.Kafka.DeadLetter()}, groups, *workers); err != nil {
+		return err
+	}
+	r.wait()
+	return nil
+}
+
+// consumerGroup runs worker of consumer group.
+type consumerGroup struct {
+	workers      int
+	manualCommit bool
+	run          func(async.Consumer)
+}
+
+// consume starts workers of consumer groups as components of role, all groups if groups is nil.
+// Each group has configured number of workers, unless workers is positive.
+func consume(r *role, k *kcp.Kcp, broker async.Broker, dlq async.DeadLetterPublisher, groups []string, workers int) error {
+	cc := r.cfg.Consumers
+	topic := r.cfg.Kafka.Topic
+	retry := async.Retry{Attempts: cc.RetryAttempts, Backoff: cc.RetryBackoff, MaxBackoff: cc.RetryMaxBackoff}
+	batch := async.Batch{Size: cc.InsertBatchSize, Timeout: cc.InsertBatchTimeout}
+	names := []string{cc.InsertGroup, cc.RollupGroup, cc.SessionsGroup, cc.DayGroup}
+	all := map[string]consumerGroup{
+		cc.InsertGroup: {workers: cc.Inserters, manualCommit: true, run: func(cons async.Consumer) {
+			if batch.Size > 1 {
+				async.BatchInsertEventsConsumer(r.ctx, k.InsertVisits, cons, topic, batch, retry, dlq, r.cancel, r.wg)
+				return
+			}
+			async.InsertEventsConsumer(r.ctx, k.InsertVisit, cons, topic, retry, dlq, r.cancel, r.wg)
+		}},
+		cc.RollupGroup: {workers: 1, manualCommit: true, run: func(cons async.Consumer) {
+			async.RollupConsumer(r.ctx, k.RollupVisit, cons, topic, retry, dlq, r.cancel, r.wg)
+		}},
+		cc.SessionsGroup: {workers: 1, manualCommit: true, run: func(cons async.Consumer) {
+			async.SessionConsumer(r.ctx, k.SessionizeVisit, cons, topic, retry, dlq, r.cancel, r.wg)
+		}},
+		cc.DayGroup: {workers: 1, manualCommit: true, run: func(cons async.Consumer) {
+			async.PrintDayConsumer(r.ctx, k.PrintDay, cons, topic, r.cancel, r.wg)
+		}},
+	}
+
+	if groups == nil {
+		groups = names
+	}
+	for _, name := range groups {
+		g, ok := all[name]
+		if !ok {
+			return fmt.Errorf("unknown consumer group %q, expected one of: %v", name, strings.Join(names, ", "))
+		}
+		n := g.workers
+		if workers > 0 {
+			n = workers
+		}
+		for i := 0; i < n; i++ {
+			cons, err := broker.NewConsumer(name, g.manualCommit)
+			if err != nil {
+				return err
+			}
+			r.start(fmt.Sprintf("%v-%v", name, i+1), func() {
+				g.run(cons)
+			})
+		}
+	}
+	return nil
+}
@@ -1,21 +1,31 @@
+// Command kcp tracks visits of http api and serves queries of them.
+//
+// Usage:
+//   kcp [all] [flags]                                  http api and all consumers in single process
+//   kcp [all] -seed [flags]                            also insert sample visits after migrating schema
+//   kcp serve [flags]                                  http api producing visits
+//   kcp consume [-group name] [-workers n] [flags]     consumers of groups, all groups by default
+//   kcp migrate [up] [-to version] [flags]             apply migrations of storage schema
+//   kcp migrate down [-steps n] [flags]                revert latest migrations
+//   kcp migrate status [flags]                         print applied and pending migrations
+//   kcp seed [flags]                                   insert sample visits
+//   kcp replay [-query q] [-topic name] [flags]        produce stored visits to topic
+//
+// Configuration flags are common to all commands, see -help of command.
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
-	"time"
+	"sort"
+	"strings"
+	// Embed time zone database used by tz query parameter.
+	_ "time/tzdata"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
-
-	"github.com/SarunasBucius/kafka-cass-practise/kcp"
-	"github.com/SarunasBucius/kafka-cass-practise/platform/async"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/config"
 	"github.com/SarunasBucius/kafka-cass-practise/platform/database"
-	"github.com/SarunasBucius/kafka-cass-practise/platform/services"
 )
 
 var version string
@@ -27,96 +37,53 @@ func main() {
 	}
 }
 
-func runApp() error {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig,
-		syscall.SIGINT,
-		syscall.SIGQUIT,
-	)
-
-	prod, err := async.KafkaProducerConn()
-	if err != nil {
-		return err
-	}
-	defer prod.Close()
-	db, err := database.SQLiteGormConn()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		d, _ := db.DB()
-		d.Close()
-	}()
-
-	k := kcp.New(
-		&async.Produce{Producer: prod},
-		&database.Gorm{DB: db},
-	)
+// commands are subcommands of kcp by name, which run using their arguments.
+var commands = map[string]func(args []string) error{
+	"all":     runAll,
+	"serve":   runServe,
+	"consume": runConsume,
+	"migrate": runMigrate,
+	"seed":    runSeed,
+	"replay":  runReplay,
+}
 
-	wg := &sync.WaitGroup{}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer waitWithTimeout(wg, cancel, time.Second*15)
-	if err := startServices(ctx, cancel, k, wg); err != nil {
-		return err
+// runApp runs subcommand named by first argument, all if it is not given.
+func runApp() error {
+	name, args := "all", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-
-	fmt.Println("Hello")
-	fmt.Println(version)
-
-	select {
-	case <-ctx.Done():
-	case <-sig:
+	run, ok := commands[name]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, expected one of: %v", name, strings.Join(names, ", "))
 	}
-
-	return nil
+	return run(args)
 }
 
-func startServices(ctx context.Context, cancel context.CancelFunc, k *kcp.Kcp, wg *sync.WaitGroup) error {
-	{
-		cons, err := async.KafkaConsumerConn("inserter")
-		if err != nil {
-			return err
-		}
-		wg.Add(1)
-		go async.InsertEventsConsumer(ctx, k.InsertVisit, cons, cancel, wg)
-	}
-	{
-		cons, err := async.KafkaConsumerConn("inserter")
-		if err != nil {
-			return err
-		}
-		wg.Add(1)
-		go async.InsertEventsConsumer(ctx, k.InsertVisit, cons, cancel, wg)
+// loadConfig loads configuration of command using flags registered on fs.
+// If -print-config flag is set, configuration is printed and ok is false.
+func loadConfig(fs *flag.FlagSet, args []string) (cfg config.Config, ok bool, err error) {
+	printConfig := fs.Bool("print-config", false, "print configuration as YAML and exit")
+	cfg, err = config.Load(fs, args, os.LookupEnv)
+	if err != nil {
+		return config.Config{}, false, err
 	}
-	{
-		cons, err := async.KafkaConsumerConn("day", map[string]kafka.ConfigValue{
-			"go.events.channel.enable": true,
-			"go.events.channel.size":   5,
-			"enable.auto.commit":       false,
-		})
-		if err != nil {
-			return err
-		}
-		wg.Add(1)
-		go async.PrintDayConsumer(ctx, k.PrintDay, cons, cancel, wg)
+	if *printConfig {
+		return cfg, false, cfg.Print(os.Stdout)
 	}
-
-	wg.Add(1)
-	go services.ListenHTTP(ctx, services.GinRoutes(k), cancel, wg)
-
-	return nil
+	return cfg, true, nil
 }
 
-func waitWithTimeout(wg *sync.WaitGroup, cancel context.CancelFunc, timeout time.Duration) {
-	cancel()
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		wg.Wait()
-	}()
-
-	select {
-	case <-c:
-	case <-time.After(timeout):
+// storageOptions returns options of storage driver from configuration.
+func storageOptions(cfg config.Config) database.Options {
+	return database.Options{
+		SQLitePath:       cfg.Database.SQLitePath,
+		CassandraHost:    cfg.Database.CassandraHost,
+		CassandraTimeout: cfg.Database.CassandraTimeout,
 	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/database"
+)
+
+// runMigrate migrates schema of configured storage.
+// First argument is action: up (default) applies migrations up to -to version or latest,
+// down reverts -steps latest migrations and status prints applied and pending migrations.
+func runMigrate(args []string) error {
+	action := "up"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("kcp migrate "+action, flag.ExitOnError)
+	to := fs.Int("to", 0, "version migrate up migrates to, latest if 0")
+	steps := fs.Int("steps", 1, "number of migrations migrate down reverts")
+	cfg, ok, err := loadConfig(fs, args)
+	if err != nil || !ok {
+		return err
+	}
+
+	db, closeDb, err := database.Connect(cfg.Database.Driver, storageOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+	schema, err := database.NewSchema(cfg.Database.Driver, db)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		return migrateUp(schema, *to)
+	case "down":
+		reverted, err := schema.Down(*steps)
+		for _, m := range reverted {
+			fmt.Printf("Reverted migration %v %v\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		return printSchemaStatus(schema, cfg.Database.Driver)
+	default:
+		return fmt.Errorf("unknown migrate action %q, expected one of: up, down, status", action)
+	}
+}
+
+// migrateUp applies migrations of schema up to version to, latest if 0.
+func migrateUp(schema *database.Schema, to int) error {
+	applied, err := schema.Up(to)
+	for _, m := range applied {
+		fmt.Printf("Applied migration %v %v\n", m.Version, m.Name)
+	}
+	return err
+}
+
+// openMigrated connects to storage using driver registered by name
+// and migrates its schema to latest version.
+func openMigrated(name string, opts database.Options) (kcp.DbConnector, func() error, error) {
+	db, closeDb, err := database.Connect(name, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	schema, err := database.NewSchema(name, db)
+	if err == nil {
+		err = migrateUp(schema, 0)
+	}
+	if err != nil {
+		closeDb()
+		return nil, nil, err
+	}
+	return db, closeDb, nil
+}
+
+// printSchemaStatus prints version of schema and whether its migrations are applied.
+func printSchemaStatus(schema *database.Schema, driver string) error {
+	v, err := schema.Version()
+	if err != nil {
+		return err
+	}
+	if len(schema.Migrations()) == 0 {
+		fmt.Printf("%v storage has no schema\n", driver)
+		return nil
+	}
+	fmt.Printf("Schema of %v storage is at version %v, latest is %v\n", driver, v, schema.Latest())
+	if v > schema.Latest() {
+		fmt.Println("Schema is newer than known migrations, upgrade kcp")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, m := range schema.Migrations() {
+		status := "pending"
+		if m.Version <= v {
+			status = "applied"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", m.Version, m.Name, status)
+	}
+	return w.Flush()
+}
+
+// runSeed inserts sample visits into configured storage.
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("kcp seed", flag.ExitOnError)
+	cfg, ok, err := loadConfig(fs, args)
+	if err != nil || !ok {
+		return err
+	}
+
+	db, closeDb, err := database.Open(cfg.Database.Driver, storageOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+	if err := database.Seed(db); err != nil {
+		return err
+	}
+	fmt.Printf("Seeded %v storage\n", cfg.Database.Driver)
+	return nil
+}
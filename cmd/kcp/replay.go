@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/async"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/database"
+)
+
+// runReplay produces stored visits matching query to topic, so that consumers process them again,
+// e.g. to fill new consumer group or storage. Visits keep their ids, so inserting them again
+// is ignored and sessions ignore visits, which are not after their end, but rollups count them again.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("kcp replay", flag.ExitOnError)
+	query := fs.String("query", "", "filters of replayed visits as url query of GET /api/visits, e.g. gte=now-1d&ip=1.1.1.1")
+	topic := fs.String("topic", "", "topic replayed visits are produced to, kafka.topic if empty")
+	cfg, ok, err := loadConfig(fs, args)
+	if err != nil || !ok {
+		return err
+	}
+	values, err := url.ParseQuery(*query)
+	if err != nil {
+		return err
+	}
+	q, err := kcp.ParseVisitQuery(values)
+	if err != nil {
+		return err
+	}
+	if *topic == "" {
+		*topic = cfg.Kafka.Topic
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig,
+		syscall.SIGINT,
+		syscall.SIGQUIT,
+		syscall.SIGTERM,
+	)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	db, closeDb, err := database.Open(cfg.Database.Driver, storageOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+	events, err := db.GetEvents(q)
+	if err != nil {
+		return err
+	}
+
+	broker, err := async.NewBroker(cfg.Broker, cfg.Kafka.Host)
+	if err != nil {
+		return err
+	}
+	codec, err := async.CodecByName(cfg.Kafka.Codec)
+	if err != nil {
+		return err
+	}
+	prod, err := broker.NewProducer()
+	if err != nil {
+		return err
+	}
+	defer prod.Close()
+	produce := async.NewProduce(prod, codec, *topic, cfg.Kafka.MaxInFlight)
+
+	var deliveries []*async.Delivery
+	for _, e := range events {
+		if ctx.Err() != nil {
+			break
+		}
+		d, err := produce.ProduceEventAsync(e)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		deliveries = append(deliveries, d)
+	}
+	produce.Flush(cfg.Kafka.FlushTimeout)
+
+	var delivered int
+	for _, d := range deliveries {
+		if d.Message() != nil {
+			delivered++
+		}
+	}
+	fmt.Printf("Replayed %v of %v visits to %v\n", delivered, len(events), *topic)
+	if delivered < len(events) && ctx.Err() == nil {
+		return fmt.Errorf("%v visits were not replayed", len(events)-delivered)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/async"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/config"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/database"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/services"
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// role runs long running components of command, e.g. http server or consumers,
+// serves their health and stops them on shutdown.
+type role struct {
+	cfg    config.Config
+	health *services.Health
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+}
+
+// newRole returns role without components.
+func newRole(cfg config.Config) *role {
+	r := &role{cfg: cfg, health: &services.Health{}, wg: &sync.WaitGroup{}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+// start runs component in goroutine, component is healthy until run returns.
+// Role wait group is incremented, run must call its Done once component is stopped.
+func (r *role) start(component string, run func()) {
+	r.wg.Add(1)
+	r.health.Set(component, nil)
+	go func() {
+		run()
+		r.health.Set(component, services.ErrStopped)
+	}()
+}
+
+// wait serves health on configured address until role is stopped by signal,
+// failed component or health check, which can not listen,
+// then stops components and waits for them until shutdown timeout.
+func (r *role) wait() {
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	healthWg := &sync.WaitGroup{}
+	healthWg.Add(1)
+	go services.ListenHTTP(healthCtx, services.HealthHandler(r.health), services.ServerConfig{
+		Addr:         r.cfg.HTTP.HealthAddr,
+		ReadTimeout:  r.cfg.HTTP.ReadTimeout,
+		WriteTimeout: r.cfg.HTTP.WriteTimeout,
+		IdleTimeout:  r.cfg.HTTP.IdleTimeout,
+	}, r.cancel, healthWg)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig,
+		syscall.SIGINT,
+		syscall.SIGQUIT,
+		syscall.SIGTERM,
+	)
+	defer signal.Stop(sig)
+	select {
+	case <-r.ctx.Done():
+	case <-sig:
+	}
+
+	// Health check reports shutdown until components are stopped.
+	r.health.Set("shutdown", errShuttingDown)
+	r.stop()
+	stopHealth()
+	healthWg.Wait()
+}
+
+// stop stops components and waits for them until shutdown timeout.
+func (r *role) stop() {
+	r.cancel()
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		r.wg.Wait()
+	}()
+
+	select {
+	case <-c:
+	case <-time.After(r.cfg.ShutdownTimeout):
+		fmt.Println("Shutdown timed out")
+	}
+}
+
+// openKcp connects to broker and storage and returns kcp using them, producer
+// used for visits and dead letters, and function flushing produced visits
+// and closing connections. Schema of storage is migrated to latest version if migrate is set,
+// otherwise it must be at latest version.
+func openKcp(cfg config.Config, migrate bool) (*kcp.Kcp, async.Broker, async.Producer, func(), error) {
+	broker, err := async.NewBroker(cfg.Broker, cfg.Kafka.Host)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	codec, err := async.CodecByName(cfg.Kafka.Codec)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	open := database.Open
+	if migrate {
+		open = openMigrated
+	}
+	db, closeDb, err := open(cfg.Database.Driver, storageOptions(cfg))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	prod, err := broker.NewProducer()
+	if err != nil {
+		closeDb()
+		return nil, nil, nil, nil, err
+	}
+
+	produce := async.NewProduce(prod, codec, cfg.Kafka.Topic, cfg.Kafka.MaxInFlight)
+	// Visits are queued, so that http api does not wait for their delivery.
+	k := kcp.New(&async.Queue{Produce: produce}, db)
+	k.AllowedHeaders = cfg.Visits.Headers
+	k.SessionGap = cfg.Visits.SessionGap
+	k.MaxSessionVisits = cfg.Visits.MaxSessionVisits
+	return k, broker, prod, func() {
+		if n := produce.Flush(cfg.Kafka.FlushTimeout); n > 0 {
+			fmt.Printf("%v events were not delivered\n", n)
+		}
+		prod.Close()
+		closeDb()
+	}, nil
+}
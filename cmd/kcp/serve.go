@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/async"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/database"
+	"github.com/SarunasBucius/kafka-cass-practise/platform/services"
+)
+
+// runAll migrates schema of storage and runs http api and all consumers in single process.
+// Sample visits are inserted if -seed flag is set.
+func runAll(args []string) error {
+	fs := flag.NewFlagSet("kcp all", flag.ExitOnError)
+	seed := fs.Bool("seed", false, "insert sample visits after migrating schema")
+	cfg, ok, err := loadConfig(fs, args)
+	if err != nil || !ok {
+		return err
+	}
+
+	k, broker, prod, closeKcp, err := openKcp(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer closeKcp()
+	if *seed {
+		if err := database.Seed(k.DbConnector); err != nil {
+			return err
+		}
+	}
+
+	r := newRole(cfg)
+	defer r.stop()
+	if err := consume(r, k, broker, &async.DeadLetter{Producer: prod, Topic: cfg.Kafka.DeadLetter()}, nil, 0); err != nil {
+		return err
+	}
+	if err := serve(r, k); err != nil {
+		return err
+	}
+
+	fmt.Println("Hello")
+	fmt.Println(version)
+	r.wait()
+	return nil
+}
+
+// runServe runs http api, which produces visits and reads them from storage.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("kcp serve", flag.ExitOnError)
+	cfg, ok, err := loadConfig(fs, args)
+	if err != nil || !ok {
+		return err
+	}
+
+	k, _, _, closeKcp, err := openKcp(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer closeKcp()
+
+	r := newRole(cfg)
+	defer r.stop()
+	if err := serve(r, k); err != nil {
+		return err
+	}
+	r.wait()
+	return nil
+}
+
+// serve starts http server of api handled by k as component of role.
+func serve(r *role, k *kcp.Kcp) error {
+	ips, err := services.NewClientIPResolver(r.cfg.HTTP.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	router, err := services.NewRouter(r.cfg.HTTP.Router, k, ips)
+	if err != nil {
+		return err
+	}
+
+	srv := services.ServerConfig{
+		Addr:         r.cfg.HTTP.Addr,
+		ReadTimeout:  r.cfg.HTTP.ReadTimeout,
+		WriteTimeout: r.cfg.HTTP.WriteTimeout,
+		IdleTimeout:  r.cfg.HTTP.IdleTimeout,
+	}
+	r.start("http", func() {
+		services.ListenHTTP(r.ctx, router, srv, r.cancel, r.wg)
+	})
+	return nil
+}
@@ -2,12 +2,24 @@
 //
 // Supported features:
 //  * Produce event of visit
+//   * Contains visited page path and method, user agent, referrer, accept language
+//     and allowed headers of request
 //  * Insert event of visit to storage
+//   * Events can be inserted in batches
+//   * Events are identified by ID, inserting same event again is not an error
 //  * Print week day of visit
 //  * Get all events from storage
-//   * Filters visits by time greater than (gt), less than (lt), day of the week (day)
+//   * Filters visits by VisitQuery parsed from query parameters (see ParseVisitQuery)
 //  * Get events by same ip from storage
-//   * Filters visits by time greater than (gt), less than (lt), day of the week (day)
+//   * Filters visits by VisitQuery parsed from query parameters (see ParseVisitQuery)
+//  * Get events by ips in CIDR networks or list of ips from storage
+//   * Filters visits by VisitQuery parsed from query parameters (see ParseVisitQuery)
+//  * Update hourly rollups of visits from stream of events
+//  * Get statistics of visits from rollups grouped by day, hour, weekday or ip
+//   * Filters visits same as getting events (see ParseStatsQuery)
+//  * Group visits from same ip and user agent into sessions separated by inactivity gap
+//   * Sessions are computed on demand from stored visits or stored from stream of events
+//   * Filters visits same as getting events (see ParseSessionQuery)
 package kcp
 
 //go:generate mockgen -destination=kcp_mock.go -package=kcp github.com/SarunasBucius/kafka-cass-practise/kcp Producer,DbConnector
@@ -15,14 +27,27 @@ package kcp
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
 	"strings"
 	"time"
+
+	"github.com/rs/xid"
 )
 
 // Kcp contains Producer and DbConnector.
 type Kcp struct {
 	Producer
 	DbConnector
+	// AllowedHeaders are names of request headers kept in Event.Headers.
+	AllowedHeaders []string
+	// SessionGap is inactivity gap after which next visit starts new session,
+	// DefaultSessionGap is used if it is not set.
+	SessionGap time.Duration
+	// MaxSessionVisits limits visits read to compute sessions on demand,
+	// DefaultMaxSessionVisits is used if it is not set.
+	MaxSessionVisits int
 }
 
 // New takes Producer, DbConnector and returns Kcp instance.
@@ -30,155 +55,192 @@ func New(p Producer, i DbConnector) *Kcp {
 	return &Kcp{Producer: p, DbConnector: i}
 }
 
+// Errors, which Producer and DbConnector implementations wrap to describe failure,
+// so that callers can tell them apart, e.g. to respond with http status.
+var (
+	// ErrNotFound is returned if requested resource does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable is returned if storage or stream is temporarily unavailable.
+	ErrUnavailable = errors.New("temporarily unavailable")
+)
+
 // Event represents event created by ProduceVisit.
+// Day is day of the week of VisitedAt in UTC.
 type Event struct {
-	VisitedAt time.Time
-	IP        string
-	Day       string
+	// ID uniquely identifies event, so that redelivered event is inserted once.
+	ID             string
+	VisitedAt      time.Time
+	IP             string
+	Day            string
+	Path           string
+	Method         string
+	UserAgent      string
+	Referrer       string
+	AcceptLanguage string
+	// Headers contains allowed request headers by canonical name,
+	// multiple values of header are joined with comma.
+	Headers map[string]string
+}
+
+// VisitRequest describes request of visit.
+// Path and Method are of visited page reported by tracking request, not of tracking request itself.
+type VisitRequest struct {
+	IP      string
+	Method  string
+	Path    string
+	Headers map[string][]string
 }
 
-// Producer produces event.
+// Producer produces event, it may return before event is delivered.
 type Producer interface {
 	ProduceEvent(Event) error
 }
 
-// ProduceVisit takes ip as param, produces visit Event and returns error.
-func (k *Kcp) ProduceVisit(ip string) error {
+// ProduceVisit takes request of visit as param, produces visit Event and returns error.
+// Path of visited page falls back to path of Referer header and method to GET.
+// Returns *FilterError if path or method is invalid.
+func (k *Kcp) ProduceVisit(r VisitRequest) error {
+	path, method, err := visitedPage(r)
+	if err != nil {
+		return err
+	}
 	now := time.Now().UTC()
 	day := now.Weekday().String()
-	event := Event{VisitedAt: now, IP: ip, Day: day}
+	event := Event{
+		ID:             xid.New().String(),
+		VisitedAt:      now,
+		IP:             r.IP,
+		Day:            day,
+		Path:           path,
+		Method:         method,
+		UserAgent:      header(r.Headers, "User-Agent"),
+		Referrer:       header(r.Headers, "Referer"),
+		AcceptLanguage: header(r.Headers, "Accept-Language"),
+		Headers:        k.allowedHeaders(r.Headers),
+	}
 	return k.ProduceEvent(event)
 }
 
-// DbConnector interface contains methods concerned with database.
-type DbConnector interface {
-	InsertEvent(Event) error
-	GetVisits() (VisitsByIP, error)
-	GetVisitsByIP(ip, day string, gt, lt time.Time) (VisitsByIP, error)
-}
-
-// InsertVisit inserts visit Event and returns error.
-func (k *Kcp) InsertVisit(event Event) error {
-	return k.InsertEvent(event)
-}
-
-// VisitsByIP contains ip and slice of visit times.
-type VisitsByIP map[string][]time.Time
-
-// ErrInvalidFilter is returned if filter parameter is invalid.
-var ErrInvalidFilter = errors.New("invalid filter parameter")
-
-// GetVisits get visits grouped by ip.
-func (k *Kcp) GetVisits(filter map[string]string) (VisitsByIP, error) {
-	// check if filter for greater than is passed and get valid time.Time value
-	gt, err := formatTime(filter, "gt")
-	if err != nil {
-		return nil, err
+// visitedPage returns path and method of visited page of request.
+// Path may be given as url, its query and fragment are dropped.
+func visitedPage(r VisitRequest) (string, string, error) {
+	method := strings.ToUpper(r.Method)
+	if method == "" {
+		method = http.MethodGet
 	}
-
-	// check if filter for less than is passed and get valid time.Time value
-	lt, err := formatTime(filter, "lt")
-	if err != nil {
-		return nil, err
+	if !isMethod(method) {
+		return "", "", &FilterError{Param: ParamMethod, Value: r.Method, Reason: "must be http method"}
 	}
 
-	// check if filter for day is passed and is valid
-	day, err := isValidDay(filter)
-	if err != nil {
-		return nil, err
+	if r.Path == "" {
+		// Referer is set by browser, so it is ignored if it is not valid url.
+		path, _ := pagePath(header(r.Headers, "Referer"))
+		return path, method, nil
+	}
+	path, ok := pagePath(r.Path)
+	if !ok {
+		return "", "", &FilterError{Param: ParamPath, Value: r.Path, Reason: "must be absolute path or url"}
 	}
+	return path, method, nil
+}
 
-	// get visits from db
-	visits, err := k.DbConnector.GetVisits()
-	if err != nil {
-		return nil, err
+// pagePath returns path of absolute path or url, root path if url has no path.
+func pagePath(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		return "", false
+	case u.Host != "" && u.Path == "":
+		return "/", true
+	case strings.HasPrefix(u.Path, "/"):
+		return u.Path, true
 	}
+	return "", false
+}
 
-	// filter data
-	filteredVisits := make(VisitsByIP)
-	for i, visitsByIP := range visits {
-		var filteredTime []time.Time
-		for _, visit := range visitsByIP {
-			if !gt.IsZero() && visit.Before(gt) {
-				continue
+// allowedHeaders returns allowed headers present in request headers or nil if there are none.
+func (k *Kcp) allowedHeaders(headers map[string][]string) map[string]string {
+	var allowed map[string]string
+	for _, name := range k.AllowedHeaders {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if v := header(headers, name); v != "" {
+			if allowed == nil {
+				allowed = make(map[string]string)
 			}
-			if !lt.IsZero() && visit.After(lt) {
-				continue
-			}
-			if day != "" && day != visit.Weekday().String() {
-				continue
-			}
-			filteredTime = append(filteredTime, visit)
+			allowed[name] = v
 		}
-		if filteredTime == nil {
-			continue
-		}
-		filteredVisits[i] = filteredTime
 	}
-	return filteredVisits, nil
+	return allowed
 }
 
-func isValidDay(filter map[string]string) (string, error) {
-	day := filter["day"]
-	if day == "" {
-		return "", nil
-	}
-	var empty struct{}
-	days := map[string]struct{}{
-		"Monday":    empty,
-		"Tuesday":   empty,
-		"Wednesday": empty,
-		"Thursday":  empty,
-		"Friday":    empty,
-		"Saturday":  empty,
-		"Sunday":    empty,
-	}
-	if _, ok := days[day]; ok {
-		return day, nil
-	}
-	return "", ErrInvalidFilter
+// header returns values of header with canonical name joined with comma.
+func header(headers map[string][]string, name string) string {
+	return strings.Join(headers[name], ", ")
 }
 
-func formatTime(filter map[string]string, key string) (time.Time, error) {
-	// check if value is passed
-	unf := filter[key]
-	if unf == "" {
-		return time.Time{}, nil
-	}
+// DbConnector interface contains methods concerned with database.
+type DbConnector interface {
+	InsertEvent(Event) error
+	InsertEvents([]Event) error
+	GetVisits(VisitQuery) (VisitsPage, error)
+	GetVisitStats(StatsQuery) ([]VisitStats, error)
+	UpdateRollups(Event, StreamPosition) error
+	// GetEvents returns events matching query filters ordered by visited_at,
+	// limit, order and cursor of query are ignored.
+	GetEvents(VisitQuery) ([]Event, error)
+	// GetSessions returns stored sessions matching query filters ordered by start,
+	// limit and order of query are ignored.
+	GetSessions(SessionQuery) ([]Session, error)
+	// LastSession returns latest stored session of ip and user agent,
+	// or zero Session if there is none.
+	LastSession(ip, userAgent string) (Session, error)
+	// SaveSession inserts session or updates stored one with same ip, user agent and start.
+	SaveSession(Session) error
+}
 
-	// add month and day if missing
-	for i := len(strings.Split(unf, "-")); i < 3; i++ {
-		unf += "-01"
-	}
+// InsertVisit inserts visit Event and returns error.
+func (k *Kcp) InsertVisit(event Event) error {
+	return k.InsertEvent(event)
+}
 
-	f, err := time.Parse("2006-01-02", unf)
-	if err != nil {
-		fmt.Println(err)
-		return time.Time{}, ErrInvalidFilter
+// InsertVisits inserts batch of visit Events and returns error,
+// empty batch is not inserted.
+func (k *Kcp) InsertVisits(events []Event) error {
+	if len(events) == 0 {
+		return nil
 	}
-	return f, nil
+	return k.InsertEvents(events)
 }
 
-// GetVisitsByIP gets visits from provided ip.
-func (k *Kcp) GetVisitsByIP(ip string, filter map[string]string) (VisitsByIP, error) {
-	// check if filter for greater than is passed and get valid time.Time value
-	gt, err := formatTime(filter, "gt")
-	if err != nil {
-		return nil, err
-	}
+// StreamPosition identifies event in stream of events.
+type StreamPosition struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
 
-	// check if filter for less than is passed and get valid time.Time value
-	lt, err := formatTime(filter, "lt")
-	if err != nil {
-		return nil, err
-	}
+// RollupVisit applies visit Event at stream position to rollups.
+// Event at position, which is not after last applied one in its partition, is ignored,
+// so redelivered events are not counted twice.
+func (k *Kcp) RollupVisit(event Event, pos StreamPosition) error {
+	return k.UpdateRollups(event, pos)
+}
 
-	// check if filter for day is passed and is valid
-	day, err := isValidDay(filter)
-	if err != nil {
-		return nil, err
+// VisitsByIP contains ip and slice of visit times.
+type VisitsByIP map[string][]time.Time
+
+// GetVisits validates query and gets page of visits grouped by ip.
+func (k *Kcp) GetVisits(q VisitQuery) (VisitsPage, error) {
+	if err := q.Validate(); err != nil {
+		return VisitsPage{}, err
 	}
-	return k.DbConnector.GetVisitsByIP(ip, day, gt, lt)
+	return k.DbConnector.GetVisits(q)
+}
+
+// GetVisitsByIP gets page of visits from provided ip, ips of query are ignored.
+func (k *Kcp) GetVisitsByIP(ip string, q VisitQuery) (VisitsPage, error) {
+	q.IPs = []string{ip}
+	return k.GetVisits(q)
 }
 
 // PrintDay prints day of the week of event.
@@ -7,7 +7,6 @@ package kcp
 import (
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
-	time "time"
 )
 
 // MockProducer is a mock of Producer interface
@@ -70,34 +69,64 @@ func (m *MockDbConnector) EXPECT() *MockDbConnectorMockRecorder {
 	return m.recorder
 }
 
+// GetEvents mocks base method
+func (m *MockDbConnector) GetEvents(arg0 VisitQuery) ([]Event, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetEvents", arg0)
+	ret0, _ := ret[0].([]Event)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetEvents indicates an expected call of GetEvents
+func (mr *MockDbConnectorMockRecorder) GetEvents(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetEvents", reflect.TypeOf((*MockDbConnector)(nil).GetEvents), arg0)
+}
+
+// GetSessions mocks base method
+func (m *MockDbConnector) GetSessions(arg0 SessionQuery) ([]Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSessions", arg0)
+	ret0, _ := ret[0].([]Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSessions indicates an expected call of GetSessions
+func (mr *MockDbConnectorMockRecorder) GetSessions(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSessions", reflect.TypeOf((*MockDbConnector)(nil).GetSessions), arg0)
+}
+
 // GetVisits mocks base method
-func (m *MockDbConnector) GetVisits() (VisitsByIP, error) {
+func (m *MockDbConnector) GetVisits(arg0 VisitQuery) (VisitsPage, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetVisits")
-	ret0, _ := ret[0].(VisitsByIP)
+	ret := m.ctrl.Call(m, "GetVisits", arg0)
+	ret0, _ := ret[0].(VisitsPage)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetVisits indicates an expected call of GetVisits
-func (mr *MockDbConnectorMockRecorder) GetVisits() *gomock.Call {
+func (mr *MockDbConnectorMockRecorder) GetVisits(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVisits", reflect.TypeOf((*MockDbConnector)(nil).GetVisits))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVisits", reflect.TypeOf((*MockDbConnector)(nil).GetVisits), arg0)
 }
 
-// GetVisitsByIP mocks base method
-func (m *MockDbConnector) GetVisitsByIP(arg0, arg1 string, arg2, arg3 time.Time) (VisitsByIP, error) {
+// GetVisitStats mocks base method
+func (m *MockDbConnector) GetVisitStats(arg0 StatsQuery) ([]VisitStats, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetVisitsByIP", arg0, arg1, arg2, arg3)
-	ret0, _ := ret[0].(VisitsByIP)
+	ret := m.ctrl.Call(m, "GetVisitStats", arg0)
+	ret0, _ := ret[0].([]VisitStats)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetVisitsByIP indicates an expected call of GetVisitsByIP
-func (mr *MockDbConnectorMockRecorder) GetVisitsByIP(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+// GetVisitStats indicates an expected call of GetVisitStats
+func (mr *MockDbConnectorMockRecorder) GetVisitStats(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVisitsByIP", reflect.TypeOf((*MockDbConnector)(nil).GetVisitsByIP), arg0, arg1, arg2, arg3)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVisitStats", reflect.TypeOf((*MockDbConnector)(nil).GetVisitStats), arg0)
 }
 
 // InsertEvent mocks base method
@@ -113,3 +142,60 @@ func (mr *MockDbConnectorMockRecorder) InsertEvent(arg0 interface{}) *gomock.Cal
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertEvent", reflect.TypeOf((*MockDbConnector)(nil).InsertEvent), arg0)
 }
+
+// InsertEvents mocks base method
+func (m *MockDbConnector) InsertEvents(arg0 []Event) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertEvents", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InsertEvents indicates an expected call of InsertEvents
+func (mr *MockDbConnectorMockRecorder) InsertEvents(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertEvents", reflect.TypeOf((*MockDbConnector)(nil).InsertEvents), arg0)
+}
+
+// LastSession mocks base method
+func (m *MockDbConnector) LastSession(arg0, arg1 string) (Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LastSession", arg0, arg1)
+	ret0, _ := ret[0].(Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LastSession indicates an expected call of LastSession
+func (mr *MockDbConnectorMockRecorder) LastSession(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LastSession", reflect.TypeOf((*MockDbConnector)(nil).LastSession), arg0, arg1)
+}
+
+// SaveSession mocks base method
+func (m *MockDbConnector) SaveSession(arg0 Session) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveSession", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveSession indicates an expected call of SaveSession
+func (mr *MockDbConnectorMockRecorder) SaveSession(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveSession", reflect.TypeOf((*MockDbConnector)(nil).SaveSession), arg0)
+}
+
+// UpdateRollups mocks base method
+func (m *MockDbConnector) UpdateRollups(arg0 Event, arg1 StreamPosition) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateRollups", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateRollups indicates an expected call of UpdateRollups
+func (mr *MockDbConnectorMockRecorder) UpdateRollups(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateRollups", reflect.TypeOf((*MockDbConnector)(nil).UpdateRollups), arg0, arg1)
+}
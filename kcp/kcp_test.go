@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/rs/xid"
 )
 
 func TestProduceVisit(t *testing.T) {
@@ -23,7 +24,90 @@ func TestProduceVisit(t *testing.T) {
 		Return(nil).
 		Times(1)
 
-	k.ProduceVisit(param)
+	k.ProduceVisit(VisitRequest{IP: param})
+}
+
+func TestProduceVisitRequest(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockProdEvent := NewMockProducer(mockCtrl)
+	k := New(mockProdEvent, nil)
+	k.AllowedHeaders = []string{"dnt", "X-Request-Id", "Origin"}
+
+	var got Event
+	mockProdEvent.EXPECT().
+		ProduceEvent(gomock.Any()).
+		Do(func(e Event) { got = e }).
+		Return(nil)
+
+	k.ProduceVisit(VisitRequest{
+		IP:     "ip",
+		Method: "post",
+		Path:   "https://example.com/signup?plan=pro",
+		Headers: map[string][]string{
+			"User-Agent":      {"curl/7.68.0"},
+			"Referer":         {"https://example.com/"},
+			"Accept-Language": {"en-US"},
+			"Dnt":             {"1"},
+			"X-Request-Id":    {"a", "b"},
+			"Cookie":          {"secret"},
+		},
+	})
+
+	want := Event{
+		ID:             got.ID,
+		VisitedAt:      got.VisitedAt,
+		IP:             "ip",
+		Day:            got.VisitedAt.Weekday().String(),
+		Path:           "/signup",
+		Method:         "POST",
+		UserAgent:      "curl/7.68.0",
+		Referrer:       "https://example.com/",
+		AcceptLanguage: "en-US",
+		Headers:        map[string]string{"Dnt": "1", "X-Request-Id": "a, b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected: %v, got: %v", want, got)
+	}
+}
+
+func TestVisitedPage(t *testing.T) {
+	type test struct {
+		r      VisitRequest
+		path   string
+		method string
+		param  string
+	}
+
+	referer := func(v string) map[string][]string { return map[string][]string{"Referer": {v}} }
+	tests := map[string]test{
+		"path":                {r: VisitRequest{Path: "/pricing", Method: "GET"}, path: "/pricing", method: "GET"},
+		"query dropped":       {r: VisitRequest{Path: "/blog/kafka?utm_source=mail#intro"}, path: "/blog/kafka", method: "GET"},
+		"url":                 {r: VisitRequest{Path: "https://example.com/pricing", Method: "post"}, path: "/pricing", method: "POST"},
+		"url without path":    {r: VisitRequest{Path: "https://example.com"}, path: "/", method: "GET"},
+		"path before referer": {r: VisitRequest{Path: "/pricing", Headers: referer("https://example.com/blog")}, path: "/pricing", method: "GET"},
+		"referer":             {r: VisitRequest{Headers: referer("https://example.com/blog/kafka?page=2")}, path: "/blog/kafka", method: "GET"},
+		"invalid referer":     {r: VisitRequest{Headers: referer("android-app")}, path: "", method: "GET"},
+		"no page":             {r: VisitRequest{}, path: "", method: "GET"},
+		"relative path":       {r: VisitRequest{Path: "pricing"}, param: ParamPath},
+		"invalid url":         {r: VisitRequest{Path: "https://example.com/%zz"}, param: ParamPath},
+		"invalid method":      {r: VisitRequest{Path: "/", Method: "GET /"}, param: ParamMethod},
+	}
+
+	for name, tt := range tests {
+		path, method, err := visitedPage(tt.r)
+		if tt.param != "" {
+			var ferr *FilterError
+			if !errors.As(err, &ferr) || ferr.Param != tt.param {
+				t.Errorf("%s: expected invalid %v, got: %v", name, tt.param, err)
+			}
+			continue
+		}
+		if err != nil || path != tt.path || method != tt.method {
+			t.Errorf("%s: expected: %v %v, got: %v %v, %v", name, tt.method, tt.path, method, path, err)
+		}
+	}
 }
 
 type approxTime struct {
@@ -49,13 +133,17 @@ func (a approxTime) Matches(event interface{}) bool {
 	if a.ip != ev.IP {
 		return false
 	}
+
+	if _, err := xid.FromString(ev.ID); err != nil {
+		return false
+	}
 	return true
 }
 
 func (a approxTime) String() string {
 	now := time.Now().UTC()
 	event := Event{VisitedAt: now, Day: now.Weekday().String(), IP: a.ip}
-	return fmt.Sprintf("%v, with deviation of %v", event, a.dev)
+	return fmt.Sprintf("%v, with deviation of %v and xid", event, a.dev)
 }
 
 func TestInsertVisit(t *testing.T) {
@@ -71,94 +159,37 @@ func TestInsertVisit(t *testing.T) {
 	k.InsertVisit(event)
 }
 
-func TestFormatTime(t *testing.T) {
-	type test struct {
-		filter map[string]string
-		key    string
-		want   time.Time
-		err    error
-	}
+func TestInsertVisits(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
 
-	y, err := time.Parse("2006-01-02", "2020-01-01")
-	if err != nil {
-		t.Fatal(err)
-	}
-	ymd, err := time.Parse("2006-01-02", "2020-05-05")
-	if err != nil {
-		t.Fatal(err)
-	}
+	mockDb := NewMockDbConnector(mockCtrl)
+	k := New(nil, mockDb)
 
-	tests := map[string]test{
-		"no value": {
-			filter: map[string]string{},
-			key:    "date",
-			want:   time.Time{},
-			err:    nil,
-		},
-		"year": {
-			filter: map[string]string{"date": "2020"},
-			key:    "date",
-			want:   y,
-			err:    nil,
-		},
-		"year month day": {
-			filter: map[string]string{"date": "2020-05-05"},
-			key:    "date",
-			want:   ymd,
-			err:    nil,
-		},
-		"invalid year": {
-			filter: map[string]string{"date": "abc"},
-			key:    "date",
-			want:   time.Time{},
-			err:    ErrInvalidFilter,
-		},
-	}
+	events := []Event{{IP: "ip1"}, {IP: "ip2"}}
+	mockDb.EXPECT().InsertEvents(events).Return(errMock)
 
-	for name, tt := range tests {
-		got, err := formatTime(tt.filter, tt.key)
-		if got != tt.want {
-			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
-		}
-		if err != tt.err {
-			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
-		}
+	if err := k.InsertVisits(events); err != errMock {
+		t.Errorf("expected: %v, got: %v", errMock, err)
+	}
+	if err := k.InsertVisits(nil); err != nil {
+		t.Errorf("expected: %v, got: %v", nil, err)
 	}
 }
 
-func TestIsValidDay(t *testing.T) {
-	type test struct {
-		filter map[string]string
-		want   string
-		err    error
-	}
+func TestRollupVisit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
 
-	tests := map[string]test{
-		"no value": {
-			filter: map[string]string{},
-			want:   "",
-			err:    nil,
-		},
-		"valid day": {
-			filter: map[string]string{"day": "Monday"},
-			want:   "Monday",
-			err:    nil,
-		},
-		"invalid day": {
-			filter: map[string]string{"day": "Mday"},
-			want:   "",
-			err:    ErrInvalidFilter,
-		},
-	}
+	mockDb := NewMockDbConnector(mockCtrl)
+	k := New(nil, mockDb)
 
-	for name, tt := range tests {
-		got, err := isValidDay(tt.filter)
-		if got != tt.want {
-			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
-		}
-		if err != tt.err {
-			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
-		}
+	event := Event{IP: "ip"}
+	pos := StreamPosition{Topic: "visits", Partition: 1, Offset: 5}
+	mockDb.EXPECT().UpdateRollups(event, pos).Return(errMock)
+
+	if err := k.RollupVisit(event, pos); err != errMock {
+		t.Errorf("expected: %v, got: %v", errMock, err)
 	}
 }
 
@@ -177,88 +208,71 @@ func TestGetVisits(t *testing.T) {
 		visits["ip"] = append(visits["ip"], time.Date(2020, 1, i, 0, 0, 0, 0, time.UTC))
 	}
 
-	gomock.InOrder(
-		mockDb.EXPECT().GetVisits().Return(visits, nil).Times(6),
-		mockDb.EXPECT().GetVisits().Return(nil, errMock).Times(1),
-	)
-
 	type test struct {
-		name   string
-		filter map[string]string
-		want   VisitsByIP
-		err    error
+		name  string
+		query VisitQuery
+		want  VisitsPage
+		err   error
+	}
+
+	filtered := VisitQuery{
+		From:     TimeBound{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		Weekdays: []time.Weekday{time.Wednesday},
 	}
+	paged := VisitQuery{Limit: 2, Cursor: "cursor"}
+
+	gomock.InOrder(
+		mockDb.EXPECT().GetVisits(VisitQuery{}).Return(VisitsPage{Visits: visits}, nil).Times(1),
+		mockDb.EXPECT().GetVisits(filtered).Return(VisitsPage{Visits: VisitsByIP{"ip": visits["ip"][:1]}}, nil).Times(1),
+		mockDb.EXPECT().GetVisits(paged).Return(VisitsPage{Visits: VisitsByIP{"ip": visits["ip"][:2]}, NextCursor: "next"}, nil).Times(1),
+		mockDb.EXPECT().GetVisits(VisitQuery{}).Return(VisitsPage{}, errMock).Times(1),
+	)
 
-	weekday := visits["ip"][0].Weekday().String()
 	tests := []test{
 		{
-			name:   "no filters",
-			filter: map[string]string{},
-			want:   visits,
-			err:    nil,
-		},
-		{
-			name:   "filter by gt",
-			filter: map[string]string{"gt": "2020-01-05"},
-			want:   VisitsByIP{"ip": visits["ip"][4:]},
-			err:    nil,
-		},
-		{
-			name:   "filter by lt",
-			filter: map[string]string{"lt": "2020-01-05"},
-			want:   VisitsByIP{"ip": visits["ip"][:5]},
-			err:    nil,
+			name:  "no filters",
+			query: VisitQuery{},
+			want:  VisitsPage{Visits: visits},
+			err:   nil,
 		},
 		{
-			name:   "filter by day",
-			filter: map[string]string{"day": weekday},
-			want:   VisitsByIP{"ip": []time.Time{visits["ip"][0]}},
-			err:    nil,
+			name:  "filtered",
+			query: filtered,
+			want:  VisitsPage{Visits: VisitsByIP{"ip": visits["ip"][:1]}},
+			err:   nil,
 		},
 		{
-			name:   "filter by all",
-			filter: map[string]string{"gt": "2020", "lt": "2020-01-05", "day": weekday},
-			want:   VisitsByIP{"ip": []time.Time{visits["ip"][0]}},
-			err:    nil,
+			name:  "paged",
+			query: paged,
+			want:  VisitsPage{Visits: VisitsByIP{"ip": visits["ip"][:2]}, NextCursor: "next"},
+			err:   nil,
 		},
 		{
-			name:   "all filtered out",
-			filter: map[string]string{"gt": "2021"},
-			want:   VisitsByIP{},
-			err:    nil,
+			name:  "invalid query",
+			query: VisitQuery{Limit: -1},
+			want:  VisitsPage{},
+			err:   ErrInvalidFilter,
 		},
 		{
-			name:   "wrong gt",
-			filter: map[string]string{"gt": "abc"},
-			want:   nil,
-			err:    ErrInvalidFilter,
+			name:  "cursor without limit",
+			query: VisitQuery{Cursor: "cursor"},
+			want:  VisitsPage{},
+			err:   ErrInvalidFilter,
 		},
 		{
-			name:   "wrong lt",
-			filter: map[string]string{"lt": "abc"},
-			want:   nil,
-			err:    ErrInvalidFilter,
-		},
-		{
-			name:   "wrong day",
-			filter: map[string]string{"day": "mday"},
-			want:   nil,
-			err:    ErrInvalidFilter,
-		},
-		{
-			name:   "error from db",
-			filter: map[string]string{},
-			want:   nil,
-			err:    errMock,
+			name:  "error from db",
+			query: VisitQuery{},
+			want:  VisitsPage{},
+			err:   errMock,
 		},
 	}
 
 	for _, tt := range tests {
-		got, err := k.GetVisits(tt.filter)
+		got, err := k.GetVisits(tt.query)
 		if !reflect.DeepEqual(got, tt.want) {
 			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.want, got)
 		}
-		if err != tt.err {
+		if !errors.Is(err, tt.err) {
 			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.err, err)
 		}
 	}
@@ -272,63 +286,43 @@ func TestGetVisitsByIP(t *testing.T) {
 	k := New(nil, mockDb)
 
 	type test struct {
-		name   string
-		ip     string
-		filter map[string]string
-		want   VisitsByIP
-		err    error
+		name  string
+		query VisitQuery
+		want  VisitsPage
+		err   error
 	}
 
-	gt, err := time.Parse("2006-01-02", "2020-01-01")
-	if err != nil {
-		t.Error(err)
-	}
-	lt, err := time.Parse("2006-01-02", "2021-01-01")
-	if err != nil {
-		t.Error(err)
-	}
+	day := VisitQuery{Weekdays: []time.Weekday{time.Monday}}
 	tests := []test{
 		{
-			name:   "all filters valid",
-			filter: map[string]string{"gt": "2020", "lt": "2021", "day": "Monday"},
-			want:   VisitsByIP{},
-			err:    nil,
-		},
-		{
-			name:   "day invalid",
-			filter: map[string]string{"gt": "2020", "lt": "2021", "day": "Mday"},
-			want:   nil,
-			err:    ErrInvalidFilter,
-		},
-		{
-			name:   "gt invalid",
-			filter: map[string]string{"gt": "abc", "lt": "2021", "day": "Monday"},
-			want:   nil,
-			err:    ErrInvalidFilter,
+			name:  "with filters",
+			query: day,
+			want:  VisitsPage{Visits: VisitsByIP{}},
+			err:   nil,
 		},
 		{
-			name:   "lt invalid",
-			filter: map[string]string{"gt": "2020", "lt": "abc", "day": "Monday"},
-			want:   nil,
-			err:    ErrInvalidFilter,
+			name:  "ips are replaced",
+			query: VisitQuery{IPs: []string{"other"}},
+			want:  VisitsPage{Visits: VisitsByIP{}},
+			err:   nil,
 		},
 		{
-			name:   "no filters",
-			filter: map[string]string{},
-			want:   VisitsByIP{},
-			err:    nil,
+			name:  "invalid hours",
+			query: VisitQuery{Hours: &HourRange{From: 0, To: 24}},
+			want:  VisitsPage{},
+			err:   ErrInvalidFilter,
 		},
 	}
 
-	mockDb.EXPECT().GetVisitsByIP("ip", "Monday", gt, lt).Return(VisitsByIP{}, nil).Times(1)
-	mockDb.EXPECT().GetVisitsByIP("ip", "", time.Time{}, time.Time{}).Return(VisitsByIP{}, nil).Times(1)
+	mockDb.EXPECT().GetVisits(VisitQuery{IPs: []string{"ip"}, Weekdays: day.Weekdays}).Return(VisitsPage{Visits: VisitsByIP{}}, nil).Times(1)
+	mockDb.EXPECT().GetVisits(VisitQuery{IPs: []string{"ip"}}).Return(VisitsPage{Visits: VisitsByIP{}}, nil).Times(1)
 
 	for _, tt := range tests {
-		got, err := k.GetVisitsByIP("ip", tt.filter)
+		got, err := k.GetVisitsByIP("ip", tt.query)
 		if !reflect.DeepEqual(got, tt.want) {
 			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.want, got)
 		}
-		if err != tt.err {
+		if !errors.Is(err, tt.err) {
 			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.err, err)
 		}
 	}
@@ -0,0 +1,74 @@
+package kcp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// ParamCIDR is query parameter of networks parsed by ParseNetworks.
+const ParamCIDR = "cidr"
+
+// ParseNetworks parses CIDR networks (e.g. 10.0.0.0/8 or 2001:db8::/32),
+// which can be repeated or comma separated.
+// Returned error is *FilterError.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range splitValues(cidrs) {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, &FilterError{Param: ParamCIDR, Value: v, Reason: "must be CIDR network, e.g. 10.0.0.0/8"}
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// NormalizeIP returns 16 byte form of ip, so that ipv4 and ipv6 addresses
+// can be compared byte by byte. Returns nil if ip is not valid.
+func NormalizeIP(ip string) net.IP {
+	if i := strings.IndexByte(ip, '%'); i >= 0 {
+		ip = ip[:i]
+	}
+	return net.ParseIP(ip).To16()
+}
+
+// NetworkRange returns first and last address of network in 16 byte form,
+// see NormalizeIP.
+func NetworkRange(n *net.IPNet) (net.IP, net.IP) {
+	first := n.IP.Mask(n.Mask)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^n.Mask[i]
+	}
+	return first.To16(), last.To16()
+}
+
+// inNetworks reports whether ip is in any of networks.
+func inNetworks(networks []*net.IPNet, ip string) bool {
+	addr := NormalizeIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range networks {
+		first, last := NetworkRange(n)
+		if bytes.Compare(addr, first) >= 0 && bytes.Compare(addr, last) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// GetVisitsByNetworks gets page of visits from ips in any of cidr networks
+// or from ips of query. At least one network or ip is required.
+func (k *Kcp) GetVisitsByNetworks(cidrs []string, q VisitQuery) (VisitsPage, error) {
+	networks, err := ParseNetworks(cidrs)
+	if err != nil {
+		return VisitsPage{}, err
+	}
+	if networks == nil && q.IPs == nil {
+		return VisitsPage{}, &FilterError{Param: ParamCIDR, Reason: "cidr or ip is required"}
+	}
+	q.Networks = networks
+	return k.GetVisits(q)
+}
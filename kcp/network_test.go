@@ -0,0 +1,165 @@
+package kcp
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func mustCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestParseNetworks(t *testing.T) {
+	type test struct {
+		cidrs []string
+		want  []*net.IPNet
+		err   error
+	}
+
+	tests := map[string]test{
+		"none":            {cidrs: nil, want: nil},
+		"repeated":        {cidrs: []string{"10.0.0.0/8", "2001:db8::/32"}, want: []*net.IPNet{mustCIDR("10.0.0.0/8"), mustCIDR("2001:db8::/32")}},
+		"comma separated": {cidrs: []string{"10.0.0.0/8, 192.168.1.0/24"}, want: []*net.IPNet{mustCIDR("10.0.0.0/8"), mustCIDR("192.168.1.0/24")}},
+		"ip without mask": {cidrs: []string{"10.0.0.1"}, err: ErrInvalidFilter},
+		"invalid":         {cidrs: []string{"10.0.0.0/33"}, err: ErrInvalidFilter},
+	}
+
+	for name, tt := range tests {
+		got, err := ParseNetworks(tt.cidrs)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
+		}
+	}
+}
+
+func TestNetworkRange(t *testing.T) {
+	type test struct {
+		first net.IP
+		last  net.IP
+	}
+
+	tests := map[string]test{
+		"10.0.0.0/8":      {first: net.ParseIP("10.0.0.0"), last: net.ParseIP("10.255.255.255")},
+		"192.168.1.17/24": {first: net.ParseIP("192.168.1.0"), last: net.ParseIP("192.168.1.255")},
+		"2001:db8::/32":   {first: net.ParseIP("2001:db8::"), last: net.ParseIP("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff")},
+	}
+
+	for cidr, tt := range tests {
+		first, last := NetworkRange(mustCIDR(cidr))
+		if !first.Equal(tt.first) || len(first) != net.IPv6len {
+			t.Errorf("%s: expected: %v, got: %v", cidr, tt.first, first)
+		}
+		if !last.Equal(tt.last) || len(last) != net.IPv6len {
+			t.Errorf("%s: expected: %v, got: %v", cidr, tt.last, last)
+		}
+	}
+}
+
+func TestVisitQueryMatchNetworks(t *testing.T) {
+	type test struct {
+		ip    string
+		query VisitQuery
+		want  bool
+	}
+
+	v4 := []*net.IPNet{mustCIDR("10.0.0.0/8")}
+	v6 := []*net.IPNet{mustCIDR("2001:db8::/32")}
+	tests := map[string]test{
+		"in network":         {ip: "10.1.2.3", query: VisitQuery{Networks: v4}, want: true},
+		"outside network":    {ip: "11.0.0.1", query: VisitQuery{Networks: v4}, want: false},
+		"ipv6 in network":    {ip: "2001:db8::1", query: VisitQuery{Networks: v6}, want: true},
+		"ipv6 outside":       {ip: "2001:db9::1", query: VisitQuery{Networks: v6}, want: false},
+		"ipv4 mapped":        {ip: "::ffff:10.0.0.1", query: VisitQuery{Networks: v4}, want: true},
+		"not an ip":          {ip: "ip", query: VisitQuery{Networks: v4}, want: false},
+		"listed ip":          {ip: "11.0.0.1", query: VisitQuery{IPs: []string{"11.0.0.1"}, Networks: v4}, want: true},
+		"not listed outside": {ip: "11.0.0.2", query: VisitQuery{IPs: []string{"11.0.0.1"}, Networks: v4}, want: false},
+	}
+
+	for name, tt := range tests {
+		if got := tt.query.Match(Event{IP: tt.ip}); got != tt.want {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
+		}
+	}
+}
+
+func TestGetVisitsByNetworks(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDb := NewMockDbConnector(mockCtrl)
+	k := New(nil, mockDb)
+
+	type test struct {
+		name  string
+		cidrs []string
+		query VisitQuery
+		want  VisitsPage
+		err   error
+	}
+
+	tests := []test{
+		{
+			name:  "networks",
+			cidrs: []string{"10.0.0.0/8"},
+			query: VisitQuery{},
+			want:  VisitsPage{Visits: VisitsByIP{}},
+			err:   nil,
+		},
+		{
+			name:  "networks and ips",
+			cidrs: []string{"10.0.0.0/8"},
+			query: VisitQuery{IPs: []string{"ip"}},
+			want:  VisitsPage{Visits: VisitsByIP{}},
+			err:   nil,
+		},
+		{
+			name:  "ips only",
+			cidrs: nil,
+			query: VisitQuery{IPs: []string{"ip"}},
+			want:  VisitsPage{Visits: VisitsByIP{}},
+			err:   nil,
+		},
+		{
+			name:  "no networks and ips",
+			cidrs: nil,
+			query: VisitQuery{},
+			want:  VisitsPage{},
+			err:   ErrInvalidFilter,
+		},
+		{
+			name:  "invalid network",
+			cidrs: []string{"10.0.0.0"},
+			query: VisitQuery{},
+			want:  VisitsPage{},
+			err:   ErrInvalidFilter,
+		},
+	}
+
+	networks := []*net.IPNet{mustCIDR("10.0.0.0/8")}
+	gomock.InOrder(
+		mockDb.EXPECT().GetVisits(VisitQuery{Networks: networks}).Return(VisitsPage{Visits: VisitsByIP{}}, nil).Times(1),
+		mockDb.EXPECT().GetVisits(VisitQuery{IPs: []string{"ip"}, Networks: networks}).Return(VisitsPage{Visits: VisitsByIP{}}, nil).Times(1),
+		mockDb.EXPECT().GetVisits(VisitQuery{IPs: []string{"ip"}}).Return(VisitsPage{Visits: VisitsByIP{}}, nil).Times(1),
+	)
+
+	for _, tt := range tests {
+		got, err := k.GetVisitsByNetworks(tt.cidrs, tt.query)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.want, got)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package kcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidFilter is returned if filter parameter is invalid.
+var ErrInvalidFilter = errors.New("invalid filter parameter")
+
+// FilterError describes which filter parameter is invalid and why.
+// It matches ErrInvalidFilter when compared using errors.Is.
+type FilterError struct {
+	Param  string
+	Value  string
+	Reason string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%v: %v=%q: %v", ErrInvalidFilter, e.Param, e.Value, e.Reason)
+}
+
+// Unwrap returns ErrInvalidFilter.
+func (e *FilterError) Unwrap() error {
+	return ErrInvalidFilter
+}
+
+// Order defines order of visits by visited_at.
+type Order string
+
+// Supported orders, empty Order is treated as OrderAsc.
+const (
+	OrderAsc  Order = "asc"
+	OrderDesc Order = "desc"
+)
+
+// TimeBound is lower or upper bound of time range.
+// Zero Time means range is not bounded.
+type TimeBound struct {
+	Time      time.Time
+	Inclusive bool
+}
+
+// IsZero reports whether bound is not set.
+func (b TimeBound) IsZero() bool {
+	return b.Time.IsZero()
+}
+
+// HourRange is range of hours of the day, From and To are inclusive.
+// Range wraps midnight if From is greater than To (e.g. 22 to 2).
+type HourRange struct {
+	From int
+	To   int
+}
+
+// Contains reports whether hour is in range.
+func (r HourRange) Contains(hour int) bool {
+	if r.From <= r.To {
+		return hour >= r.From && hour <= r.To
+	}
+	return hour >= r.From || hour <= r.To
+}
+
+// VisitQuery describes which visits to get.
+// Zero value matches all visits.
+type VisitQuery struct {
+	IPs []string
+	// Networks match ips in any of them, together with IPs
+	// they match visits from any of listed ips or networks.
+	Networks []*net.IPNet
+	From     TimeBound
+	To       TimeBound
+	Weekdays []time.Weekday
+	Hours    *HourRange
+	// Location is time zone of weekdays and hours, UTC if nil.
+	Location *time.Location
+	// Paths and Referrers match exactly or by prefix if value ends with *.
+	Paths     []string
+	Methods   []string
+	Referrers []string
+	// UserAgent matches user agents containing it, case insensitive.
+	UserAgent string
+	Limit     int
+	Order     Order
+	Cursor    string
+}
+
+// Query parameters parsed by ParseVisitQuery.
+const (
+	ParamIP        = "ip"
+	ParamTimeZone  = "tz"
+	ParamGt        = "gt"
+	ParamLt        = "lt"
+	ParamGte       = "gte"
+	ParamLte       = "lte"
+	ParamDay       = "day"
+	ParamHourFrom  = "hour_from"
+	ParamHourTo    = "hour_to"
+	ParamPath      = "path"
+	ParamMethod    = "method"
+	ParamReferrer  = "referrer"
+	ParamUserAgent = "user_agent"
+	ParamLimit     = "limit"
+	ParamOrder     = "order"
+	ParamCursor    = "cursor"
+)
+
+// ParseVisitQuery parses url query values into VisitQuery.
+//
+// Supported parameters:
+//  * ip - ip of visit, can be repeated or comma separated
+//  * tz - IANA time zone (e.g. Europe/Vilnius) of dates, days and hours, UTC by default
+//  * gt, lt - visited_at greater than, less than time
+//  * gte, lte - visited_at greater than or equal, less than or equal time, can not be combined with gt, lt
+//   * date yyyy-mm-dd containing at least year, midnight in time zone of tz
+//   * RFC 3339 timestamp, e.g. 2020-01-02T15:04:05Z
+//   * Unix epoch seconds, e.g. 1577977445
+//   * time relative to now, e.g. now-15m, now-1h, now-7d (day is 24 hours) or now-2w
+//  * day - day of the week, can be repeated or comma separated
+//  * hour_from, hour_to - inclusive hour of the day range from 0 to 23
+//  * path - request path, can be repeated or comma separated, matches prefix if it ends with *
+//  * method - request method, can be repeated or comma separated
+//  * referrer - referrer of request, can be repeated, matches prefix if it ends with *
+//  * user_agent - part of user agent, case insensitive
+//  * limit - max number of visits in page
+//  * order - asc or desc order by visited_at
+//  * cursor - opaque cursor of next page returned in VisitsPage, requires limit
+//
+// Returned error is *FilterError.
+func ParseVisitQuery(values url.Values) (VisitQuery, error) {
+	var q VisitQuery
+	var err error
+
+	q.IPs = splitValues(values[ParamIP])
+
+	if v := values.Get(ParamTimeZone); v != "" {
+		if q.Location, err = time.LoadLocation(v); err != nil {
+			return VisitQuery{}, &FilterError{Param: ParamTimeZone, Value: v, Reason: "must be IANA time zone, e.g. Europe/Vilnius"}
+		}
+	}
+
+	now := time.Now().UTC()
+	if q.From, err = parseBound(values, ParamGt, ParamGte, q.Loc(), now); err != nil {
+		return VisitQuery{}, err
+	}
+	if q.To, err = parseBound(values, ParamLt, ParamLte, q.Loc(), now); err != nil {
+		return VisitQuery{}, err
+	}
+
+	for _, v := range splitValues(values[ParamDay]) {
+		day, err := parseWeekday(v)
+		if err != nil {
+			return VisitQuery{}, &FilterError{Param: ParamDay, Value: v, Reason: err.Error()}
+		}
+		q.Weekdays = append(q.Weekdays, day)
+	}
+
+	from, to := values.Get(ParamHourFrom), values.Get(ParamHourTo)
+	if from != "" || to != "" {
+		q.Hours = &HourRange{From: 0, To: 23}
+		if from != "" {
+			if q.Hours.From, err = strconv.Atoi(from); err != nil {
+				return VisitQuery{}, &FilterError{Param: ParamHourFrom, Value: from, Reason: "must be a number"}
+			}
+		}
+		if to != "" {
+			if q.Hours.To, err = strconv.Atoi(to); err != nil {
+				return VisitQuery{}, &FilterError{Param: ParamHourTo, Value: to, Reason: "must be a number"}
+			}
+		}
+	}
+
+	q.Paths = splitValues(values[ParamPath])
+	for _, v := range splitValues(values[ParamMethod]) {
+		q.Methods = append(q.Methods, strings.ToUpper(v))
+	}
+	for _, v := range values[ParamReferrer] {
+		if v != "" {
+			q.Referrers = append(q.Referrers, v)
+		}
+	}
+	q.UserAgent = values.Get(ParamUserAgent)
+
+	if v := values.Get(ParamLimit); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return VisitQuery{}, &FilterError{Param: ParamLimit, Value: v, Reason: "must be a number"}
+		}
+	}
+
+	q.Order = Order(strings.ToLower(values.Get(ParamOrder)))
+	q.Cursor = values.Get(ParamCursor)
+
+	if err := q.Validate(); err != nil {
+		return VisitQuery{}, err
+	}
+	return q, nil
+}
+
+// Validate checks if query values are valid, returns *FilterError otherwise.
+func (q VisitQuery) Validate() error {
+	for _, ip := range q.IPs {
+		if ip == "" {
+			return &FilterError{Param: ParamIP, Value: ip, Reason: "must not be empty"}
+		}
+	}
+	for _, n := range q.Networks {
+		if n == nil {
+			return &FilterError{Param: ParamCIDR, Reason: "must not be empty"}
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Time.Before(q.From.Time) {
+		param, from := ParamLt, ParamGt
+		if q.To.Inclusive {
+			param = ParamLte
+		}
+		if q.From.Inclusive {
+			from = ParamGte
+		}
+		return &FilterError{Param: param, Value: q.To.Time.Format(time.RFC3339Nano), Reason: "must not be before " + from}
+	}
+	for _, day := range q.Weekdays {
+		if day < time.Sunday || day > time.Saturday {
+			return &FilterError{Param: ParamDay, Value: fmt.Sprint(int(day)), Reason: "unknown day of the week"}
+		}
+	}
+	if q.Hours != nil {
+		if q.Hours.From < 0 || q.Hours.From > 23 {
+			return &FilterError{Param: ParamHourFrom, Value: fmt.Sprint(q.Hours.From), Reason: "must be from 0 to 23"}
+		}
+		if q.Hours.To < 0 || q.Hours.To > 23 {
+			return &FilterError{Param: ParamHourTo, Value: fmt.Sprint(q.Hours.To), Reason: "must be from 0 to 23"}
+		}
+	}
+	for _, path := range q.Paths {
+		if path == "" {
+			return &FilterError{Param: ParamPath, Value: path, Reason: "must not be empty"}
+		}
+	}
+	for _, method := range q.Methods {
+		if !isMethod(method) {
+			return &FilterError{Param: ParamMethod, Value: method, Reason: "must be uppercase http method"}
+		}
+	}
+	for _, referrer := range q.Referrers {
+		if referrer == "" {
+			return &FilterError{Param: ParamReferrer, Value: referrer, Reason: "must not be empty"}
+		}
+	}
+	if q.Limit < 0 {
+		return &FilterError{Param: ParamLimit, Value: fmt.Sprint(q.Limit), Reason: "must not be negative"}
+	}
+	switch q.Order {
+	case "", OrderAsc, OrderDesc:
+	default:
+		return &FilterError{Param: ParamOrder, Value: string(q.Order), Reason: "must be asc or desc"}
+	}
+	if q.Cursor != "" && q.Limit == 0 {
+		return &FilterError{Param: ParamCursor, Value: q.Cursor, Reason: "requires limit"}
+	}
+	return nil
+}
+
+// VisitsPage contains visits grouped by ip and cursor of next page.
+// NextCursor is empty if there are no more visits.
+type VisitsPage struct {
+	Visits     VisitsByIP `json:"visits"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// Match reports whether visit event matches query filters.
+// Limit and order are not checked.
+func (q VisitQuery) Match(e Event) bool {
+	t := e.VisitedAt
+	if (q.IPs != nil || q.Networks != nil) && !containsString(q.IPs, e.IP) && !inNetworks(q.Networks, e.IP) {
+		return false
+	}
+	if !q.From.IsZero() && (t.Before(q.From.Time) || !q.From.Inclusive && t.Equal(q.From.Time)) {
+		return false
+	}
+	if !q.To.IsZero() && (t.After(q.To.Time) || !q.To.Inclusive && t.Equal(q.To.Time)) {
+		return false
+	}
+	if q.Weekdays != nil && !containsWeekday(q.Weekdays, t.In(q.Loc()).Weekday()) {
+		return false
+	}
+	if q.Hours != nil && !q.Hours.Contains(t.In(q.Loc()).Hour()) {
+		return false
+	}
+	if q.Paths != nil && !matchPatterns(q.Paths, e.Path) {
+		return false
+	}
+	if q.Methods != nil && !containsString(q.Methods, e.Method) {
+		return false
+	}
+	if q.Referrers != nil && !matchPatterns(q.Referrers, e.Referrer) {
+		return false
+	}
+	if q.UserAgent != "" && !strings.Contains(strings.ToLower(e.UserAgent), strings.ToLower(q.UserAgent)) {
+		return false
+	}
+	return true
+}
+
+// HasRequestFilters reports whether query filters visits by request path, method, referrer or user agent.
+func (q VisitQuery) HasRequestFilters() bool {
+	return q.Paths != nil || q.Methods != nil || q.Referrers != nil || q.UserAgent != ""
+}
+
+// IsPrefixPattern reports whether path or referrer filter value matches by prefix
+// and returns the prefix.
+func IsPrefixPattern(pattern string) (string, bool) {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.TrimSuffix(pattern, "*"), true
+	}
+	return pattern, false
+}
+
+// Loc returns time zone of query, UTC if Location is not set.
+func (q VisitQuery) Loc() *time.Location {
+	if q.Location == nil {
+		return time.UTC
+	}
+	return q.Location
+}
+
+// IsUTC reports whether query time zone is UTC, in which weekdays match Event.Day.
+func (q VisitQuery) IsUTC() bool {
+	return q.Loc() == time.UTC
+}
+
+// Days returns names of query weekdays as stored in Event.Day.
+func (q VisitQuery) Days() []string {
+	var days []string
+	for _, day := range q.Weekdays {
+		days = append(days, day.String())
+	}
+	return days
+}
+
+// Desc reports whether visits are ordered from latest.
+func (q VisitQuery) Desc() bool {
+	return q.Order == OrderDesc
+}
+
+func containsString(s []string, v string) bool {
+	for _, val := range s {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPatterns reports whether v matches any of path or referrer patterns.
+func matchPatterns(patterns []string, v string) bool {
+	for _, p := range patterns {
+		if prefix, ok := IsPrefixPattern(p); ok && strings.HasPrefix(v, prefix) || !ok && p == v {
+			return true
+		}
+	}
+	return false
+}
+
+// isMethod reports whether method consists of uppercase letters.
+func isMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, r := range method {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func containsWeekday(s []time.Weekday, v time.Weekday) bool {
+	for _, val := range s {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// splitValues splits comma separated values and removes empty ones.
+func splitValues(values []string) []string {
+	var res []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if day == d.String() {
+			return d, nil
+		}
+	}
+	return 0, errors.New("unknown day of the week")
+}
+
+// errInvalidTime is reason of invalid time bound.
+var errInvalidTime = errors.New("must be date yyyy-mm-dd containing at least year, RFC 3339 timestamp, " +
+	"Unix epoch seconds or time relative to now, e.g. now-1h")
+
+// parseBound parses time bound from exclusive or inclusive parameter,
+// only one of them can be set. Returns zero TimeBound if neither is set.
+func parseBound(values url.Values, exclusive, inclusive string, loc *time.Location, now time.Time) (TimeBound, error) {
+	ex, in := values.Get(exclusive), values.Get(inclusive)
+	if ex != "" && in != "" {
+		return TimeBound{}, &FilterError{Param: inclusive, Value: in, Reason: "can not be combined with " + exclusive}
+	}
+	param, v := exclusive, ex
+	if in != "" {
+		param, v = inclusive, in
+	}
+	if v == "" {
+		return TimeBound{}, nil
+	}
+	t, err := parseTime(v, loc, now)
+	if err != nil {
+		return TimeBound{}, &FilterError{Param: param, Value: v, Reason: err.Error()}
+	}
+	return TimeBound{Time: t, Inclusive: in != ""}, nil
+}
+
+// parseTime parses time relative to now, Unix epoch seconds, RFC 3339 timestamp
+// or date at midnight in loc. Numbers up to 4 digits are years, longer ones are epoch seconds.
+func parseTime(v string, loc *time.Location, now time.Time) (time.Time, error) {
+	switch {
+	case strings.HasPrefix(v, "now"):
+		return parseRelative(strings.TrimPrefix(v, "now"), now)
+	case len(v) > 4 && isDigits(v):
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, errInvalidTime
+		}
+		return time.Unix(sec, 0).UTC(), nil
+	case strings.Contains(v, "T"):
+		// Plus sign of offset is decoded as space, if it is not escaped in url.
+		t, err := time.Parse(time.RFC3339Nano, strings.Replace(v, " ", "+", 1))
+		if err != nil {
+			return time.Time{}, errInvalidTime
+		}
+		return t, nil
+	}
+	t, err := parseDate(v, loc)
+	if err != nil {
+		return time.Time{}, errInvalidTime
+	}
+	return t, nil
+}
+
+// parseRelative parses offset from now, e.g. -15m, -1h, -7d or +1w.
+// Empty offset is now, days and weeks are 24 and 168 hours.
+func parseRelative(offset string, now time.Time) (time.Time, error) {
+	if offset == "" {
+		return now, nil
+	}
+	sign, v := offset[0], offset[1:]
+	if sign != '-' && sign != '+' && sign != ' ' || v == "" || !isDigits(v[:1]) {
+		// Plus sign is decoded as space, if it is not escaped in url.
+		return time.Time{}, errInvalidTime
+	}
+
+	var d time.Duration
+	switch unit := v[len(v)-1]; unit {
+	case 'd', 'w':
+		n, err := strconv.Atoi(v[:len(v)-1])
+		if err != nil {
+			return time.Time{}, errInvalidTime
+		}
+		d = time.Duration(n) * time.Hour * 24
+		if unit == 'w' {
+			d *= 7
+		}
+	default:
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return time.Time{}, errInvalidTime
+		}
+	}
+	if sign == '-' {
+		d = -d
+	}
+	return now.Add(d), nil
+}
+
+// isDigits reports whether v consists of decimal digits.
+func isDigits(v string) bool {
+	for _, r := range v {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return v != ""
+}
+
+// parseDate parses date at midnight in loc.
+func parseDate(unf string, loc *time.Location) (time.Time, error) {
+	// add month and day if missing
+	for i := len(strings.Split(unf, "-")); i < 3; i++ {
+		unf += "-01"
+	}
+
+	f, err := time.ParseInLocation("2006-01-02", unf, loc)
+	if err != nil {
+		return time.Time{}, errors.New("must be date yyyy-mm-dd, containing at least year")
+	}
+	return f, nil
+}
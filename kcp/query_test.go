@@ -0,0 +1,303 @@
+package kcp
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	vilnius, err := time.LoadLocation("Europe/Vilnius")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type test struct {
+		value string
+		loc   *time.Location
+		want  time.Time
+		err   bool
+	}
+
+	tests := map[string]test{
+		"year": {
+			value: "2020",
+			want:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"year month": {
+			value: "2020-05",
+			want:  time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"year month day": {
+			value: "2020-05-05",
+			want:  time.Date(2020, 5, 5, 0, 0, 0, 0, time.UTC),
+		},
+		"time zone": {
+			value: "2020-05-05",
+			loc:   vilnius,
+			want:  time.Date(2020, 5, 4, 21, 0, 0, 0, time.UTC),
+		},
+		"invalid year": {
+			value: "abc",
+			want:  time.Time{},
+			err:   true,
+		},
+	}
+
+	for name, tt := range tests {
+		if tt.loc == nil {
+			tt.loc = time.UTC
+		}
+		got, err := parseDate(tt.value, tt.loc)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error: %v, got: %v", name, tt.err, err)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	vilnius, err := time.LoadLocation("Europe/Vilnius")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 3, 10, 12, 30, 0, 0, time.UTC)
+
+	type test struct {
+		value string
+		loc   *time.Location
+		want  time.Time
+		err   bool
+	}
+
+	tests := map[string]test{
+		"date":                  {value: "2020-05-05", loc: vilnius, want: time.Date(2020, 5, 4, 21, 0, 0, 0, time.UTC)},
+		"rfc 3339":              {value: "2020-05-05T10:00:00Z", want: time.Date(2020, 5, 5, 10, 0, 0, 0, time.UTC)},
+		"rfc 3339 offset":       {value: "2020-05-05T10:00:00.5+02:00", want: time.Date(2020, 5, 5, 8, 0, 0, 5e8, time.UTC)},
+		"unescaped plus":        {value: "2020-05-05T10:00:00 02:00", want: time.Date(2020, 5, 5, 8, 0, 0, 0, time.UTC)},
+		"epoch seconds":         {value: "1588672800", want: time.Date(2020, 5, 5, 10, 0, 0, 0, time.UTC)},
+		"now":                   {value: "now", want: now},
+		"minutes ago":           {value: "now-15m", want: now.Add(-time.Minute * 15)},
+		"hours ago":             {value: "now-1h30m", want: now.Add(-time.Minute * 90)},
+		"days ago":              {value: "now-7d", want: now.Add(-time.Hour * 24 * 7)},
+		"weeks ago":             {value: "now-2w", want: now.Add(-time.Hour * 24 * 14)},
+		"from now":              {value: "now+1h", want: now.Add(time.Hour)},
+		"invalid":               {value: "abc", err: true},
+		"invalid rfc 3339":      {value: "2020-05-05T10:00", err: true},
+		"invalid relative":      {value: "now-h", err: true},
+		"relative without sign": {value: "now1h", err: true},
+		"double sign":           {value: "now--1h", err: true},
+		"fractional days":       {value: "now-1.5d", err: true},
+	}
+
+	for name, tt := range tests {
+		if tt.loc == nil {
+			tt.loc = time.UTC
+		}
+		got, err := parseTime(tt.value, tt.loc, now)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error: %v, got: %v", name, tt.err, err)
+		}
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	type test struct {
+		value string
+		want  time.Weekday
+		err   bool
+	}
+
+	tests := map[string]test{
+		"valid day": {
+			value: "Monday",
+			want:  time.Monday,
+		},
+		"sunday": {
+			value: "Sunday",
+			want:  time.Sunday,
+		},
+		"invalid day": {
+			value: "Mday",
+			err:   true,
+		},
+	}
+
+	for name, tt := range tests {
+		got, err := parseWeekday(tt.value)
+		if got != tt.want {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error: %v, got: %v", name, tt.err, err)
+		}
+	}
+}
+
+func TestParseVisitQuery(t *testing.T) {
+	vilnius, err := time.LoadLocation("Europe/Vilnius")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type test struct {
+		values url.Values
+		want   VisitQuery
+		param  string
+	}
+
+	tests := map[string]test{
+		"no values": {
+			values: url.Values{},
+			want:   VisitQuery{},
+		},
+		"all values": {
+			values: url.Values{
+				"ip":         {"1.1.1.1,2.2.2.2", "3.3.3.3"},
+				"gt":         {"2020"},
+				"lt":         {"2020-02-03"},
+				"day":        {"Monday,Friday"},
+				"hour_from":  {"22"},
+				"hour_to":    {"2"},
+				"path":       {"/api/visits,/blog/*"},
+				"method":     {"post"},
+				"referrer":   {"https://example.com/a,b"},
+				"user_agent": {"Firefox"},
+				"limit":      {"10"},
+				"order":      {"DESC"},
+				"cursor":     {"abc"},
+			},
+			want: VisitQuery{
+				IPs:       []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+				From:      TimeBound{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+				To:        TimeBound{Time: time.Date(2020, 2, 3, 0, 0, 0, 0, time.UTC)},
+				Weekdays:  []time.Weekday{time.Monday, time.Friday},
+				Hours:     &HourRange{From: 22, To: 2},
+				Paths:     []string{"/api/visits", "/blog/*"},
+				Methods:   []string{"POST"},
+				Referrers: []string{"https://example.com/a,b"},
+				UserAgent: "Firefox",
+				Limit:     10,
+				Order:     OrderDesc,
+				Cursor:    "abc",
+			},
+		},
+		"time zone": {
+			values: url.Values{"tz": {"Europe/Vilnius"}, "gt": {"2020-07"}, "day": {"Monday"}},
+			want: VisitQuery{
+				From:     TimeBound{Time: time.Date(2020, 7, 1, 0, 0, 0, 0, vilnius)},
+				Weekdays: []time.Weekday{time.Monday},
+				Location: vilnius,
+			},
+		},
+		"inclusive bounds": {
+			values: url.Values{"gte": {"1577836800"}, "lte": {"2020-01-01T12:00:00Z"}},
+			want: VisitQuery{
+				From: TimeBound{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Inclusive: true},
+				To:   TimeBound{Time: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), Inclusive: true},
+			},
+		},
+		"only hour to": {
+			values: url.Values{"hour_to": {"5"}},
+			want:   VisitQuery{Hours: &HourRange{From: 0, To: 5}},
+		},
+		"invalid tz":     {values: url.Values{"tz": {"Europe/Nowhere"}}, param: ParamTimeZone},
+		"invalid gt":     {values: url.Values{"gt": {"abc"}}, param: ParamGt},
+		"invalid lt":     {values: url.Values{"lt": {"abc"}}, param: ParamLt},
+		"lt before gt":   {values: url.Values{"gt": {"2021"}, "lt": {"2020"}}, param: ParamLt},
+		"lte before gte": {values: url.Values{"gte": {"2021"}, "lte": {"2020"}}, param: ParamLte},
+		"gt and gte":     {values: url.Values{"gt": {"2021"}, "gte": {"2021"}}, param: ParamGte},
+		"lt and lte":     {values: url.Values{"lt": {"2021"}, "lte": {"2021"}}, param: ParamLte},
+		"invalid gte":    {values: url.Values{"gte": {"now-1x"}}, param: ParamGte},
+		"invalid day":    {values: url.Values{"day": {"Monday,Mday"}}, param: ParamDay},
+		"invalid hour":   {values: url.Values{"hour_from": {"24"}}, param: ParamHourFrom},
+		"hour nan":       {values: url.Values{"hour_to": {"abc"}}, param: ParamHourTo},
+		"invalid method": {values: url.Values{"method": {"po-st"}}, param: ParamMethod},
+		"invalid limit":  {values: url.Values{"limit": {"-1"}}, param: ParamLimit},
+		"invalid order":  {values: url.Values{"order": {"up"}}, param: ParamOrder},
+		"cursor only":    {values: url.Values{"cursor": {"abc"}}, param: ParamCursor},
+	}
+
+	for name, tt := range tests {
+		got, err := ParseVisitQuery(tt.values)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected: %+v, got: %+v", name, tt.want, got)
+		}
+		if tt.param == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+			}
+			continue
+		}
+		var ferr *FilterError
+		if !errors.As(err, &ferr) || ferr.Param != tt.param {
+			t.Errorf("%s: expected invalid %v, got: %v", name, tt.param, err)
+		}
+		if !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: expected: %v, got: %v", name, ErrInvalidFilter, err)
+		}
+	}
+}
+
+func TestVisitQueryMatch(t *testing.T) {
+	vilnius, err := time.LoadLocation("Europe/Vilnius")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wednesday.
+	visit := time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC)
+	event := Event{
+		IP:        "ip",
+		VisitedAt: visit,
+		Path:      "/blog/post",
+		Method:    "POST",
+		Referrer:  "https://example.com/page",
+		UserAgent: "Mozilla/5.0 Firefox/84.0",
+	}
+
+	type test struct {
+		query VisitQuery
+		want  bool
+	}
+
+	tests := map[string]test{
+		"no filters":          {query: VisitQuery{}, want: true},
+		"other ip":            {query: VisitQuery{IPs: []string{"other"}}, want: false},
+		"same ip":             {query: VisitQuery{IPs: []string{"other", "ip"}}, want: true},
+		"exclusive from":      {query: VisitQuery{From: TimeBound{Time: visit}}, want: false},
+		"inclusive from":      {query: VisitQuery{From: TimeBound{Time: visit, Inclusive: true}}, want: true},
+		"exclusive to":        {query: VisitQuery{To: TimeBound{Time: visit}}, want: false},
+		"inclusive to":        {query: VisitQuery{To: TimeBound{Time: visit, Inclusive: true}}, want: true},
+		"other weekday":       {query: VisitQuery{Weekdays: []time.Weekday{time.Monday}}, want: false},
+		"same weekday":        {query: VisitQuery{Weekdays: []time.Weekday{time.Wednesday}}, want: true},
+		"hours":               {query: VisitQuery{Hours: &HourRange{From: 20, To: 23}}, want: true},
+		"other hours":         {query: VisitQuery{Hours: &HourRange{From: 1, To: 22}}, want: false},
+		"hours over midnight": {query: VisitQuery{Hours: &HourRange{From: 23, To: 1}}, want: true},
+		"same path":           {query: VisitQuery{Paths: []string{"/other", "/blog/post"}}, want: true},
+		"path prefix":         {query: VisitQuery{Paths: []string{"/blog/*"}}, want: true},
+		"other path":          {query: VisitQuery{Paths: []string{"/blog"}}, want: false},
+		"same method":         {query: VisitQuery{Methods: []string{"POST"}}, want: true},
+		"other method":        {query: VisitQuery{Methods: []string{"GET"}}, want: false},
+		"referrer prefix":     {query: VisitQuery{Referrers: []string{"https://example.com/*"}}, want: true},
+		"other referrer":      {query: VisitQuery{Referrers: []string{"https://example.com/"}}, want: false},
+		"user agent":          {query: VisitQuery{UserAgent: "firefox"}, want: true},
+		"other user agent":    {query: VisitQuery{UserAgent: "Chrome"}, want: false},
+		"weekday in tz":       {query: VisitQuery{Weekdays: []time.Weekday{time.Thursday}, Location: vilnius}, want: true},
+		"other weekday in tz": {query: VisitQuery{Weekdays: []time.Weekday{time.Wednesday}, Location: vilnius}, want: false},
+		"hours in tz":         {query: VisitQuery{Hours: &HourRange{From: 1, To: 1}, Location: vilnius}, want: true},
+	}
+
+	for name, tt := range tests {
+		if got := tt.query.Match(event); got != tt.want {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
+		}
+	}
+}
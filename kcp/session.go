@@ -0,0 +1,325 @@
+package kcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// DefaultSessionGap is inactivity gap used if Kcp.SessionGap is not set.
+const DefaultSessionGap = time.Minute * 30
+
+// DefaultMaxSessionVisits is limit of visits used if Kcp.MaxSessionVisits is not set.
+const DefaultMaxSessionVisits = 100000
+
+// Session contains consecutive visits from same ip and user agent,
+// each of them within inactivity gap from previous one.
+type Session struct {
+	IP        string
+	UserAgent string
+	Start     time.Time
+	End       time.Time
+	Visits    int64
+	// LastID is id of last event applied by SessionizeVisit, so its redelivery is ignored.
+	LastID string
+}
+
+// Duration returns time between first and last visit of session.
+func (s Session) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// MarshalJSON encodes session with its duration in seconds.
+func (s Session) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		IP        string    `json:"ip"`
+		UserAgent string    `json:"user_agent,omitempty"`
+		Start     time.Time `json:"start"`
+		End       time.Time `json:"end"`
+		Duration  float64   `json:"duration"`
+		Visits    int64     `json:"visits"`
+	}{s.IP, s.UserAgent, s.Start, s.End, s.Duration().Seconds(), s.Visits})
+}
+
+// SessionStats contains aggregates of sessions, durations are in seconds.
+type SessionStats struct {
+	Sessions  int64 `json:"sessions"`
+	Visits    int64 `json:"visits"`
+	UniqueIPs int64 `json:"unique_ips"`
+	// Bounces is number of sessions with single visit.
+	Bounces     int64   `json:"bounces"`
+	AvgVisits   float64 `json:"avg_visits"`
+	AvgDuration float64 `json:"avg_duration"`
+	MaxDuration float64 `json:"max_duration"`
+}
+
+// SessionsPage contains sessions and aggregates of all sessions matching query.
+type SessionsPage struct {
+	Sessions []Session    `json:"sessions"`
+	Stats    SessionStats `json:"stats"`
+}
+
+// SessionSource defines where sessions are read from.
+type SessionSource string
+
+// Supported sources of sessions, empty SessionSource is treated as SourceVisits.
+const (
+	// SourceVisits computes sessions on demand from stored visits.
+	SourceVisits SessionSource = "visits"
+	// SourceStream reads sessions stored by SessionizeVisit from stream of events.
+	SourceStream SessionSource = "stream"
+)
+
+// Query parameters parsed by ParseSessionQuery.
+const (
+	ParamGap    = "gap"
+	ParamSource = "source"
+)
+
+// SessionQuery describes which sessions to get.
+// Filters of VisitQuery are applied to visits before they are grouped into sessions,
+// limit and order apply to sessions.
+// Sessions read from SourceStream support only ip, time bounds checked against
+// start of session, user agent, limit and order.
+type SessionQuery struct {
+	VisitQuery
+	// Gap is inactivity gap of sessions computed from visits, Kcp.SessionGap is used if zero.
+	Gap    time.Duration
+	Source SessionSource
+}
+
+// ParseSessionQuery parses url query values into SessionQuery.
+// Supports gap parameter as duration (e.g. 30m), source parameter visits (default) or stream
+// and same filters as ParseVisitQuery, except cursor.
+// Returned error is *FilterError.
+func ParseSessionQuery(values url.Values) (SessionQuery, error) {
+	vq, err := ParseVisitQuery(values)
+	if err != nil {
+		return SessionQuery{}, err
+	}
+	q := SessionQuery{VisitQuery: vq, Source: SessionSource(values.Get(ParamSource))}
+	if q.Source == "" {
+		q.Source = SourceVisits
+	}
+	if v := values.Get(ParamGap); v != "" {
+		if q.Gap, err = time.ParseDuration(v); err != nil {
+			return SessionQuery{}, &FilterError{Param: ParamGap, Value: v, Reason: "must be duration, e.g. 30m"}
+		}
+	}
+	if err := q.Validate(); err != nil {
+		return SessionQuery{}, err
+	}
+	return q, nil
+}
+
+// Validate checks if query values are valid, returns *FilterError otherwise.
+func (q SessionQuery) Validate() error {
+	switch q.Source {
+	case "", SourceVisits:
+	case SourceStream:
+		if err := q.streamFiltersError(); err != nil {
+			return err
+		}
+	default:
+		return &FilterError{Param: ParamSource, Value: string(q.Source), Reason: "must be visits or stream"}
+	}
+	if q.Gap < 0 {
+		return &FilterError{Param: ParamGap, Value: q.Gap.String(), Reason: "must not be negative"}
+	}
+	if q.Cursor != "" {
+		return &FilterError{Param: ParamCursor, Value: q.Cursor, Reason: "not supported by sessions"}
+	}
+	return q.VisitQuery.Validate()
+}
+
+// streamFiltersError returns *FilterError for first filter,
+// which can not be applied to stored sessions.
+func (q SessionQuery) streamFiltersError() error {
+	const reason = "not supported by stream sessions"
+	switch {
+	case q.Gap != 0:
+		return &FilterError{Param: ParamGap, Value: q.Gap.String(), Reason: reason}
+	case q.Networks != nil:
+		return &FilterError{Param: ParamCIDR, Value: q.Networks[0].String(), Reason: reason}
+	case q.Weekdays != nil:
+		return &FilterError{Param: ParamDay, Value: q.Weekdays[0].String(), Reason: reason}
+	case q.Hours != nil:
+		return &FilterError{Param: ParamHourFrom, Value: fmt.Sprint(q.Hours.From), Reason: reason}
+	case q.Paths != nil:
+		return &FilterError{Param: ParamPath, Value: q.Paths[0], Reason: reason}
+	case q.Methods != nil:
+		return &FilterError{Param: ParamMethod, Value: q.Methods[0], Reason: reason}
+	case q.Referrers != nil:
+		return &FilterError{Param: ParamReferrer, Value: q.Referrers[0], Reason: reason}
+	}
+	return nil
+}
+
+// Match reports whether stored session matches query filters supported by SourceStream.
+// Time bounds are checked against start of session.
+func (q SessionQuery) Match(s Session) bool {
+	return q.VisitQuery.Match(Event{IP: s.IP, VisitedAt: s.Start, UserAgent: s.UserAgent})
+}
+
+// sessionKey identifies visitor, whose visits are grouped into sessions.
+type sessionKey struct {
+	ip        string
+	userAgent string
+}
+
+// Sessionize groups events into sessions of same ip and user agent.
+// Event starts new session if it is more than gap after previous event of session.
+// Returned sessions are ordered by start.
+func Sessionize(events []Event, gap time.Duration) []Session {
+	sorted := append([]Event(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].VisitedAt.Before(sorted[j].VisitedAt)
+	})
+
+	sessions := []Session{}
+	last := make(map[sessionKey]int)
+	for _, e := range sorted {
+		k := sessionKey{ip: e.IP, userAgent: e.UserAgent}
+		if i, ok := last[k]; ok && e.VisitedAt.Sub(sessions[i].End) <= gap {
+			sessions[i].End = e.VisitedAt
+			sessions[i].Visits++
+			continue
+		}
+		last[k] = len(sessions)
+		sessions = append(sessions, Session{IP: e.IP, UserAgent: e.UserAgent, Start: e.VisitedAt, End: e.VisitedAt, Visits: 1})
+	}
+	return sessions
+}
+
+// SummarizeSessions returns aggregates of sessions.
+func SummarizeSessions(sessions []Session) SessionStats {
+	var stats SessionStats
+	var total time.Duration
+	ips := make(map[string]struct{})
+	for _, s := range sessions {
+		stats.Sessions++
+		stats.Visits += s.Visits
+		if s.Visits == 1 {
+			stats.Bounces++
+		}
+		if _, ok := ips[s.IP]; !ok {
+			ips[s.IP] = struct{}{}
+			stats.UniqueIPs++
+		}
+		d := s.Duration()
+		total += d
+		if d.Seconds() > stats.MaxDuration {
+			stats.MaxDuration = d.Seconds()
+		}
+	}
+	if stats.Sessions > 0 {
+		stats.AvgVisits = float64(stats.Visits) / float64(stats.Sessions)
+		stats.AvgDuration = total.Seconds() / float64(stats.Sessions)
+	}
+	return stats
+}
+
+// GetSessions validates query and gets sessions with aggregates of all matching sessions.
+// Sessions are computed from stored visits using query gap,
+// or read from sessions stored by SessionizeVisit if source is SourceStream.
+// Computing sessions from more than Kcp.MaxSessionVisits visits is rejected with *FilterError,
+// time range of query must be narrowed then.
+func (k *Kcp) GetSessions(q SessionQuery) (SessionsPage, error) {
+	if err := q.Validate(); err != nil {
+		return SessionsPage{}, err
+	}
+
+	var sessions []Session
+	if q.Source == SourceStream {
+		var err error
+		if sessions, err = k.DbConnector.GetSessions(q); err != nil {
+			return SessionsPage{}, err
+		}
+	} else {
+		// Limit and order apply to sessions, not visits,
+		// single visit above max is read to tell if there are more.
+		max := k.maxSessionVisits()
+		vq := q.VisitQuery
+		vq.Limit, vq.Order = max+1, ""
+		events, err := k.GetEvents(vq)
+		if err != nil {
+			return SessionsPage{}, err
+		}
+		if len(events) > max {
+			return SessionsPage{}, sessionVisitsError(q.To, max)
+		}
+		sessions = Sessionize(events, k.sessionGap(q.Gap))
+	}
+
+	page := SessionsPage{Sessions: make([]Session, 0, len(sessions)), Stats: SummarizeSessions(sessions)}
+	for i := range sessions {
+		if q.Desc() {
+			i = len(sessions) - 1 - i
+		}
+		page.Sessions = append(page.Sessions, sessions[i])
+	}
+	if q.Limit > 0 && len(page.Sessions) > q.Limit {
+		page.Sessions = page.Sessions[:q.Limit]
+	}
+	return page, nil
+}
+
+// SessionizeVisit applies visit Event to stored sessions of its ip and user agent.
+// Event extends last session if it is within Kcp.SessionGap from its end,
+// otherwise new session is started.
+// Events of same ip are expected in order of visit, as they are in partition of stream,
+// so event before end of last session or last applied event itself is treated as redelivered
+// and ignored. Other event visited at end of last session is part of it.
+func (k *Kcp) SessionizeVisit(event Event) error {
+	s, err := k.LastSession(event.IP, event.UserAgent)
+	if err != nil {
+		return err
+	}
+	switch {
+	case s.Visits > 0 && (event.VisitedAt.Before(s.End) || event.VisitedAt.Equal(s.End) && event.ID == s.LastID):
+		// Event was already applied.
+		return nil
+	case s.Visits > 0 && event.VisitedAt.Sub(s.End) <= k.sessionGap(0):
+		s.End = event.VisitedAt
+		s.Visits++
+		s.LastID = event.ID
+	default:
+		s = Session{IP: event.IP, UserAgent: event.UserAgent, Start: event.VisitedAt, End: event.VisitedAt, Visits: 1, LastID: event.ID}
+	}
+	return k.SaveSession(s)
+}
+
+// sessionVisitsError returns *FilterError of upper time bound, which should be lowered
+// for sessions to be computed from at most max visits.
+func sessionVisitsError(to TimeBound, max int) error {
+	err := &FilterError{Param: ParamLt, Reason: fmt.Sprintf("range contains more than %v visits, narrow it", max)}
+	if to.Inclusive {
+		err.Param = ParamLte
+	}
+	if !to.IsZero() {
+		err.Value = to.Time.Format(time.RFC3339Nano)
+	}
+	return err
+}
+
+// maxSessionVisits returns Kcp.MaxSessionVisits if it is set, otherwise DefaultMaxSessionVisits.
+func (k *Kcp) maxSessionVisits() int {
+	if k.MaxSessionVisits > 0 {
+		return k.MaxSessionVisits
+	}
+	return DefaultMaxSessionVisits
+}
+
+// sessionGap returns gap if it is set, otherwise Kcp.SessionGap or DefaultSessionGap.
+func (k *Kcp) sessionGap(gap time.Duration) time.Duration {
+	switch {
+	case gap > 0:
+		return gap
+	case k.SessionGap > 0:
+		return k.SessionGap
+	default:
+		return DefaultSessionGap
+	}
+}
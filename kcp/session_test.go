@@ -0,0 +1,303 @@
+package kcp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSessionize(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Minute * time.Duration(minutes))
+	}
+
+	type test struct {
+		events []Event
+		want   []Session
+	}
+
+	tests := map[string]test{
+		"no events": {events: nil, want: []Session{}},
+		"within gap": {
+			events: []Event{{IP: "ip", VisitedAt: at(0)}, {IP: "ip", VisitedAt: at(30)}, {IP: "ip", VisitedAt: at(50)}},
+			want:   []Session{{IP: "ip", Start: at(0), End: at(50), Visits: 3}},
+		},
+		"gap exceeded": {
+			events: []Event{{IP: "ip", VisitedAt: at(0)}, {IP: "ip", VisitedAt: at(31)}},
+			want:   []Session{{IP: "ip", Start: at(0), End: at(0), Visits: 1}, {IP: "ip", Start: at(31), End: at(31), Visits: 1}},
+		},
+		"unordered events": {
+			events: []Event{{IP: "ip", VisitedAt: at(20)}, {IP: "ip", VisitedAt: at(0)}},
+			want:   []Session{{IP: "ip", Start: at(0), End: at(20), Visits: 2}},
+		},
+		"other ip and user agent": {
+			events: []Event{
+				{IP: "ip", UserAgent: "firefox", VisitedAt: at(0)},
+				{IP: "other", UserAgent: "firefox", VisitedAt: at(1)},
+				{IP: "ip", UserAgent: "chrome", VisitedAt: at(2)},
+				{IP: "ip", UserAgent: "firefox", VisitedAt: at(3)},
+			},
+			want: []Session{
+				{IP: "ip", UserAgent: "firefox", Start: at(0), End: at(3), Visits: 2},
+				{IP: "other", UserAgent: "firefox", Start: at(1), End: at(1), Visits: 1},
+				{IP: "ip", UserAgent: "chrome", Start: at(2), End: at(2), Visits: 1},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		if got := Sessionize(tt.events, time.Minute*30); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.want, got)
+		}
+	}
+}
+
+func TestSummarizeSessions(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	sessions := []Session{
+		{IP: "ip", Start: start, End: start.Add(time.Minute), Visits: 3},
+		{IP: "ip", Start: start.Add(time.Hour), End: start.Add(time.Hour), Visits: 1},
+		{IP: "other", Start: start, End: start.Add(time.Minute * 2), Visits: 2},
+	}
+	want := SessionStats{Sessions: 3, Visits: 6, UniqueIPs: 2, Bounces: 1, AvgVisits: 2, AvgDuration: 60, MaxDuration: 120}
+
+	if got := SummarizeSessions(sessions); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected: %+v, got: %+v", want, got)
+	}
+	if got := SummarizeSessions(nil); !reflect.DeepEqual(got, SessionStats{}) {
+		t.Errorf("expected: %+v, got: %+v", SessionStats{}, got)
+	}
+}
+
+func TestSessionMarshalJSON(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	s := Session{IP: "ip", Start: start, End: start.Add(time.Second * 90), Visits: 2}
+	want := `{"ip":"ip","start":"2021-01-01T10:00:00Z","end":"2021-01-01T10:01:30Z","duration":90,"visits":2}`
+
+	got, err := json.Marshal(s)
+	if err != nil || string(got) != want {
+		t.Errorf("expected: %v, got: %s, %v", want, got, err)
+	}
+}
+
+func TestParseSessionQuery(t *testing.T) {
+	type test struct {
+		values url.Values
+		want   SessionQuery
+		err    error
+	}
+
+	tests := map[string]test{
+		"default source": {
+			values: url.Values{},
+			want:   SessionQuery{Source: SourceVisits},
+		},
+		"gap and filters": {
+			values: url.Values{"gap": {"10m"}, "ip": {"ip"}, "path": {"/blog/*"}},
+			want:   SessionQuery{VisitQuery: VisitQuery{IPs: []string{"ip"}, Paths: []string{"/blog/*"}}, Gap: time.Minute * 10, Source: SourceVisits},
+		},
+		"stream": {
+			values: url.Values{"source": {"stream"}, "ip": {"ip"}, "limit": {"10"}},
+			want:   SessionQuery{VisitQuery: VisitQuery{IPs: []string{"ip"}, Limit: 10}, Source: SourceStream},
+		},
+		"invalid gap": {
+			values: url.Values{"gap": {"10"}},
+			err:    ErrInvalidFilter,
+		},
+		"negative gap": {
+			values: url.Values{"gap": {"-10m"}},
+			err:    ErrInvalidFilter,
+		},
+		"invalid source": {
+			values: url.Values{"source": {"rollups"}},
+			err:    ErrInvalidFilter,
+		},
+		"gap of stream": {
+			values: url.Values{"source": {"stream"}, "gap": {"10m"}},
+			err:    ErrInvalidFilter,
+		},
+		"filter not supported by stream": {
+			values: url.Values{"source": {"stream"}, "day": {"Monday"}},
+			err:    ErrInvalidFilter,
+		},
+		"cursor": {
+			values: url.Values{"limit": {"10"}, "cursor": {"cursor"}},
+			err:    ErrInvalidFilter,
+		},
+	}
+
+	for name, tt := range tests {
+		got, err := ParseSessionQuery(tt.values)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected: %+v, got: %+v", name, tt.want, got)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
+		}
+	}
+}
+
+func TestGetSessions(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDb := NewMockDbConnector(mockCtrl)
+	k := New(nil, mockDb)
+	k.SessionGap = time.Minute * 10
+	k.MaxSessionVisits = 3
+
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	events := []Event{
+		{IP: "ip", VisitedAt: start},
+		{IP: "ip", VisitedAt: start.Add(time.Minute * 5)},
+		{IP: "ip", VisitedAt: start.Add(time.Minute * 20)},
+	}
+	first := Session{IP: "ip", Start: start, End: start.Add(time.Minute * 5), Visits: 2}
+	second := Session{IP: "ip", Start: start.Add(time.Minute * 20), End: start.Add(time.Minute * 20), Visits: 1}
+	merged := Session{IP: "ip", Start: start, End: start.Add(time.Minute * 20), Visits: 3}
+
+	type test struct {
+		name  string
+		query SessionQuery
+		want  SessionsPage
+		err   error
+	}
+
+	tests := []test{
+		{
+			name:  "gap of kcp",
+			query: SessionQuery{},
+			want:  SessionsPage{Sessions: []Session{first, second}, Stats: SummarizeSessions([]Session{first, second})},
+		},
+		{
+			name:  "gap of query",
+			query: SessionQuery{Gap: time.Minute * 15},
+			want:  SessionsPage{Sessions: []Session{merged}, Stats: SummarizeSessions([]Session{merged})},
+		},
+		{
+			name:  "limit and order apply to sessions",
+			query: SessionQuery{VisitQuery: VisitQuery{Limit: 1, Order: OrderDesc}},
+			want:  SessionsPage{Sessions: []Session{second}, Stats: SummarizeSessions([]Session{first, second})},
+		},
+		{
+			name:  "stream",
+			query: SessionQuery{VisitQuery: VisitQuery{IPs: []string{"ip"}}, Source: SourceStream},
+			want:  SessionsPage{Sessions: []Session{merged}, Stats: SummarizeSessions([]Session{merged})},
+		},
+		{
+			name:  "invalid query",
+			query: SessionQuery{Source: "rollups"},
+			want:  SessionsPage{},
+			err:   ErrInvalidFilter,
+		},
+		{
+			name:  "error from db",
+			query: SessionQuery{},
+			want:  SessionsPage{},
+			err:   errMock,
+		},
+		{
+			name:  "too many visits",
+			query: SessionQuery{},
+			want:  SessionsPage{},
+			err:   ErrInvalidFilter,
+		},
+	}
+
+	visits := VisitQuery{Limit: 4}
+	gomock.InOrder(
+		mockDb.EXPECT().GetEvents(visits).Return(events, nil).Times(2),
+		mockDb.EXPECT().GetEvents(visits).Return(events, nil).Times(1),
+		mockDb.EXPECT().GetSessions(tests[3].query).Return([]Session{merged}, nil).Times(1),
+		mockDb.EXPECT().GetEvents(visits).Return(nil, errMock).Times(1),
+		mockDb.EXPECT().GetEvents(visits).Return(append(events, Event{IP: "ip", VisitedAt: start.Add(time.Minute * 25)}), nil).Times(1),
+	)
+
+	for _, tt := range tests {
+		got, err := k.GetSessions(tt.query)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.want, got)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestSessionizeVisit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDb := NewMockDbConnector(mockCtrl)
+	k := New(nil, mockDb)
+
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	last := Session{IP: "ip", UserAgent: "firefox", Start: start, End: start.Add(time.Minute), Visits: 2, LastID: "e2"}
+
+	type test struct {
+		name  string
+		event Event
+		last  Session
+		saved *Session
+	}
+
+	tests := []test{
+		{
+			name:  "first session",
+			event: Event{ID: "e1", IP: "ip", UserAgent: "firefox", VisitedAt: start},
+			last:  Session{},
+			saved: &Session{IP: "ip", UserAgent: "firefox", Start: start, End: start, Visits: 1, LastID: "e1"},
+		},
+		{
+			name:  "within gap",
+			event: Event{ID: "e3", IP: "ip", UserAgent: "firefox", VisitedAt: start.Add(time.Minute * 31)},
+			last:  last,
+			saved: &Session{IP: "ip", UserAgent: "firefox", Start: start, End: start.Add(time.Minute * 31), Visits: 3, LastID: "e3"},
+		},
+		{
+			name:  "gap exceeded",
+			event: Event{ID: "e3", IP: "ip", UserAgent: "firefox", VisitedAt: start.Add(time.Minute * 32)},
+			last:  last,
+			saved: &Session{IP: "ip", UserAgent: "firefox", Start: start.Add(time.Minute * 32), End: start.Add(time.Minute * 32), Visits: 1, LastID: "e3"},
+		},
+		{
+			name:  "at end of session",
+			event: Event{ID: "e3", IP: "ip", UserAgent: "firefox", VisitedAt: start.Add(time.Minute)},
+			last:  last,
+			saved: &Session{IP: "ip", UserAgent: "firefox", Start: start, End: start.Add(time.Minute), Visits: 3, LastID: "e3"},
+		},
+		{
+			name:  "redelivered",
+			event: Event{ID: "e2", IP: "ip", UserAgent: "firefox", VisitedAt: start.Add(time.Minute)},
+			last:  last,
+			saved: nil,
+		},
+		{
+			name:  "redelivered before end of session",
+			event: Event{ID: "e1", IP: "ip", UserAgent: "firefox", VisitedAt: start},
+			last:  last,
+			saved: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		mockDb.EXPECT().LastSession("ip", "firefox").Return(tt.last, nil).Times(1)
+		if tt.saved != nil {
+			mockDb.EXPECT().SaveSession(*tt.saved).Return(nil).Times(1)
+		}
+		if err := k.SessionizeVisit(tt.event); err != nil {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, nil, err)
+		}
+	}
+
+	mockDb.EXPECT().LastSession("ip", "").Return(Session{}, errMock).Times(1)
+	if err := k.SessionizeVisit(Event{IP: "ip"}); !errors.Is(err, errMock) {
+		t.Errorf("expected: %v, got: %v", errMock, err)
+	}
+}
@@ -0,0 +1,117 @@
+package kcp
+
+import (
+	"net/url"
+	"time"
+)
+
+// GroupBy defines how visit stats are grouped.
+type GroupBy string
+
+// Supported groupings of visit stats.
+const (
+	// GroupByDay groups by date of visit, e.g. 2020-01-02.
+	GroupByDay GroupBy = "day"
+	// GroupByHour groups by hour of the day, e.g. 13.
+	GroupByHour GroupBy = "hour"
+	// GroupByWeekday groups by day of the week, e.g. Monday.
+	GroupByWeekday GroupBy = "weekday"
+	// GroupByIP groups by ip of visit.
+	GroupByIP GroupBy = "ip"
+)
+
+// ParamGroupBy is query parameter parsed by ParseStatsQuery.
+const ParamGroupBy = "group_by"
+
+// StatsQuery describes which visits to aggregate and how to group them.
+// Limit, order and cursor of VisitQuery are ignored.
+type StatsQuery struct {
+	VisitQuery
+	GroupBy GroupBy
+}
+
+// VisitStats contains statistics of visits in single group.
+type VisitStats struct {
+	Group     string    `json:"group"`
+	Visits    int64     `json:"visits"`
+	UniqueIPs int64     `json:"unique_ips"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ParseStatsQuery parses url query values into StatsQuery.
+// Supports group_by parameter, which defaults to day,
+// and same filters as ParseVisitQuery.
+// Returned error is *FilterError.
+func ParseStatsQuery(values url.Values) (StatsQuery, error) {
+	vq, err := ParseVisitQuery(values)
+	if err != nil {
+		return StatsQuery{}, err
+	}
+	q := StatsQuery{VisitQuery: vq, GroupBy: GroupBy(values.Get(ParamGroupBy))}
+	if q.GroupBy == "" {
+		q.GroupBy = GroupByDay
+	}
+	if err := q.Validate(); err != nil {
+		return StatsQuery{}, err
+	}
+	return q, nil
+}
+
+// Validate checks if query values are valid, returns *FilterError otherwise.
+func (q StatsQuery) Validate() error {
+	switch q.GroupBy {
+	case GroupByDay, GroupByHour, GroupByWeekday, GroupByIP:
+	default:
+		return &FilterError{Param: ParamGroupBy, Value: string(q.GroupBy), Reason: "must be day, hour, weekday or ip"}
+	}
+	if err := q.requestFiltersError(); err != nil {
+		return err
+	}
+	if q.Networks != nil {
+		// Rollups store ips as text, which can not be matched by range.
+		return &FilterError{Param: ParamCIDR, Value: q.Networks[0].String(), Reason: "not supported by stats"}
+	}
+	return q.VisitQuery.Validate()
+}
+
+// requestFiltersError returns *FilterError for first request filter,
+// which can not be applied to rollups as they do not contain request details.
+func (q StatsQuery) requestFiltersError() error {
+	const reason = "not supported by stats"
+	switch {
+	case q.Paths != nil:
+		return &FilterError{Param: ParamPath, Value: q.Paths[0], Reason: reason}
+	case q.Methods != nil:
+		return &FilterError{Param: ParamMethod, Value: q.Methods[0], Reason: reason}
+	case q.Referrers != nil:
+		return &FilterError{Param: ParamReferrer, Value: q.Referrers[0], Reason: reason}
+	case q.UserAgent != "":
+		return &FilterError{Param: ParamUserAgent, Value: q.UserAgent, Reason: reason}
+	}
+	return nil
+}
+
+// Group returns group of visit from ip at time t in time zone loc.
+func (g GroupBy) Group(ip string, t time.Time, loc *time.Location) string {
+	t = t.In(loc)
+	switch g {
+	case GroupByHour:
+		return t.Format("15")
+	case GroupByWeekday:
+		return t.Weekday().String()
+	case GroupByIP:
+		return ip
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
+// GetVisitStats validates query and gets statistics of visits grouped by query.
+// Stats are read from hourly rollups, so time bounds are rounded to whole hours.
+func (k *Kcp) GetVisitStats(q StatsQuery) ([]VisitStats, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	return k.DbConnector.GetVisitStats(q)
+}
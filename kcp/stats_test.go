@@ -0,0 +1,112 @@
+package kcp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestParseStatsQuery(t *testing.T) {
+	type test struct {
+		values url.Values
+		want   StatsQuery
+		err    error
+	}
+
+	tests := map[string]test{
+		"default group": {
+			values: url.Values{},
+			want:   StatsQuery{GroupBy: GroupByDay},
+		},
+		"with filters": {
+			values: url.Values{"group_by": {"ip"}, "day": {"Monday"}},
+			want:   StatsQuery{VisitQuery: VisitQuery{Weekdays: []time.Weekday{time.Monday}}, GroupBy: GroupByIP},
+		},
+		"invalid group": {
+			values: url.Values{"group_by": {"month"}},
+			err:    ErrInvalidFilter,
+		},
+		"request filter": {
+			values: url.Values{"path": {"/api/visits"}},
+			err:    ErrInvalidFilter,
+		},
+		"invalid filter": {
+			values: url.Values{"group_by": {"hour"}, "day": {"Mday"}},
+			err:    ErrInvalidFilter,
+		},
+	}
+
+	for name, tt := range tests {
+		got, err := ParseStatsQuery(tt.values)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected: %+v, got: %+v", name, tt.want, got)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
+		}
+	}
+}
+
+func TestGroupByGroup(t *testing.T) {
+	visit := time.Date(2020, 1, 1, 9, 30, 0, 0, time.UTC)
+
+	tests := map[GroupBy]string{
+		GroupByDay:     "2020-01-01",
+		GroupByHour:    "09",
+		GroupByWeekday: "Wednesday",
+		GroupByIP:      "ip",
+	}
+
+	for g, want := range tests {
+		if got := g.Group("ip", visit, time.UTC); got != want {
+			t.Errorf("%s: expected: %v, got: %v", g, want, got)
+		}
+	}
+
+	// Visit is at 23:30 in Pacific/Kiritimati (UTC+14).
+	kiritimati, err := time.LoadLocation("Pacific/Kiritimati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := map[GroupBy]string{
+		GroupByDay:     "2020-01-01",
+		GroupByHour:    "23",
+		GroupByWeekday: "Wednesday",
+	}
+	for g, want := range local {
+		if got := g.Group("ip", visit, kiritimati); got != want {
+			t.Errorf("%s in time zone: expected: %v, got: %v", g, want, got)
+		}
+	}
+}
+
+func TestGetVisitStats(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDb := NewMockDbConnector(mockCtrl)
+	k := New(nil, mockDb)
+
+	stats := []VisitStats{{Group: "ip", Visits: 2, UniqueIPs: 1}}
+	q := StatsQuery{GroupBy: GroupByIP}
+	mockDb.EXPECT().GetVisitStats(q).Return(stats, nil).Times(1)
+
+	got, err := k.GetVisitStats(q)
+	if !reflect.DeepEqual(got, stats) || err != nil {
+		t.Errorf("expected: %v, got: %v, %v", stats, got, err)
+	}
+
+	if _, err := k.GetVisitStats(StatsQuery{}); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("expected: %v, got: %v", ErrInvalidFilter, err)
+	}
+
+	networks := StatsQuery{VisitQuery: VisitQuery{Networks: []*net.IPNet{mustCIDR("10.0.0.0/8")}}, GroupBy: GroupByIP}
+	if _, err := k.GetVisitStats(networks); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("expected: %v, got: %v", ErrInvalidFilter, err)
+	}
+}
@@ -1,17 +1,15 @@
-// Package async provides event streaming using kafka.
+// Package async provides event streaming using kafka or in-memory broker.
 package async
 
 import (
-	"os"
-
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
-// KafkaConsumerConn takes groupID and optional options as param,
+// KafkaConsumerConn takes bootstrap servers host, groupID and optional options as param,
 // returns connection to kafka consumer or an error.
-func KafkaConsumerConn(groupID string, options ...map[string]kafka.ConfigValue) (*kafka.Consumer, error) {
+func KafkaConsumerConn(host, groupID string, options ...map[string]kafka.ConfigValue) (*kafka.Consumer, error) {
 	config := &kafka.ConfigMap{
-		"bootstrap.servers": os.Getenv("KAFKA_HOST"),
+		"bootstrap.servers": host,
 		"group.id":          groupID,
 		"auto.offset.reset": "earliest",
 	}
@@ -28,9 +26,9 @@ func KafkaConsumerConn(groupID string, options ...map[string]kafka.ConfigValue)
 	return c, nil
 }
 
-// KafkaProducerConn returns connection to kafka producer or an error.
-func KafkaProducerConn() (*kafka.Producer, error) {
-	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": os.Getenv("KAFKA_HOST")})
+// KafkaProducerConn returns connection to kafka producer at bootstrap servers host or an error.
+func KafkaProducerConn(host string) (*kafka.Producer, error) {
+	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": host})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,76 @@
+package async
+
+import (
+	"fmt"
+	"time"
+)
+
+// Message is message produced to or consumed from broker.
+// Partition and Offset are set by broker.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+}
+
+// Header is key value pair of message metadata.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Delivered is called with delivered message, containing its partition and offset,
+// or with delivery error.
+type Delivered func(*Message, error)
+
+// Producer produces messages to broker.
+// Partition of message is chosen by broker using message key.
+type Producer interface {
+	// Produce produces message to its topic and waits for delivery.
+	Produce(*Message) error
+	// ProduceAsync produces message without waiting for delivery,
+	// delivered is called once delivery report is received.
+	// If error is returned, message was not produced and delivered is not called.
+	ProduceAsync(msg *Message, delivered Delivered) error
+	// Flush waits for delivery of produced messages until timeout,
+	// returns number of messages still waiting for delivery.
+	Flush(timeout time.Duration) int
+	Close()
+}
+
+// Consumer consumes messages of subscribed topics as member of consumer group.
+// Partitions of topics are shared between members of the same group.
+type Consumer interface {
+	Subscribe(topics ...string) error
+	// Poll returns next message or nil if there is none within timeout.
+	// Returned error is fatal, consumer should not be used after it.
+	Poll(timeout time.Duration) (*Message, error)
+	// Commit commits offsets of all polled messages.
+	Commit() error
+	// CommitMessage commits offset of message.
+	CommitMessage(*Message) error
+	Close() error
+}
+
+// Broker creates producers and consumers connected to it.
+type Broker interface {
+	NewProducer() (Producer, error)
+	// NewConsumer returns consumer in group, offsets of polled messages
+	// are committed automatically unless manualCommit is set.
+	NewConsumer(groupID string, manualCommit bool) (Consumer, error)
+}
+
+// NewBroker returns broker by name, kafka (default) connected to kafkaHost or memory.
+func NewBroker(name, kafkaHost string) (Broker, error) {
+	switch name {
+	case "", "kafka":
+		return KafkaBroker{Host: kafkaHost}, nil
+	case "memory":
+		return NewMemoryBroker(2), nil
+	default:
+		return nil, fmt.Errorf("unknown broker %q", name)
+	}
+}
@@ -0,0 +1,367 @@
+package async
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// CodecHeader is message header containing name of codec used to encode message value.
+// Messages without it are encoded using gob.
+const CodecHeader = "codec"
+
+// Codec encodes and decodes kcp.Event.
+type Codec interface {
+	Name() string
+	Encode(kcp.Event) ([]byte, error)
+	Decode([]byte) (kcp.Event, error)
+}
+
+var codecs = map[string]Codec{
+	GobCodec{}.Name():      GobCodec{},
+	JSONCodec{}.Name():     JSONCodec{},
+	ProtobufCodec{}.Name(): ProtobufCodec{},
+}
+
+// CodecByName returns codec with name, gob codec is returned if name is empty.
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		return GobCodec{}, nil
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// decodeMessage decodes event from message using codec from its header.
+func decodeMessage(m *Message) (kcp.Event, error) {
+	var name string
+	for _, h := range m.Headers {
+		if h.Key == CodecHeader {
+			name = string(h.Value)
+		}
+	}
+	c, err := CodecByName(name)
+	if err != nil {
+		fmt.Println(err)
+		return kcp.Event{}, err
+	}
+	return c.Decode(m.Value)
+}
+
+// GobCodec encodes events using gob, it is only readable by Go services.
+type GobCodec struct{}
+
+// Name returns gob.
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+// Encode encodes event using gob.
+func (GobCodec) Encode(event kcp.Event) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(event); err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decode decodes event encoded using gob, time of visit is returned in UTC.
+func (GobCodec) Decode(data []byte) (kcp.Event, error) {
+	var event kcp.Event
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&event); err != nil {
+		fmt.Println(err)
+		return kcp.Event{}, err
+	}
+	event.VisitedAt = event.VisitedAt.UTC()
+	return event, nil
+}
+
+// JSONCodec encodes events as JSON object with fields id, visited_at (RFC 3339), ip, day
+// and optional request fields path, method, user_agent, referrer, accept_language and headers.
+type JSONCodec struct{}
+
+type jsonEvent struct {
+	ID             string            `json:"id,omitempty"`
+	VisitedAt      time.Time         `json:"visited_at"`
+	IP             string            `json:"ip"`
+	Day            string            `json:"day"`
+	Path           string            `json:"path,omitempty"`
+	Method         string            `json:"method,omitempty"`
+	UserAgent      string            `json:"user_agent,omitempty"`
+	Referrer       string            `json:"referrer,omitempty"`
+	AcceptLanguage string            `json:"accept_language,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+}
+
+// Name returns json.
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+// Encode encodes event as JSON.
+func (JSONCodec) Encode(event kcp.Event) ([]byte, error) {
+	return json.Marshal(jsonEvent{
+		ID:             event.ID,
+		VisitedAt:      event.VisitedAt,
+		IP:             event.IP,
+		Day:            event.Day,
+		Path:           event.Path,
+		Method:         event.Method,
+		UserAgent:      event.UserAgent,
+		Referrer:       event.Referrer,
+		AcceptLanguage: event.AcceptLanguage,
+		Headers:        event.Headers,
+	})
+}
+
+// Decode decodes event encoded as JSON, time of visit is returned in UTC.
+func (JSONCodec) Decode(data []byte) (kcp.Event, error) {
+	var e jsonEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		return kcp.Event{}, err
+	}
+	return kcp.Event{
+		ID:             e.ID,
+		VisitedAt:      e.VisitedAt.UTC(),
+		IP:             e.IP,
+		Day:            e.Day,
+		Path:           e.Path,
+		Method:         e.Method,
+		UserAgent:      e.UserAgent,
+		Referrer:       e.Referrer,
+		AcceptLanguage: e.AcceptLanguage,
+		Headers:        e.Headers,
+	}, nil
+}
+
+// ProtobufCodec encodes events as Visit protobuf message described in visit.proto.
+type ProtobufCodec struct{}
+
+// Field numbers of Visit message, its map entries and google.protobuf.Timestamp.
+const (
+	protoVisitedAt      protowire.Number = 1
+	protoIP             protowire.Number = 2
+	protoDay            protowire.Number = 3
+	protoID             protowire.Number = 4
+	protoPath           protowire.Number = 5
+	protoMethod         protowire.Number = 6
+	protoUserAgent      protowire.Number = 7
+	protoReferrer       protowire.Number = 8
+	protoAcceptLanguage protowire.Number = 9
+	protoHeaders        protowire.Number = 10
+
+	protoKey   protowire.Number = 1
+	protoValue protowire.Number = 2
+
+	protoSeconds protowire.Number = 1
+	protoNanos   protowire.Number = 2
+)
+
+var errProtobuf = errors.New("invalid protobuf message")
+
+// Name returns protobuf.
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+// protoString is string field of Visit message.
+type protoString struct {
+	num protowire.Number
+	v   *string
+}
+
+// protoStrings returns string fields of event ordered by field number,
+// both Encode and Decode use them, so that they follow same field numbers.
+func protoStrings(event *kcp.Event) []protoString {
+	return []protoString{
+		{protoIP, &event.IP},
+		{protoDay, &event.Day},
+		{protoID, &event.ID},
+		{protoPath, &event.Path},
+		{protoMethod, &event.Method},
+		{protoUserAgent, &event.UserAgent},
+		{protoReferrer, &event.Referrer},
+		{protoAcceptLanguage, &event.AcceptLanguage},
+	}
+}
+
+// Encode encodes event as Visit protobuf message.
+func (ProtobufCodec) Encode(event kcp.Event) ([]byte, error) {
+	var ts []byte
+	if !event.VisitedAt.IsZero() {
+		ts = protowire.AppendTag(ts, protoSeconds, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(event.VisitedAt.Unix()))
+		ts = protowire.AppendTag(ts, protoNanos, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(event.VisitedAt.Nanosecond()))
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, protoVisitedAt, protowire.BytesType)
+	b = protowire.AppendBytes(b, ts)
+	for _, f := range protoStrings(&event) {
+		// Empty strings are omitted as in proto3.
+		if *f.v != "" {
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendString(b, *f.v)
+		}
+	}
+
+	keys := make([]string, 0, len(event.Headers))
+	for k := range event.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, protoKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, protoValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, event.Headers[k])
+		b = protowire.AppendTag(b, protoHeaders, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+// Decode decodes event encoded as Visit protobuf message, unknown fields are skipped.
+func (ProtobufCodec) Decode(data []byte) (kcp.Event, error) {
+	var event kcp.Event
+	fields := make(map[protowire.Number]*string)
+	for _, f := range protoStrings(&event) {
+		fields[f.num] = f.v
+	}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return kcp.Event{}, errProtobuf
+		}
+		data = data[n:]
+
+		if field, ok := fields[num]; ok && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return kcp.Event{}, errProtobuf
+			}
+			*field = v
+			data = data[n:]
+			continue
+		}
+
+		switch {
+		case num == protoVisitedAt && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return kcp.Event{}, errProtobuf
+			}
+			t, err := decodeProtoTimestamp(v)
+			if err != nil {
+				return kcp.Event{}, err
+			}
+			event.VisitedAt = t
+			data = data[n:]
+		case num == protoHeaders && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return kcp.Event{}, errProtobuf
+			}
+			key, value, err := decodeProtoMapEntry(v)
+			if err != nil {
+				return kcp.Event{}, err
+			}
+			if event.Headers == nil {
+				event.Headers = make(map[string]string)
+			}
+			event.Headers[key] = value
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return kcp.Event{}, errProtobuf
+			}
+			data = data[n:]
+		}
+	}
+	return event, nil
+}
+
+// decodeProtoMapEntry decodes entry of map<string, string>.
+func decodeProtoMapEntry(data []byte) (string, string, error) {
+	var key, value string
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", "", errProtobuf
+		}
+		data = data[n:]
+
+		if typ != protowire.BytesType || num != protoKey && num != protoValue {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return "", "", errProtobuf
+			}
+			data = data[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeString(data)
+		if n < 0 {
+			return "", "", errProtobuf
+		}
+		if num == protoKey {
+			key = v
+		} else {
+			value = v
+		}
+		data = data[n:]
+	}
+	return key, value, nil
+}
+
+// decodeProtoTimestamp decodes google.protobuf.Timestamp message into UTC time.
+func decodeProtoTimestamp(data []byte) (time.Time, error) {
+	if len(data) == 0 {
+		return time.Time{}, nil
+	}
+	var seconds, nanos uint64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return time.Time{}, errProtobuf
+		}
+		data = data[n:]
+
+		if typ != protowire.VarintType || num != protoSeconds && num != protoNanos {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return time.Time{}, errProtobuf
+			}
+			data = data[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return time.Time{}, errProtobuf
+		}
+		if num == protoSeconds {
+			seconds = v
+		} else {
+			nanos = v
+		}
+		data = data[n:]
+	}
+	return time.Unix(int64(seconds), int64(nanos)).UTC(), nil
+}
@@ -0,0 +1,144 @@
+package async
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+func TestCodecs(t *testing.T) {
+	events := []kcp.Event{
+		{
+			ID:        "c0ab7kd6n88ehkqgbm7g",
+			VisitedAt: time.Date(2020, 1, 1, 10, 30, 0, 123, time.UTC),
+			IP:        "172.19.0.1",
+			Day:       "Wednesday",
+		},
+		{
+			VisitedAt: time.Date(2020, 1, 1, 10, 30, 0, 123, time.UTC),
+			IP:        "172.19.0.1",
+			Day:       "Wednesday",
+		},
+		{
+			ID:             "c0ab7kd6n88ehkqgbm7g",
+			VisitedAt:      time.Date(2020, 1, 1, 10, 30, 0, 123, time.UTC),
+			IP:             "172.19.0.1",
+			Day:            "Wednesday",
+			Path:           "/pricing",
+			Method:         "POST",
+			UserAgent:      "curl/7.68.0",
+			Referrer:       "https://example.com/",
+			AcceptLanguage: "en-US,en;q=0.5",
+			Headers:        map[string]string{"Dnt": "1", "X-Request-Id": "abc"},
+		},
+	}
+
+	for name, c := range codecs {
+		if c.Name() != name {
+			t.Errorf("%s: expected name: %v, got: %v", name, name, c.Name())
+		}
+		for _, event := range events {
+			b, err := c.Encode(event)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+				continue
+			}
+			got, err := decodeMessage(&Message{
+				Value:   b,
+				Headers: []Header{{Key: CodecHeader, Value: []byte(name)}},
+			})
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+			}
+			if !reflect.DeepEqual(got, event) {
+				t.Errorf("%s: expected: %v, got: %v", name, event, got)
+			}
+		}
+	}
+}
+
+func TestCodecsDecodeUTC(t *testing.T) {
+	visitedAt := time.Date(2020, 1, 1, 3, 0, 0, 0, time.FixedZone("+02:00", 2*60*60))
+	for name, c := range codecs {
+		b, err := c.Encode(kcp.Event{VisitedAt: visitedAt, IP: "172.19.0.1"})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		got, err := c.Decode(b)
+		if err != nil || !got.VisitedAt.Equal(visitedAt) || got.VisitedAt.Location() != time.UTC {
+			t.Errorf("%s: expected: %v, got: %v, %v", name, visitedAt.UTC(), got.VisitedAt, err)
+		}
+	}
+}
+
+func TestDecodeMessageWithoutHeader(t *testing.T) {
+	event := kcp.Event{IP: "ip", Day: "Monday"}
+	b, err := GobCodec{}.Encode(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decodeMessage(&Message{Value: b})
+	if err != nil || !reflect.DeepEqual(got, event) {
+		t.Errorf("expected: %v, got: %v, %v", event, got, err)
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	if c, err := CodecByName(""); err != nil || c.Name() != "gob" {
+		t.Errorf("expected gob codec, got: %v, %v", c, err)
+	}
+	if _, err := CodecByName("xml"); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
+
+// TestProtobufWireFormat decodes message encoded using field numbers of visit.proto
+// in other order than Encode, with unknown field.
+func TestProtobufWireFormat(t *testing.T) {
+	str := func(b []byte, num protowire.Number, v string) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, v)
+	}
+	var ts, entry, b []byte
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, 1577874600)
+	entry = str(str(entry, 1, "Dnt"), 2, "1")
+
+	b = protowire.AppendTag(b, 10, protowire.BytesType)
+	b = protowire.AppendBytes(b, entry)
+	b = str(b, 9, "en-US")
+	b = str(b, 8, "https://example.com/")
+	b = str(b, 7, "curl/7.68.0")
+	b = str(b, 6, "GET")
+	b = str(b, 5, "/pricing")
+	b = str(b, 4, "id")
+	b = str(b, 3, "Wednesday")
+	b = str(b, 2, "172.19.0.1")
+	b = protowire.AppendTag(b, 99, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, ts)
+
+	want := kcp.Event{
+		ID:             "id",
+		VisitedAt:      time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC),
+		IP:             "172.19.0.1",
+		Day:            "Wednesday",
+		Path:           "/pricing",
+		Method:         "GET",
+		UserAgent:      "curl/7.68.0",
+		Referrer:       "https://example.com/",
+		AcceptLanguage: "en-US",
+		Headers:        map[string]string{"Dnt": "1"},
+	}
+	got, err := ProtobufCodec{}.Decode(b)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected: %v, got: %v, %v", want, got, err)
+	}
+}
@@ -1,26 +1,26 @@
 package async
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"fmt"
 	"sync"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
-
 	"github.com/SarunasBucius/kafka-cass-practise/kcp"
 )
 
 // InsertVisit describes method to insert visit.
 type InsertVisit func(kcp.Event) error
 
-// InsertEventsConsumer inserts events from kafka consumer.
-func InsertEventsConsumer(ctx context.Context, insertVisit InsertVisit, cons *kafka.Consumer, cancel context.CancelFunc, wg *sync.WaitGroup) {
+// InsertEventsConsumer inserts events consumed from topic.
+// Failed inserts are retried, messages which could not be decoded or inserted
+// after all retries are published to dead letter topic using dlq, if it is not nil.
+// Consumer must be created with manual commit, offset of message is committed after it is inserted
+// or published to dead letter topic, consumer stops without committing if publishing fails.
+func InsertEventsConsumer(ctx context.Context, insertVisit InsertVisit, cons Consumer, topic string, retry Retry, dlq DeadLetterPublisher, cancel context.CancelFunc, wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer cons.Close()
-	if err := cons.SubscribeTopics([]string{"visits"}, nil); err != nil {
+	if err := cons.Subscribe(topic); err != nil {
 		fmt.Printf("Subscription failed: %v\n", err)
 		cancel()
 		return
@@ -31,29 +31,254 @@ func InsertEventsConsumer(ctx context.Context, insertVisit InsertVisit, cons *ka
 		case <-ctx.Done():
 			return
 		default:
-			ev := cons.Poll(500)
-			if ev == nil {
+			msg, err := cons.Poll(time.Millisecond * 500)
+			if err != nil {
+				fmt.Println(err)
+				cancel()
+				return
+			}
+			if msg == nil {
 				continue
 			}
 
-			switch e := ev.(type) {
-			case *kafka.Message:
-				fmt.Println(cons.String())
-				event, err := decodeGob(e.Value)
-				if err != nil {
+			stage := StageDecode
+			event, err := decodeMessage(msg)
+			if err == nil {
+				stage = StageInsert
+				err = retry.Do(ctx, func() error { return insertVisit(event) })
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err := handleFailure(dlq, msg, stage, err); err != nil {
+					fmt.Println(err)
+					cancel()
+					return
+				}
+			}
+			if err := cons.CommitMessage(msg); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// InsertVisits describes method to insert batch of visits.
+type InsertVisits func([]kcp.Event) error
+
+// Batch limits number of events in batch and time they are accumulated.
+type Batch struct {
+	// Size is max number of events in batch, batch contains single event if less than 1.
+	Size int
+	// Timeout is max duration since first event of batch was consumed, after which batch is inserted.
+	Timeout time.Duration
+}
+
+// BatchInsertEventsConsumer inserts events consumed from topic in batches.
+// Consumer must be created with manual commit, offsets are committed only after batch is inserted
+// or published to dead letter topic, so events of unfinished batch are consumed again after restart.
+// Failed batches are retried as a whole, messages of batch which could not be inserted after all
+// retries and messages which could not be decoded are published using dlq, if it is not nil.
+// Consumer stops without committing if publishing fails.
+func BatchInsertEventsConsumer(ctx context.Context, insertVisits InsertVisits, cons Consumer, topic string, batch Batch, retry Retry, dlq DeadLetterPublisher, cancel context.CancelFunc, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer cons.Close()
+	if err := cons.Subscribe(topic); err != nil {
+		fmt.Printf("Subscription failed: %v\n", err)
+		cancel()
+		return
+	}
+
+	var events []kcp.Event
+	var msgs []*Message
+	var deadline time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if len(events) > 0 && (len(events) >= batch.Size || !time.Now().Before(deadline)) {
+			if err := insertBatch(ctx, insertVisits, events, msgs, retry, dlq); err != nil {
+				if ctx.Err() == nil {
 					fmt.Println(err)
-					continue
+					cancel()
+				}
+				return
+			}
+			if err := cons.Commit(); err != nil {
+				fmt.Println(err)
+			}
+			events, msgs = nil, nil
+			continue
+		}
+
+		timeout := time.Millisecond * 500
+		if len(events) > 0 {
+			timeout = time.Until(deadline)
+		}
+		msg, err := cons.Poll(timeout)
+		if err != nil {
+			fmt.Println(err)
+			cancel()
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		event, err := decodeMessage(msg)
+		if err != nil {
+			if err := handleFailure(dlq, msg, StageDecode, err); err != nil {
+				fmt.Println(err)
+				cancel()
+				return
+			}
+			continue
+		}
+		if len(events) == 0 {
+			deadline = time.Now().Add(batch.Timeout)
+		}
+		events = append(events, event)
+		msgs = append(msgs, msg)
+	}
+}
+
+// insertBatch inserts events with retries, messages of events are published
+// to dead letter topic if insert fails. Returns error if ctx is done or publishing fails,
+// offsets of batch must not be committed then.
+func insertBatch(ctx context.Context, insertVisits InsertVisits, events []kcp.Event, msgs []*Message, retry Retry, dlq DeadLetterPublisher) error {
+	err := retry.Do(ctx, func() error { return insertVisits(events) })
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, msg := range msgs {
+		if err := handleFailure(dlq, msg, StageInsert, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RollupVisit describes method to apply visit at stream position to rollups.
+type RollupVisit func(kcp.Event, kcp.StreamPosition) error
+
+// RollupConsumer applies events consumed from topic to rollups.
+// Position of message is passed with event, so that events redelivered
+// after rebalance or restart are not counted twice.
+// Failed updates are retried, messages which could not be decoded or applied
+// after all retries are published to dead letter topic using dlq, if it is not nil.
+// Consumer must be created with manual commit, offset of message is committed after it is applied
+// or published to dead letter topic, consumer stops without committing if publishing fails.
+func RollupConsumer(ctx context.Context, rollupVisit RollupVisit, cons Consumer, topic string, retry Retry, dlq DeadLetterPublisher, cancel context.CancelFunc, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer cons.Close()
+	if err := cons.Subscribe(topic); err != nil {
+		fmt.Printf("Subscription failed: %v\n", err)
+		cancel()
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			msg, err := cons.Poll(time.Millisecond * 500)
+			if err != nil {
+				fmt.Println(err)
+				cancel()
+				return
+			}
+			if msg == nil {
+				continue
+			}
+
+			stage := StageDecode
+			event, err := decodeMessage(msg)
+			if err == nil {
+				pos := streamPosition(msg)
+				stage = StageRollup
+				err = retry.Do(ctx, func() error { return rollupVisit(event, pos) })
+				if err != nil && ctx.Err() != nil {
+					return
 				}
-				if err := insertVisit(event); err != nil {
+			}
+			if err != nil {
+				if err := handleFailure(dlq, msg, stage, err); err != nil {
 					fmt.Println(err)
+					cancel()
+					return
+				}
+			}
+			if err := cons.CommitMessage(msg); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+func streamPosition(msg *Message) kcp.StreamPosition {
+	return kcp.StreamPosition{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}
+}
+
+// SessionizeVisit describes method to apply visit to sessions.
+type SessionizeVisit func(kcp.Event) error
+
+// SessionConsumer applies events consumed from topic to stored sessions.
+// Events with same key are consumed from single partition in order they were produced,
+// which sessionizeVisit relies on to extend sessions and to ignore redelivered events.
+// Failed updates are retried, messages which could not be decoded or applied
+// after all retries are published to dead letter topic using dlq, if it is not nil.
+// Consumer must be created with manual commit, offset of message is committed after it is applied
+// or published to dead letter topic, consumer stops without committing if publishing fails.
+func SessionConsumer(ctx context.Context, sessionizeVisit SessionizeVisit, cons Consumer, topic string, retry Retry, dlq DeadLetterPublisher, cancel context.CancelFunc, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer cons.Close()
+	if err := cons.Subscribe(topic); err != nil {
+		fmt.Printf("Subscription failed: %v\n", err)
+		cancel()
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			msg, err := cons.Poll(time.Millisecond * 500)
+			if err != nil {
+				fmt.Println(err)
+				cancel()
+				return
+			}
+			if msg == nil {
+				continue
+			}
+
+			stage := StageDecode
+			event, err := decodeMessage(msg)
+			if err == nil {
+				stage = StageSession
+				err = retry.Do(ctx, func() error { return sessionizeVisit(event) })
+				if err != nil && ctx.Err() != nil {
+					return
 				}
-			case kafka.Error:
-				if e.IsFatal() {
+			}
+			if err != nil {
+				if err := handleFailure(dlq, msg, stage, err); err != nil {
+					fmt.Println(err)
 					cancel()
 					return
 				}
-			default:
-				fmt.Printf("Ignored %v\n", e)
+			}
+			if err := cons.CommitMessage(msg); err != nil {
+				fmt.Println(err)
 			}
 		}
 	}
@@ -62,47 +287,52 @@ func InsertEventsConsumer(ctx context.Context, insertVisit InsertVisit, cons *ka
 // PrintDay describes method to print day.
 type PrintDay func(kcp.Event)
 
-// PrintDayConsumer prints day from consumed events.
-func PrintDayConsumer(ctx context.Context, printDay PrintDay, cons *kafka.Consumer, cancel context.CancelFunc, wg *sync.WaitGroup) {
+// PrintDayConsumer prints day from events consumed from topic.
+// Consumer should be created with manual commit, offsets are committed
+// after every 5 printed events or after 5 seconds.
+func PrintDayConsumer(ctx context.Context, printDay PrintDay, cons Consumer, topic string, cancel context.CancelFunc, wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer cons.Close()
 	defer cons.Commit()
-	if err := cons.SubscribeTopics([]string{"visits"}, nil); err != nil {
+	if err := cons.Subscribe(topic); err != nil {
 		cancel()
 		return
 	}
 
 	offsetDif := 0
+	lastCommit := time.Now()
 	done := make(chan struct{}, 5)
 	for {
-		offsetDif, _ = commitOffset(offsetDif, 5, cons)
+		if offsetDif >= 5 || time.Since(lastCommit) > time.Second*5 {
+			offsetDif, _ = commitOffset(offsetDif, 1, cons)
+			lastCommit = time.Now()
+		}
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(time.Second * 5):
-			offsetDif, _ = commitOffset(offsetDif, 1, cons)
 		case <-done:
 			offsetDif++
-		case ev := <-cons.Events():
-			switch e := ev.(type) {
-			case *kafka.Message:
-				wg.Add(1)
-				go asyncPrintDay(e.Value, printDay, wg, done)
-			case kafka.Error:
-				if e.IsFatal() {
-					cancel()
-					return
-				}
-			default:
-				fmt.Printf("Ignored %v\n", e)
-			}
+			continue
+		default:
 		}
+
+		msg, err := cons.Poll(time.Millisecond * 100)
+		if err != nil {
+			fmt.Println(err)
+			cancel()
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		wg.Add(1)
+		go asyncPrintDay(msg, printDay, wg, done)
 	}
 }
 
-func commitOffset(offset, minOffset int, cons *kafka.Consumer) (int, error) {
+func commitOffset(offset, minOffset int, cons Consumer) (int, error) {
 	if offset >= minOffset {
-		if _, err := cons.Commit(); err != nil {
+		if err := cons.Commit(); err != nil {
 			fmt.Println(err)
 			return offset, err
 		}
@@ -111,24 +341,15 @@ func commitOffset(offset, minOffset int, cons *kafka.Consumer) (int, error) {
 	return offset, nil
 }
 
-func asyncPrintDay(value []byte, printDay PrintDay, wg *sync.WaitGroup, done chan<- struct{}) {
+func asyncPrintDay(msg *Message, printDay PrintDay, wg *sync.WaitGroup, done chan<- struct{}) {
 	defer wg.Done()
 	defer func() {
 		done <- struct{}{}
 	}()
-	event, err := decodeGob(value)
+	event, err := decodeMessage(msg)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	printDay(event)
 }
-
-func decodeGob(data []byte) (kcp.Event, error) {
-	var event kcp.Event
-	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&event); err != nil {
-		fmt.Println(err)
-		return kcp.Event{}, err
-	}
-	return event, nil
-}
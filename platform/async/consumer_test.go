@@ -0,0 +1,357 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+func TestInsertEventsConsumer(t *testing.T) {
+	b := NewMemoryBroker(2)
+	prod, _ := b.NewProducer()
+	p := &Produce{Producer: prod, Codec: JSONCodec{}, Topic: "visits"}
+
+	events := []kcp.Event{
+		{VisitedAt: time.Date(2021, 1, 2, 10, 0, 0, 0, time.UTC), IP: "1.1.1.1", Day: "Saturday"},
+		{VisitedAt: time.Date(2021, 1, 3, 11, 0, 0, 0, time.UTC), IP: "fail", Day: "Sunday"},
+		{VisitedAt: time.Date(2021, 1, 4, 12, 0, 0, 0, time.UTC), IP: "2.2.2.2", Day: "Monday"},
+	}
+	for _, e := range events {
+		if err := p.ProduceEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prod.Produce(&Message{Topic: "visits", Value: []byte("invalid"), Headers: []Header{{Key: CodecHeader, Value: []byte("json")}}})
+
+	var mu sync.Mutex
+	inserted := make(map[string]int)
+	insertVisit := func(e kcp.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		inserted[e.IP]++
+		if e.IP == "fail" {
+			return errors.New("insert failed")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	cons, _ := b.NewConsumer("inserter", true)
+	wg.Add(1)
+	go InsertEventsConsumer(ctx, insertVisit, cons, "visits", Retry{Attempts: 2}, &DeadLetter{Producer: prod, Topic: "visits.dlq"}, cancel, wg)
+
+	dlq, _ := b.NewConsumer("test", false)
+	dlq.Subscribe("visits.dlq")
+	stages := make(map[string]bool)
+	for len(stages) < 2 {
+		msg, err := dlq.Poll(time.Second)
+		if err != nil || msg == nil {
+			t.Fatalf("expected dead letter, got: %v, %v", msg, err)
+		}
+		for _, h := range msg.Headers {
+			if h.Key == HeaderStage {
+				stages[string(h.Value)] = true
+			}
+		}
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := inserted["1.1.1.1"] + inserted["2.2.2.2"]
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+	}
+	// wait for offset of last message to be committed
+	time.Sleep(time.Millisecond * 20)
+	cancel()
+	wg.Wait()
+
+	if !stages[StageDecode] || !stages[StageInsert] {
+		t.Errorf("expected stages: %v and %v, got: %v", StageDecode, StageInsert, stages)
+	}
+	want := map[string]int{"1.1.1.1": 1, "fail": 2, "2.2.2.2": 1}
+	for ip, n := range want {
+		if inserted[ip] != n {
+			t.Errorf("%s: expected inserts: %v, got: %v", ip, n, inserted[ip])
+		}
+	}
+	cons, _ = b.NewConsumer("inserter", true)
+	cons.Subscribe("visits")
+	if got := pollAll(t, cons); len(got) != 0 {
+		t.Errorf("expected committed offsets, got: %v uncommitted", len(got))
+	}
+}
+
+// failingDeadLetter fails to publish dead letters.
+type failingDeadLetter struct{}
+
+func (failingDeadLetter) PublishDeadLetter(*Message, string, error) error {
+	return errors.New("publish failed")
+}
+
+func TestConsumersStopWhenDeadLetterFails(t *testing.T) {
+	type test struct {
+		group string
+		run   func(context.Context, Consumer, context.CancelFunc, *sync.WaitGroup)
+	}
+
+	failing := func(kcp.Event) error { return errors.New("failed") }
+	tests := map[string]test{
+		"insert": {group: "inserter", run: func(ctx context.Context, cons Consumer, cancel context.CancelFunc, wg *sync.WaitGroup) {
+			InsertEventsConsumer(ctx, failing, cons, "visits", Retry{}, failingDeadLetter{}, cancel, wg)
+		}},
+		"batch insert": {group: "inserter", run: func(ctx context.Context, cons Consumer, cancel context.CancelFunc, wg *sync.WaitGroup) {
+			BatchInsertEventsConsumer(ctx, func([]kcp.Event) error { return failing(kcp.Event{}) }, cons, "visits", Batch{Size: 2, Timeout: time.Millisecond * 20}, Retry{}, failingDeadLetter{}, cancel, wg)
+		}},
+		"session": {group: "sessions", run: func(ctx context.Context, cons Consumer, cancel context.CancelFunc, wg *sync.WaitGroup) {
+			SessionConsumer(ctx, failing, cons, "visits", Retry{}, failingDeadLetter{}, cancel, wg)
+		}},
+		"rollup": {group: "rollup", run: func(ctx context.Context, cons Consumer, cancel context.CancelFunc, wg *sync.WaitGroup) {
+			RollupConsumer(ctx, func(e kcp.Event, _ kcp.StreamPosition) error { return failing(e) }, cons, "visits", Retry{}, failingDeadLetter{}, cancel, wg)
+		}},
+	}
+
+	for name, tt := range tests {
+		b := NewMemoryBroker(1)
+		prod, _ := b.NewProducer()
+		p := &Produce{Producer: prod, Topic: "visits"}
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+			if err := p.ProduceEvent(kcp.Event{IP: ip, VisitedAt: time.Date(2021, 1, 2, 10, 0, 0, 0, time.UTC)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		cons, _ := b.NewConsumer(tt.group, true)
+		wg.Add(1)
+		go tt.run(ctx, cons, cancel, wg)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("%s: expected consumer to stop", name)
+			cancel()
+		}
+		wg.Wait()
+
+		cons, _ = b.NewConsumer(tt.group, true)
+		cons.Subscribe("visits")
+		if got := pollAll(t, cons); len(got) != 2 {
+			t.Errorf("%s: expected uncommitted: %v, got: %v", name, 2, len(got))
+		}
+	}
+}
+
+func TestBatchInsertEventsConsumer(t *testing.T) {
+	type test struct {
+		events   int
+		fail     bool
+		batches  int
+		inserted int
+		dead     int
+	}
+
+	tests := map[string]test{
+		"inserted in batches": {events: 5, fail: false, batches: 3, inserted: 5, dead: 0},
+		"failed batches":      {events: 5, fail: true, batches: 6, inserted: 0, dead: 5},
+	}
+
+	for name, tt := range tests {
+		b := NewMemoryBroker(1)
+		prod, _ := b.NewProducer()
+		p := &Produce{Producer: prod, Topic: "visits"}
+		for i := 0; i < tt.events; i++ {
+			p.ProduceEvent(kcp.Event{IP: "1.1.1.1", VisitedAt: time.Date(2021, 1, 2, 10, i, 0, 0, time.UTC)})
+		}
+
+		var mu sync.Mutex
+		batches, inserted := 0, 0
+		insertVisits := func(events []kcp.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batches++
+			if len(events) > 2 {
+				t.Errorf("%s: expected at most 2 events, got: %v", name, len(events))
+			}
+			if tt.fail {
+				return errors.New("insert failed")
+			}
+			inserted += len(events)
+			return nil
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		cons, _ := b.NewConsumer("inserter", true)
+		wg.Add(1)
+		go BatchInsertEventsConsumer(ctx, insertVisits, cons, "visits", Batch{Size: 2, Timeout: time.Millisecond * 20}, Retry{Attempts: 2}, &DeadLetter{Producer: prod, Topic: "visits.dlq"}, cancel, wg)
+
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			mu.Lock()
+			n := batches
+			mu.Unlock()
+			if n == tt.batches {
+				break
+			}
+		}
+		// wait for offsets to be committed after last batch
+		time.Sleep(time.Millisecond * 20)
+		cancel()
+		wg.Wait()
+
+		if batches != tt.batches {
+			t.Errorf("%s: expected batches: %v, got: %v", name, tt.batches, batches)
+		}
+		if inserted != tt.inserted {
+			t.Errorf("%s: expected inserted: %v, got: %v", name, tt.inserted, inserted)
+		}
+
+		dlq, _ := b.NewConsumer("test", false)
+		dlq.Subscribe("visits.dlq")
+		if got := pollAll(t, dlq); len(got) != tt.dead {
+			t.Errorf("%s: expected dead letters: %v, got: %v", name, tt.dead, len(got))
+		}
+		cons, _ = b.NewConsumer("inserter", true)
+		cons.Subscribe("visits")
+		if got := pollAll(t, cons); len(got) != 0 {
+			t.Errorf("%s: expected committed offsets, got: %v uncommitted", name, len(got))
+		}
+	}
+}
+
+func TestRollupConsumer(t *testing.T) {
+	b := NewMemoryBroker(1)
+	prod, _ := b.NewProducer()
+	p := &Produce{Producer: prod, Topic: "visits"}
+	for _, ip := range []string{"1.1.1.1", "fail", "flaky"} {
+		if err := p.ProduceEvent(kcp.Event{IP: ip, VisitedAt: time.Date(2021, 1, 2, 10, 0, 0, 0, time.UTC)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	applied := make(map[string]kcp.StreamPosition)
+	rollupVisit := func(e kcp.Event, pos kcp.StreamPosition) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[e.IP]++
+		if e.IP == "fail" || e.IP == "flaky" && calls[e.IP] == 1 {
+			return errors.New("rollup failed")
+		}
+		applied[e.IP] = pos
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	cons, _ := b.NewConsumer("rollup", true)
+	wg.Add(1)
+	go RollupConsumer(ctx, rollupVisit, cons, "visits", Retry{Attempts: 2}, &DeadLetter{Producer: prod, Topic: "visits.dlq"}, cancel, wg)
+
+	dlq, _ := b.NewConsumer("test", false)
+	dlq.Subscribe("visits.dlq")
+	msg, err := dlq.Poll(time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("expected dead letter, got: %v, %v", msg, err)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(applied)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	for _, h := range msg.Headers {
+		if h.Key == HeaderStage && string(h.Value) != StageRollup {
+			t.Errorf("expected stage: %v, got: %s", StageRollup, h.Value)
+		}
+	}
+	want := map[string]int{"1.1.1.1": 1, "fail": 2, "flaky": 2}
+	for ip, n := range want {
+		if calls[ip] != n {
+			t.Errorf("%s: expected calls: %v, got: %v", ip, n, calls[ip])
+		}
+	}
+	if pos := applied["flaky"]; pos.Topic != "visits" || pos.Offset != 2 {
+		t.Errorf("expected position of retried event, got: %+v", pos)
+	}
+}
+
+func TestSessionConsumer(t *testing.T) {
+	b := NewMemoryBroker(1)
+	prod, _ := b.NewProducer()
+	p := &Produce{Producer: prod, Topic: "visits"}
+	for _, ip := range []string{"1.1.1.1", "fail", "flaky"} {
+		if err := p.ProduceEvent(kcp.Event{IP: ip, VisitedAt: time.Date(2021, 1, 2, 10, 0, 0, 0, time.UTC)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	applied := make(map[string]bool)
+	sessionizeVisit := func(e kcp.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[e.IP]++
+		if e.IP == "fail" || e.IP == "flaky" && calls[e.IP] == 1 {
+			return errors.New("session failed")
+		}
+		applied[e.IP] = true
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	cons, _ := b.NewConsumer("sessions", true)
+	wg.Add(1)
+	go SessionConsumer(ctx, sessionizeVisit, cons, "visits", Retry{Attempts: 2}, &DeadLetter{Producer: prod, Topic: "visits.dlq"}, cancel, wg)
+
+	dlq, _ := b.NewConsumer("test", false)
+	dlq.Subscribe("visits.dlq")
+	msg, err := dlq.Poll(time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("expected dead letter, got: %v, %v", msg, err)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(applied)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+	}
+	// wait for offset of last message to be committed
+	time.Sleep(time.Millisecond * 20)
+	cancel()
+	wg.Wait()
+
+	for _, h := range msg.Headers {
+		if h.Key == HeaderStage && string(h.Value) != StageSession {
+			t.Errorf("expected stage: %v, got: %s", StageSession, h.Value)
+		}
+	}
+	want := map[string]int{"1.1.1.1": 1, "fail": 2, "flaky": 2}
+	for ip, n := range want {
+		if calls[ip] != n {
+			t.Errorf("%s: expected calls: %v, got: %v", ip, n, calls[ip])
+		}
+	}
+	cons, _ = b.NewConsumer("sessions", true)
+	cons.Subscribe("visits")
+	if got := pollAll(t, cons); len(got) != 0 {
+		t.Errorf("expected committed offsets, got: %v uncommitted", len(got))
+	}
+}
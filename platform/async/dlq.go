@@ -0,0 +1,166 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers added to dead letter messages, original headers are kept.
+const (
+	headerPrefix    = "dlq."
+	HeaderError     = headerPrefix + "error"
+	HeaderStage     = headerPrefix + "stage"
+	HeaderTopic     = headerPrefix + "topic"
+	HeaderPartition = headerPrefix + "partition"
+	HeaderOffset    = headerPrefix + "offset"
+	HeaderFailedAt  = headerPrefix + "failed_at"
+)
+
+// Stages at which processing of message can fail.
+const (
+	StageDecode  = "decode"
+	StageInsert  = "insert"
+	StageRollup  = "rollup"
+	StageSession = "session"
+)
+
+// Retry describes retries with exponential backoff.
+type Retry struct {
+	// Attempts is max number of attempts including first one, single attempt is made if less than 1.
+	Attempts int
+	// Backoff is delay after first failed attempt, it is doubled after each next one.
+	Backoff time.Duration
+	// MaxBackoff limits delay between attempts, not limited if zero.
+	MaxBackoff time.Duration
+}
+
+// Do calls f until it succeeds, attempts are exhausted or ctx is done.
+// Returns last error of f or error of ctx.
+func (r Retry) Do(ctx context.Context, f func() error) error {
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= r.Attempts {
+			return err
+		}
+		fmt.Printf("Attempt %v failed: %v\n", attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+// DeadLetterPublisher publishes message, which failed to be processed at stage, with error.
+type DeadLetterPublisher interface {
+	PublishDeadLetter(msg *Message, stage string, err error) error
+}
+
+// DeadLetter publishes failed messages to Topic using producer.
+type DeadLetter struct {
+	Producer Producer
+	Topic    string
+}
+
+// PublishDeadLetter publishes original key, value and headers of message
+// with error metadata headers and waits for delivery.
+func (d *DeadLetter) PublishDeadLetter(msg *Message, stage string, err error) error {
+	headers := append([]Header{}, msg.Headers...)
+	headers = append(headers,
+		Header{Key: HeaderError, Value: []byte(err.Error())},
+		Header{Key: HeaderStage, Value: []byte(stage)},
+		Header{Key: HeaderTopic, Value: []byte(msg.Topic)},
+		Header{Key: HeaderPartition, Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		Header{Key: HeaderOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		Header{Key: HeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+
+	return d.Producer.Produce(&Message{
+		Topic:   d.Topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+}
+
+// handleFailure publishes failed message to dead letter topic, message is dropped if publisher is nil.
+// Returns error if message could not be published, consumer should then stop without committing it.
+func handleFailure(dlq DeadLetterPublisher, msg *Message, stage string, err error) error {
+	if dlq == nil {
+		fmt.Printf("Processing of %v[%v]@%v failed at %v: %v\n", msg.Topic, msg.Partition, msg.Offset, stage, err)
+		return nil
+	}
+	if perr := dlq.PublishDeadLetter(msg, stage, err); perr != nil {
+		return fmt.Errorf("publish dead letter of %v[%v]@%v failed at %v: %v: %w", msg.Topic, msg.Partition, msg.Offset, stage, err, perr)
+	}
+	return nil
+}
+
+// RedriveDeadLetters produces messages consumed from dead letter topic from back to their original topic,
+// or to topic to if it is unknown, with original headers, offset is committed after each delivery.
+// Stops when ctx is done or no messages are received for idle duration,
+// returns number of redriven messages.
+func RedriveDeadLetters(ctx context.Context, cons Consumer, prod Producer, from, to string, idle time.Duration) (int, error) {
+	if err := cons.Subscribe(from); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	lastMsg := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return count, nil
+		default:
+		}
+		if time.Since(lastMsg) > idle {
+			return count, nil
+		}
+
+		msg, err := cons.Poll(time.Millisecond * 500)
+		if err != nil {
+			return count, err
+		}
+		if msg == nil {
+			continue
+		}
+		lastMsg = time.Now()
+		if err := prod.Produce(redriveMessage(msg, to)); err != nil {
+			return count, err
+		}
+		if err := cons.CommitMessage(msg); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// redriveMessage returns message to produce to original topic of dead letter message,
+// or to topic if it is unknown.
+func redriveMessage(msg *Message, topic string) *Message {
+	var headers []Header
+	for _, h := range msg.Headers {
+		if h.Key == HeaderTopic {
+			topic = string(h.Value)
+		}
+		if strings.HasPrefix(h.Key, headerPrefix) {
+			continue
+		}
+		headers = append(headers, h)
+	}
+	return &Message{
+		Topic:   topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+}
@@ -0,0 +1,86 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryDo(t *testing.T) {
+	errFail := errors.New("fail")
+
+	type test struct {
+		retry    Retry
+		failures int
+		calls    int
+		err      error
+	}
+
+	tests := map[string]test{
+		"succeeds first":    {retry: Retry{Attempts: 3}, failures: 0, calls: 1, err: nil},
+		"succeeds on retry": {retry: Retry{Attempts: 3, Backoff: time.Millisecond}, failures: 2, calls: 3, err: nil},
+		"attempts exceeded": {retry: Retry{Attempts: 3, Backoff: time.Millisecond}, failures: 5, calls: 3, err: errFail},
+		"no retries":        {retry: Retry{}, failures: 5, calls: 1, err: errFail},
+	}
+
+	for name, tt := range tests {
+		calls := 0
+		err := tt.retry.Do(context.Background(), func() error {
+			calls++
+			if calls <= tt.failures {
+				return errFail
+			}
+			return nil
+		})
+		if err != tt.err {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s: expected calls: %v, got: %v", name, tt.calls, calls)
+		}
+	}
+}
+
+func TestRetryDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := Retry{Attempts: 3, Backoff: time.Hour}.Do(ctx, func() error {
+		return errors.New("fail")
+	})
+	if err != context.Canceled {
+		t.Errorf("expected: %v, got: %v", context.Canceled, err)
+	}
+}
+
+func TestRedriveMessage(t *testing.T) {
+	msg := &Message{
+		Topic: "visits.dlq",
+		Key:   []byte("ip"),
+		Value: []byte("value"),
+		Headers: []Header{
+			{Key: CodecHeader, Value: []byte("json")},
+			{Key: HeaderError, Value: []byte("failed")},
+			{Key: HeaderTopic, Value: []byte("visits")},
+		},
+	}
+
+	got := redriveMessage(msg, "default")
+	if got.Topic != "visits" {
+		t.Errorf("expected topic: visits, got: %v", got.Topic)
+	}
+	wantHeaders := []Header{{Key: CodecHeader, Value: []byte("json")}}
+	if !reflect.DeepEqual(got.Headers, wantHeaders) {
+		t.Errorf("expected headers: %v, got: %v", wantHeaders, got.Headers)
+	}
+	if string(got.Key) != "ip" || string(got.Value) != "value" {
+		t.Errorf("expected original key and value, got: %s, %s", got.Key, got.Value)
+	}
+
+	msg.Headers = msg.Headers[:2]
+	if got := redriveMessage(msg, "default"); got.Topic != "default" {
+		t.Errorf("expected topic: default, got: %v", got.Topic)
+	}
+}
@@ -0,0 +1,200 @@
+package async
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// KafkaBroker creates producers and consumers connected to kafka bootstrap servers at Host.
+type KafkaBroker struct {
+	Host string
+}
+
+// NewProducer returns producer connected to kafka.
+func (b KafkaBroker) NewProducer() (Producer, error) {
+	p, err := KafkaProducerConn(b.Host)
+	if err != nil {
+		return nil, err
+	}
+	return NewKafkaProducer(p), nil
+}
+
+// NewConsumer returns consumer connected to kafka.
+func (b KafkaBroker) NewConsumer(groupID string, manualCommit bool) (Consumer, error) {
+	c, err := KafkaConsumerConn(b.Host, groupID, map[string]kafka.ConfigValue{
+		"enable.auto.commit": !manualCommit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaConsumer{Consumer: c}, nil
+}
+
+// KafkaProducer implements Producer using kafka producer.
+// Delivery reports are read from producer events channel and passed
+// to callback of produced message, which is set as its opaque value.
+type KafkaProducer struct {
+	*kafka.Producer
+}
+
+// NewKafkaProducer returns KafkaProducer and starts handling delivery reports of p,
+// which is stopped when p is closed.
+func NewKafkaProducer(p *kafka.Producer) *KafkaProducer {
+	kp := &KafkaProducer{Producer: p}
+	go kp.handleEvents()
+	return kp
+}
+
+func (p *KafkaProducer) handleEvents() {
+	for ev := range p.Events() {
+		switch e := ev.(type) {
+		case *kafka.Message:
+			delivered, ok := e.Opaque.(Delivered)
+			if !ok {
+				fmt.Printf("Ignored delivery report of %v\n", e.TopicPartition)
+				continue
+			}
+			if e.TopicPartition.Error != nil {
+				delivered(fromKafkaMessage(e), producerError(e.TopicPartition.Error))
+				continue
+			}
+			delivered(fromKafkaMessage(e), nil)
+		case kafka.Error:
+			fmt.Println(e)
+		default:
+			fmt.Printf("Ignored %v\n", e)
+		}
+	}
+}
+
+// Produce produces message to kafka and waits for its delivery.
+func (p *KafkaProducer) Produce(msg *Message) error {
+	errc := make(chan error, 1)
+	if err := p.ProduceAsync(msg, func(_ *Message, err error) {
+		errc <- err
+	}); err != nil {
+		return err
+	}
+	if err := <-errc; err != nil {
+		fmt.Printf("Delivery failed: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// ProduceAsync enqueues message to kafka producer queue,
+// delivered is called from delivery report handling goroutine.
+func (p *KafkaProducer) ProduceAsync(msg *Message, delivered Delivered) error {
+	m := toKafkaMessage(msg)
+	m.Opaque = delivered
+	if err := p.Producer.Produce(m, nil); err != nil {
+		fmt.Printf("Produce failed: %v\n", err)
+		return producerError(err)
+	}
+	return nil
+}
+
+// producerError wraps err with kcp.ErrUnavailable, if message could not be produced,
+// because producer queue is full, brokers are down or delivery timed out.
+func producerError(err error) error {
+	kerr, ok := err.(kafka.Error)
+	if !ok {
+		return err
+	}
+	switch kerr.Code() {
+	case kafka.ErrQueueFull, kafka.ErrAllBrokersDown, kafka.ErrTransport, kafka.ErrMsgTimedOut, kafka.ErrTimedOut:
+		return fmt.Errorf("%w: %v", kcp.ErrUnavailable, err)
+	}
+	return err
+}
+
+// Flush waits for delivery of queued messages until timeout.
+func (p *KafkaProducer) Flush(timeout time.Duration) int {
+	return p.Producer.Flush(int(timeout / time.Millisecond))
+}
+
+// KafkaConsumer implements Consumer using kafka consumer.
+type KafkaConsumer struct {
+	*kafka.Consumer
+}
+
+// Subscribe subscribes to topics.
+func (c *KafkaConsumer) Subscribe(topics ...string) error {
+	return c.SubscribeTopics(topics, nil)
+}
+
+// Poll polls kafka for next message, non fatal errors are printed and ignored.
+func (c *KafkaConsumer) Poll(timeout time.Duration) (*Message, error) {
+	switch e := c.Consumer.Poll(int(timeout / time.Millisecond)).(type) {
+	case *kafka.Message:
+		if e.TopicPartition.Error != nil {
+			fmt.Println(e.TopicPartition.Error)
+			return nil, nil
+		}
+		return fromKafkaMessage(e), nil
+	case kafka.Error:
+		if e.IsFatal() {
+			return nil, e
+		}
+		fmt.Println(e)
+	case nil:
+	default:
+		fmt.Printf("Ignored %v\n", e)
+	}
+	return nil, nil
+}
+
+// Commit commits offsets of all polled messages.
+func (c *KafkaConsumer) Commit() error {
+	if _, err := c.Consumer.Commit(); err != nil {
+		if kerr, ok := err.(kafka.Error); ok && kerr.Code() == kafka.ErrNoOffset {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// CommitMessage commits offset of message.
+func (c *KafkaConsumer) CommitMessage(msg *Message) error {
+	_, err := c.CommitOffsets([]kafka.TopicPartition{{
+		Topic:     &msg.Topic,
+		Partition: msg.Partition,
+		Offset:    kafka.Offset(msg.Offset + 1),
+	}})
+	return err
+}
+
+func toKafkaMessage(msg *Message) *kafka.Message {
+	topic := msg.Topic
+	var headers []kafka.Header
+	for _, h := range msg.Headers {
+		headers = append(headers, kafka.Header{Key: h.Key, Value: h.Value})
+	}
+	return &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        headers,
+	}
+}
+
+func fromKafkaMessage(msg *kafka.Message) *Message {
+	m := &Message{
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+		Key:       msg.Key,
+		Value:     msg.Value,
+	}
+	if msg.TopicPartition.Topic != nil {
+		m.Topic = *msg.TopicPartition.Topic
+	}
+	for _, h := range msg.Headers {
+		m.Headers = append(m.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return m
+}
@@ -0,0 +1,321 @@
+package async
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errConsumerClosed = errors.New("consumer closed")
+
+// MemoryBroker is in-memory broker for running without kafka and in tests.
+// Topics are created with fixed number of partitions on first use,
+// messages are kept until broker is garbage collected.
+type MemoryBroker struct {
+	partitions int
+
+	mu     sync.Mutex
+	topics map[string][][]*Message
+	next   map[string]int
+	groups map[string]*memoryGroup
+	// notify is closed and replaced when message is produced or partitions are reassigned.
+	notify chan struct{}
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// memoryGroup contains members and committed offsets of consumer group.
+type memoryGroup struct {
+	members   []*MemoryConsumer
+	committed map[topicPartition]int64
+}
+
+// NewMemoryBroker returns broker creating topics with number of partitions, at least one.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBroker{
+		partitions: partitions,
+		topics:     make(map[string][][]*Message),
+		next:       make(map[string]int),
+		groups:     make(map[string]*memoryGroup),
+		notify:     make(chan struct{}),
+	}
+}
+
+// NewProducer returns producer of broker.
+func (b *MemoryBroker) NewProducer() (Producer, error) {
+	return &MemoryProducer{broker: b}, nil
+}
+
+// NewConsumer returns consumer joined to group.
+func (b *MemoryBroker) NewConsumer(groupID string, manualCommit bool) (Consumer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, ok := b.groups[groupID]
+	if !ok {
+		g = &memoryGroup{committed: make(map[topicPartition]int64)}
+		b.groups[groupID] = g
+	}
+	c := &MemoryConsumer{
+		broker:       b,
+		group:        g,
+		manualCommit: manualCommit,
+		positions:    make(map[topicPartition]int64),
+	}
+	g.members = append(g.members, c)
+	return c, nil
+}
+
+// createTopic creates topic if it does not exist and reassigns partitions of groups subscribed to it.
+// Must be called with lock held.
+func (b *MemoryBroker) createTopic(topic string) {
+	if _, ok := b.topics[topic]; ok {
+		return
+	}
+	b.topics[topic] = make([][]*Message, b.partitions)
+	for _, g := range b.groups {
+		b.rebalance(g)
+	}
+}
+
+// rebalance assigns partitions of subscribed topics to members of group in round robin.
+// Positions of partitions kept by member are not changed, positions of partitions
+// assigned to another member start from committed offset.
+// Must be called with lock held.
+func (b *MemoryBroker) rebalance(g *memoryGroup) {
+	topics := make(map[string][]*MemoryConsumer)
+	for _, c := range g.members {
+		for _, t := range c.topics {
+			topics[t] = append(topics[t], c)
+		}
+	}
+
+	assigned := make(map[*MemoryConsumer]map[topicPartition]int64)
+	for _, c := range g.members {
+		assigned[c] = make(map[topicPartition]int64)
+	}
+	for topic, members := range topics {
+		for p := range b.topics[topic] {
+			tp := topicPartition{topic: topic, partition: int32(p)}
+			c := members[p%len(members)]
+			pos, ok := c.positions[tp]
+			if !ok {
+				pos = g.committed[tp]
+			}
+			assigned[c][tp] = pos
+		}
+	}
+	for c, positions := range assigned {
+		c.positions = positions
+	}
+	b.broadcast()
+}
+
+// broadcast wakes up polling consumers. Must be called with lock held.
+func (b *MemoryBroker) broadcast() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// MemoryProducer produces messages to MemoryBroker.
+type MemoryProducer struct {
+	broker *MemoryBroker
+}
+
+// Produce appends copy of message to partition chosen by hash of key,
+// messages without key are distributed in round robin.
+func (p *MemoryProducer) Produce(msg *Message) error {
+	_, err := p.produce(msg)
+	return err
+}
+
+// ProduceAsync produces message, delivered is called before returning.
+func (p *MemoryProducer) ProduceAsync(msg *Message, delivered Delivered) error {
+	m, err := p.produce(msg)
+	if err != nil {
+		return err
+	}
+	delivered(m, nil)
+	return nil
+}
+
+// Flush returns zero, messages are delivered when produced.
+func (p *MemoryProducer) Flush(timeout time.Duration) int {
+	return 0
+}
+
+// produce appends copy of message to partition and returns another copy with position set.
+func (p *MemoryProducer) produce(msg *Message) (*Message, error) {
+	b := p.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.createTopic(msg.Topic)
+	partitions := b.topics[msg.Topic]
+
+	var partition int
+	if msg.Key != nil {
+		h := fnv.New32a()
+		h.Write(msg.Key)
+		partition = int(h.Sum32() % uint32(len(partitions)))
+	} else {
+		partition = b.next[msg.Topic] % len(partitions)
+		b.next[msg.Topic]++
+	}
+
+	m := copyMessage(msg)
+	m.Partition = int32(partition)
+	m.Offset = int64(len(partitions[partition]))
+	partitions[partition] = append(partitions[partition], m)
+	b.broadcast()
+	return copyMessage(m), nil
+}
+
+// Close does nothing, messages are delivered when produced.
+func (p *MemoryProducer) Close() {}
+
+// MemoryConsumer consumes messages from MemoryBroker as member of consumer group.
+type MemoryConsumer struct {
+	broker       *MemoryBroker
+	group        *memoryGroup
+	manualCommit bool
+	topics       []string
+	// positions contains offsets of next messages of assigned partitions.
+	positions map[topicPartition]int64
+	closed    bool
+}
+
+// Subscribe subscribes to topics, replacing previous subscription, topics are created if needed.
+func (c *MemoryConsumer) Subscribe(topics ...string) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return errConsumerClosed
+	}
+	c.topics = topics
+	for _, t := range topics {
+		b.createTopic(t)
+	}
+	b.rebalance(c.group)
+	return nil
+}
+
+// Poll returns next message of assigned partitions, waiting for it until timeout.
+func (c *MemoryConsumer) Poll(timeout time.Duration) (*Message, error) {
+	b := c.broker
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mu.Lock()
+		if c.closed {
+			b.mu.Unlock()
+			return nil, errConsumerClosed
+		}
+		msg := c.nextMessage()
+		notify := b.notify
+		b.mu.Unlock()
+		if msg != nil {
+			return msg, nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, nil
+		}
+		select {
+		case <-notify:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// nextMessage returns copy of message at earliest position of assigned partitions
+// and advances it. Must be called with lock held.
+func (c *MemoryConsumer) nextMessage() *Message {
+	var tps []topicPartition
+	for tp, pos := range c.positions {
+		if pos < int64(len(c.broker.topics[tp.topic][tp.partition])) {
+			tps = append(tps, tp)
+		}
+	}
+	if len(tps) == 0 {
+		return nil
+	}
+	sort.Slice(tps, func(i, j int) bool {
+		if c.positions[tps[i]] != c.positions[tps[j]] {
+			return c.positions[tps[i]] < c.positions[tps[j]]
+		}
+		if tps[i].topic != tps[j].topic {
+			return tps[i].topic < tps[j].topic
+		}
+		return tps[i].partition < tps[j].partition
+	})
+
+	tp := tps[0]
+	msg := copyMessage(c.broker.topics[tp.topic][tp.partition][c.positions[tp]])
+	c.positions[tp]++
+	if !c.manualCommit {
+		c.group.committed[tp] = c.positions[tp]
+	}
+	return msg
+}
+
+// Commit commits positions of assigned partitions.
+func (c *MemoryConsumer) Commit() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return errConsumerClosed
+	}
+	for tp, pos := range c.positions {
+		c.group.committed[tp] = pos
+	}
+	return nil
+}
+
+// CommitMessage commits offset following message.
+func (c *MemoryConsumer) CommitMessage(msg *Message) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return errConsumerClosed
+	}
+	c.group.committed[topicPartition{topic: msg.Topic, partition: msg.Partition}] = msg.Offset + 1
+	return nil
+}
+
+// Close leaves consumer group, partitions are reassigned to remaining members.
+// Positions, which were not committed, are lost.
+func (c *MemoryConsumer) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	members := c.group.members[:0]
+	for _, m := range c.group.members {
+		if m != c {
+			members = append(members, m)
+		}
+	}
+	c.group.members = members
+	c.positions = nil
+	b.rebalance(c.group)
+	return nil
+}
+
+func copyMessage(msg *Message) *Message {
+	m := *msg
+	m.Headers = append([]Header(nil), msg.Headers...)
+	return &m
+}
@@ -0,0 +1,134 @@
+package async
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func produceMessages(t *testing.T, b *MemoryBroker, topic string, n int) {
+	p, _ := b.NewProducer()
+	for i := 0; i < n; i++ {
+		if err := p.Produce(&Message{Topic: topic, Key: []byte(fmt.Sprint(i)), Value: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func pollAll(t *testing.T, c Consumer) []string {
+	var values []string
+	for {
+		msg, err := c.Poll(time.Millisecond * 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			return values
+		}
+		values = append(values, string(msg.Value))
+	}
+}
+
+func TestMemoryBrokerGroups(t *testing.T) {
+	b := NewMemoryBroker(4)
+	first, _ := b.NewConsumer("group", false)
+	second, _ := b.NewConsumer("group", false)
+	other, _ := b.NewConsumer("other", false)
+	for _, c := range []Consumer{first, second, other} {
+		if err := c.Subscribe("topic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	produceMessages(t, b, "topic", 20)
+
+	firstValues := pollAll(t, first)
+	secondValues := pollAll(t, second)
+	if len(firstValues) == 0 || len(secondValues) == 0 {
+		t.Errorf("expected partitions to be shared, got: %v and %v", firstValues, secondValues)
+	}
+	seen := make(map[string]int)
+	for _, v := range append(firstValues, secondValues...) {
+		seen[v]++
+	}
+	for v, n := range seen {
+		if n != 1 {
+			t.Errorf("expected %v to be consumed once, got: %v", v, n)
+		}
+	}
+	if len(seen) != 20 {
+		t.Errorf("expected: %v, got: %v", 20, len(seen))
+	}
+	if got := pollAll(t, other); len(got) != 20 {
+		t.Errorf("expected: %v, got: %v", 20, len(got))
+	}
+}
+
+func TestMemoryBrokerCommit(t *testing.T) {
+	type test struct {
+		manualCommit bool
+		commit       bool
+		redelivered  int
+	}
+
+	tests := map[string]test{
+		"auto commit":          {manualCommit: false, commit: false, redelivered: 0},
+		"manual commit":        {manualCommit: true, commit: true, redelivered: 0},
+		"manual not committed": {manualCommit: true, commit: false, redelivered: 5},
+	}
+
+	for name, tt := range tests {
+		b := NewMemoryBroker(2)
+		produceMessages(t, b, "topic", 5)
+
+		c, _ := b.NewConsumer("group", tt.manualCommit)
+		c.Subscribe("topic")
+		if got := pollAll(t, c); len(got) != 5 {
+			t.Errorf("%s: expected: %v, got: %v", name, 5, len(got))
+		}
+		if tt.commit {
+			c.Commit()
+		}
+		c.Close()
+
+		c, _ = b.NewConsumer("group", tt.manualCommit)
+		c.Subscribe("topic")
+		if got := pollAll(t, c); len(got) != tt.redelivered {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.redelivered, len(got))
+		}
+	}
+}
+
+func TestMemoryBrokerRebalance(t *testing.T) {
+	b := NewMemoryBroker(2)
+	first, _ := b.NewConsumer("group", false)
+	second, _ := b.NewConsumer("group", false)
+	first.Subscribe("topic")
+	second.Subscribe("topic")
+	second.Close()
+
+	produceMessages(t, b, "topic", 10)
+	if got := pollAll(t, first); len(got) != 10 {
+		t.Errorf("expected: %v, got: %v", 10, len(got))
+	}
+	if _, err := second.Poll(0); err != errConsumerClosed {
+		t.Errorf("expected: %v, got: %v", errConsumerClosed, err)
+	}
+}
+
+func TestMemoryConsumerPollWaits(t *testing.T) {
+	b := NewMemoryBroker(1)
+	c, _ := b.NewConsumer("group", false)
+	c.Subscribe("topic")
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		produceMessages(t, b, "topic", 1)
+	}()
+	msg, err := c.Poll(time.Second)
+	if err != nil || msg == nil {
+		t.Fatalf("expected message, got: %v, %v", msg, err)
+	}
+	if msg.Offset != 0 || msg.Topic != "topic" {
+		t.Errorf("expected: topic@0, got: %v@%v", msg.Topic, msg.Offset)
+	}
+}
@@ -1,55 +1,166 @@
 package async
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
-
-	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/SarunasBucius/kafka-cass-practise/kcp"
 )
 
-// Produce contains connection to kafka producer.
+// Produce produces events to Topic using producer connected to broker
+// and codec used to encode events. Events are encoded using gob if codec is nil.
+// Number of events waiting for delivery is limited if Produce is created using NewProduce.
 type Produce struct {
-	*kafka.Producer
+	Producer Producer
+	Codec    Codec
+	Topic    string
+
+	inFlight chan struct{}
+	pending  int64
+	wg       sync.WaitGroup
+}
+
+// NewProduce returns Produce of events to topic allowing at most maxInFlight events waiting for delivery,
+// not limited if maxInFlight is less than 1.
+func NewProduce(p Producer, codec Codec, topic string, maxInFlight int) *Produce {
+	prod := &Produce{Producer: p, Codec: codec, Topic: topic}
+	if maxInFlight > 0 {
+		prod.inFlight = make(chan struct{}, maxInFlight)
+	}
+	return prod
+}
+
+// Delivery is result of asynchronously produced event, which is available once it is done.
+type Delivery struct {
+	done chan struct{}
+	msg  *Message
+	err  error
+}
+
+// Done returns channel closed when delivery report is received.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
 }
 
-// ProduceEvent produces kcp.Event to kafka.
+// Wait waits for delivery report and returns delivery error.
+func (d *Delivery) Wait() error {
+	<-d.done
+	return d.err
+}
+
+// Message returns delivered message containing its partition and offset, nil until done or if delivery failed.
+func (d *Delivery) Message() *Message {
+	select {
+	case <-d.done:
+		return d.msg
+	default:
+		return nil
+	}
+}
+
+// ProduceEvent produces kcp.Event and waits for its delivery.
 func (p *Produce) ProduceEvent(event kcp.Event) error {
-	topic := "visits"
-	b, err := encodeGob(event)
+	d, err := p.ProduceEventAsync(event)
 	if err != nil {
 		return err
 	}
-	if err := p.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Value:          b,
-		Key:            []byte(event.IP),
-	}, nil); err != nil {
-		fmt.Printf("Produce failed: %v\n", err)
+	return d.Wait()
+}
+
+// ProduceEventAsync produces kcp.Event without waiting for delivery.
+func (p *Produce) ProduceEventAsync(event kcp.Event) (*Delivery, error) {
+	d := &Delivery{done: make(chan struct{})}
+	if err := p.ProduceEventFunc(event, func(msg *Message, err error) {
+		d.msg, d.err = msg, err
+		close(d.done)
+	}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ProduceEventFunc produces kcp.Event, delivered is called once delivery report is received.
+// Blocks while number of events waiting for delivery is at limit.
+// Codec name is set in CodecHeader.
+func (p *Produce) ProduceEventFunc(event kcp.Event, delivered Delivered) error {
+	codec := p.Codec
+	if codec == nil {
+		codec = GobCodec{}
+	}
+	b, err := codec.Encode(event)
+	if err != nil {
 		return err
 	}
 
-	switch e := (<-p.Events()).(type) {
-	case *kafka.Message:
-		if e.TopicPartition.Error != nil {
-			fmt.Printf("Delivery failed: %v\n", e.TopicPartition.Error)
-			return e.TopicPartition.Error
+	if p.inFlight != nil {
+		p.inFlight <- struct{}{}
+	}
+	p.wg.Add(1)
+	atomic.AddInt64(&p.pending, 1)
+	done := func() {
+		atomic.AddInt64(&p.pending, -1)
+		p.wg.Done()
+		if p.inFlight != nil {
+			<-p.inFlight
 		}
-	case kafka.Error:
-		fmt.Println(e)
-		return e
 	}
 
+	if err := p.Producer.ProduceAsync(&Message{
+		Topic:   p.Topic,
+		Value:   b,
+		Key:     []byte(event.IP),
+		Headers: []Header{{Key: CodecHeader, Value: []byte(codec.Name())}},
+	}, func(msg *Message, err error) {
+		defer done()
+		delivered(msg, err)
+	}); err != nil {
+		done()
+		return err
+	}
 	return nil
 }
 
-func encodeGob(event kcp.Event) ([]byte, error) {
-	var b bytes.Buffer
-	if err := gob.NewEncoder(&b).Encode(event); err != nil {
-		fmt.Println(err)
-		return nil, err
+// Queue produces events using Produce without waiting for their delivery,
+// so that callers, e.g. http handlers, are not blocked by broker.
+// It implements kcp.Producer.
+type Queue struct {
+	Produce *Produce
+	// Failed is called with event, which could not be delivered, failure is printed if it is nil.
+	Failed func(kcp.Event, error)
+}
+
+// ProduceEvent produces kcp.Event and returns once it is queued,
+// it blocks only while number of events waiting for delivery is at limit.
+// Failed delivery is reported to Failed.
+func (q *Queue) ProduceEvent(event kcp.Event) error {
+	return q.Produce.ProduceEventFunc(event, func(msg *Message, err error) {
+		if err == nil {
+			return
+		}
+		if q.Failed != nil {
+			q.Failed(event, err)
+			return
+		}
+		fmt.Printf("Delivery of visit %v failed: %v\n", event.ID, err)
+	})
+}
+
+// Flush waits until delivery reports of produced events are received or timeout,
+// returns number of events still waiting for delivery.
+func (p *Produce) Flush(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	p.Producer.Flush(timeout)
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		p.wg.Wait()
+	}()
+
+	select {
+	case <-c:
+	case <-time.After(time.Until(deadline)):
 	}
-	return b.Bytes(), nil
+	return int(atomic.LoadInt64(&p.pending))
 }
@@ -0,0 +1,183 @@
+package async
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// heldProducer holds delivery reports until deliver is called.
+type heldProducer struct {
+	mu        sync.Mutex
+	delivered []Delivered
+	msgs      []*Message
+}
+
+func (p *heldProducer) Produce(msg *Message) error { return nil }
+
+func (p *heldProducer) ProduceAsync(msg *Message, delivered Delivered) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := copyMessage(msg)
+	m.Offset = int64(len(p.msgs))
+	p.msgs = append(p.msgs, m)
+	p.delivered = append(p.delivered, delivered)
+	return nil
+}
+
+func (p *heldProducer) Flush(timeout time.Duration) int { return 0 }
+
+func (p *heldProducer) Close() {}
+
+func (p *heldProducer) deliver(i int, err error) {
+	p.mu.Lock()
+	delivered, msg := p.delivered[i], p.msgs[i]
+	p.mu.Unlock()
+	delivered(msg, err)
+}
+
+func TestProduceEventAsync(t *testing.T) {
+	errDelivery := errors.New("delivery failed")
+	hp := &heldProducer{}
+	p := NewProduce(hp, JSONCodec{}, "visits", 0)
+
+	first, err := p.ProduceEventAsync(kcp.Event{IP: "1.1.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.ProduceEventAsync(kcp.Event{IP: "2.2.2.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hp.deliver(1, errDelivery)
+	if err := second.Wait(); err != errDelivery {
+		t.Errorf("expected: %v, got: %v", errDelivery, err)
+	}
+	select {
+	case <-first.Done():
+		t.Errorf("expected first delivery to be pending")
+	default:
+	}
+	if n := p.Flush(time.Millisecond); n != 1 {
+		t.Errorf("expected pending: %v, got: %v", 1, n)
+	}
+
+	hp.deliver(0, nil)
+	if err := first.Wait(); err != nil {
+		t.Errorf("expected: %v, got: %v", nil, err)
+	}
+	if msg := first.Message(); msg == nil || string(msg.Key) != "1.1.1.1" || msg.Offset != 0 {
+		t.Errorf("expected message of 1.1.1.1 at offset 0, got: %v", msg)
+	}
+	if n := p.Flush(time.Second); n != 0 {
+		t.Errorf("expected pending: %v, got: %v", 0, n)
+	}
+}
+
+func TestProduceInFlightLimit(t *testing.T) {
+	hp := &heldProducer{}
+	p := NewProduce(hp, JSONCodec{}, "visits", 2)
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.ProduceEventAsync(kcp.Event{IP: "ip"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		p.ProduceEventAsync(kcp.Event{IP: "ip"})
+	}()
+	select {
+	case <-produced:
+		t.Fatalf("expected produce to block while %v events are in flight", 2)
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	hp.deliver(0, nil)
+	select {
+	case <-produced:
+	case <-time.After(time.Second):
+		t.Errorf("expected produce to continue after delivery")
+	}
+}
+
+func TestProduceEventMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker(2)
+	prod, _ := b.NewProducer()
+	p := NewProduce(prod, nil, "visits", 1)
+
+	event := kcp.Event{VisitedAt: time.Date(2021, 1, 2, 10, 0, 0, 0, time.UTC), IP: "1.1.1.1", Day: "Saturday"}
+	for i := 0; i < 3; i++ {
+		if err := p.ProduceEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, _ := b.NewConsumer("test", false)
+	c.Subscribe("visits")
+	for i := 0; i < 3; i++ {
+		msg, err := c.Poll(time.Second)
+		if err != nil || msg == nil {
+			t.Fatalf("expected message, got: %v, %v", msg, err)
+		}
+		got, err := decodeMessage(msg)
+		if err != nil || !got.VisitedAt.Equal(event.VisitedAt) || got.IP != event.IP {
+			t.Errorf("expected: %v, got: %v, %v", event, got, err)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	errDelivery := errors.New("delivery failed")
+	hp := &heldProducer{}
+	failed := make(chan kcp.Event, 1)
+	q := &Queue{Produce: NewProduce(hp, JSONCodec{}, "visits", 1), Failed: func(e kcp.Event, err error) {
+		if err != errDelivery {
+			t.Errorf("expected: %v, got: %v", errDelivery, err)
+		}
+		failed <- e
+	}}
+
+	// ProduceEvent returns before delivery report is received.
+	if err := q.ProduceEvent(kcp.Event{ID: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	produced := make(chan error)
+	go func() {
+		produced <- q.ProduceEvent(kcp.Event{ID: "second"})
+	}()
+	select {
+	case <-produced:
+		t.Fatalf("expected produce to block while in flight limit is reached")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	hp.deliver(0, errDelivery)
+	select {
+	case e := <-failed:
+		if e.ID != "first" {
+			t.Errorf("expected: %v, got: %v", "first", e.ID)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected failed delivery to be reported")
+	}
+	if err := <-produced; err != nil {
+		t.Errorf("expected: %v, got: %v", nil, err)
+	}
+
+	hp.deliver(1, nil)
+	if n := q.Produce.Flush(time.Second); n != 0 {
+		t.Errorf("expected pending: %v, got: %v", 0, n)
+	}
+	select {
+	case e := <-failed:
+		t.Errorf("expected only failed delivery to be reported, got: %v", e)
+	default:
+	}
+}
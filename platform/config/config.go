@@ -0,0 +1,354 @@
+// Package config provides typed configuration of kcp command.
+//
+// Configuration is loaded in order, later source overriding earlier one:
+//  * defaults (see Default)
+//  * YAML file passed using -config flag or CONFIG_FILE environment variable
+//  * environment variables named in env tags of fields, empty ones are ignored
+//  * command line flags named in flag tags of fields
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is configuration of kcp command.
+type Config struct {
+	Broker          string        `yaml:"broker" env:"BROKER" flag:"broker" usage:"broker of events: kafka or memory"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"max duration to wait for services to stop"`
+	Kafka           Kafka         `yaml:"kafka"`
+	Database        Database      `yaml:"database"`
+	HTTP            HTTP          `yaml:"http"`
+	Consumers       Consumers     `yaml:"consumers"`
+	Visits          Visits        `yaml:"visits"`
+}
+
+// Kafka configures producing and consuming events.
+type Kafka struct {
+	Host            string        `yaml:"host" env:"KAFKA_HOST" flag:"kafka-host" usage:"bootstrap servers of kafka"`
+	Codec           string        `yaml:"codec" env:"KAFKA_CODEC" flag:"kafka-codec" usage:"codec of produced events: gob, json or protobuf"`
+	Topic           string        `yaml:"topic" env:"KAFKA_TOPIC" flag:"kafka-topic" usage:"topic of visit events"`
+	DeadLetterTopic string        `yaml:"dead_letter_topic" env:"KAFKA_DEAD_LETTER_TOPIC" flag:"kafka-dead-letter-topic" usage:"topic of events which failed to be processed, <topic>.dlq if empty"`
+	MaxInFlight     int           `yaml:"max_in_flight" env:"KAFKA_MAX_IN_FLIGHT" flag:"kafka-max-in-flight" usage:"max number of events waiting for delivery, not limited if 0"`
+	FlushTimeout    time.Duration `yaml:"flush_timeout" env:"KAFKA_FLUSH_TIMEOUT" flag:"kafka-flush-timeout" usage:"max duration to wait for delivery of events on shutdown"`
+}
+
+// DeadLetter returns topic of events which failed to be processed,
+// DeadLetterTopic or visits topic with .dlq suffix if it is not set,
+// so that deployments with different topics do not share dead letters.
+func (k Kafka) DeadLetter() string {
+	if k.DeadLetterTopic != "" {
+		return k.DeadLetterTopic
+	}
+	return k.Topic + ".dlq"
+}
+
+// Database configures connections to storage.
+type Database struct {
+	Driver           string        `yaml:"driver" env:"DATABASE_DRIVER" flag:"database-driver" usage:"storage driver: cassandra, sqlite, gorm-sqlite or memory"`
+	SQLitePath       string        `yaml:"sqlite_path" env:"SQLITE_PATH" flag:"sqlite-path" usage:"path of SQLite db file"`
+	CassandraHost    string        `yaml:"cassandra_host" env:"CASSANDRA_HOST" flag:"cassandra-host" usage:"host of cassandra"`
+	CassandraTimeout time.Duration `yaml:"cassandra_timeout" env:"CASSANDRA_TIMEOUT" flag:"cassandra-timeout" usage:"timeout of cassandra queries"`
+}
+
+// HTTP configures http server.
+type HTTP struct {
+	Router         string        `yaml:"router" env:"HTTP_ROUTER" flag:"http-router" usage:"router of http api: gin or mux"`
+	Addr           string        `yaml:"addr" env:"HTTP_ADDR" flag:"http-addr" usage:"address http server listens on"`
+	ReadTimeout    time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT" flag:"http-read-timeout" usage:"timeout of reading request"`
+	WriteTimeout   time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT" flag:"http-write-timeout" usage:"timeout of writing response"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT" flag:"http-idle-timeout" usage:"timeout of idle keep-alive connection"`
+	HealthAddr     string        `yaml:"health_addr" env:"HEALTH_ADDR" flag:"health-addr" usage:"address health check of command listens on"`
+	TrustedProxies []string      `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" flag:"trusted-proxies" usage:"comma separated CIDRs or ips of proxies trusted to forward client ip"`
+}
+
+// Consumers configures consumer groups of events.
+type Consumers struct {
+	InsertGroup        string        `yaml:"insert_group" env:"INSERT_GROUP" flag:"insert-group" usage:"consumer group inserting visits"`
+	Inserters          int           `yaml:"inserters" env:"INSERTERS" flag:"inserters" usage:"number of consumers inserting visits"`
+	InsertBatchSize    int           `yaml:"insert_batch_size" env:"INSERT_BATCH_SIZE" flag:"insert-batch-size" usage:"max number of visits inserted in batch, one by one if 1"`
+	InsertBatchTimeout time.Duration `yaml:"insert_batch_timeout" env:"INSERT_BATCH_TIMEOUT" flag:"insert-batch-timeout" usage:"max duration visits are accumulated in batch"`
+	RollupGroup        string        `yaml:"rollup_group" env:"ROLLUP_GROUP" flag:"rollup-group" usage:"consumer group updating hourly rollups"`
+	SessionsGroup      string        `yaml:"sessions_group" env:"SESSIONS_GROUP" flag:"sessions-group" usage:"consumer group updating sessions"`
+	DayGroup           string        `yaml:"day_group" env:"DAY_GROUP" flag:"day-group" usage:"consumer group printing day of visits"`
+	RetryAttempts      int           `yaml:"retry_attempts" env:"RETRY_ATTEMPTS" flag:"retry-attempts" usage:"max number of attempts to insert visits"`
+	RetryBackoff       time.Duration `yaml:"retry_backoff" env:"RETRY_BACKOFF" flag:"retry-backoff" usage:"backoff before second attempt, doubled after each attempt"`
+	RetryMaxBackoff    time.Duration `yaml:"retry_max_backoff" env:"RETRY_MAX_BACKOFF" flag:"retry-max-backoff" usage:"max backoff between attempts"`
+}
+
+// Visits configures tracking of visits.
+type Visits struct {
+	Headers          []string      `yaml:"headers" env:"VISIT_HEADERS" flag:"visit-headers" usage:"comma separated request headers kept in visit events"`
+	SessionGap       time.Duration `yaml:"session_gap" env:"SESSION_GAP" flag:"session-gap" usage:"inactivity gap after which visit starts new session"`
+	MaxSessionVisits int           `yaml:"max_session_visits" env:"MAX_SESSION_VISITS" flag:"max-session-visits" usage:"max number of visits sessions are computed from on demand"`
+}
+
+// Default returns configuration used if it is not overridden.
+func Default() Config {
+	return Config{
+		Broker:          "kafka",
+		ShutdownTimeout: time.Second * 15,
+		Kafka: Kafka{
+			Codec:        "gob",
+			Topic:        "visits",
+			MaxInFlight:  1000,
+			FlushTimeout: time.Second * 10,
+		},
+		Database: Database{
+			Driver:           "gorm-sqlite",
+			SQLitePath:       "./kcp.db",
+			CassandraTimeout: time.Second * 2,
+		},
+		HTTP: HTTP{
+			Router:       "gin",
+			Addr:         ":80",
+			ReadTimeout:  time.Second * 15,
+			WriteTimeout: time.Second * 15,
+			IdleTimeout:  time.Second * 60,
+			HealthAddr:   ":8081",
+		},
+		Consumers: Consumers{
+			InsertGroup:        "inserter",
+			Inserters:          2,
+			InsertBatchSize:    1,
+			InsertBatchTimeout: time.Second,
+			RollupGroup:        "rollup",
+			SessionsGroup:      "sessions",
+			DayGroup:           "day",
+			RetryAttempts:      5,
+			RetryBackoff:       time.Millisecond * 100,
+			RetryMaxBackoff:    time.Second * 5,
+		},
+		Visits: Visits{
+			SessionGap:       time.Minute * 30,
+			MaxSessionVisits: 100000,
+		},
+	}
+}
+
+// FlagConfig is flag of configuration file path.
+const FlagConfig = "config"
+
+// EnvConfig is environment variable of configuration file path.
+const EnvConfig = "CONFIG_FILE"
+
+// Load registers configuration flags on fs, parses args and returns validated configuration.
+// Environment variables are looked up using lookupEnv, e.g. os.LookupEnv.
+// Flags of caller can be registered on fs before calling Load.
+func Load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	path := fs.String(FlagConfig, "", "path of YAML configuration file, "+EnvConfig+" environment variable by default")
+	c := Default()
+	fields := configFields(&c)
+	flags := make(map[string]*flagValue)
+	for _, f := range fields {
+		if f.flag == "" {
+			continue
+		}
+		flags[f.flag] = &flagValue{def: formatValue(f.value)}
+		fs.Var(flags[f.flag], f.flag, f.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *path == "" {
+		*path, _ = lookupEnv(EnvConfig)
+	}
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := yaml.UnmarshalStrict(b, &c); err != nil {
+			return Config{}, fmt.Errorf("invalid configuration file %v: %w", *path, err)
+		}
+	}
+
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		// Empty environment variable is treated as unset.
+		if v, ok := lookupEnv(f.env); ok && v != "" {
+			if err := setValue(f.value, v); err != nil {
+				return Config{}, fmt.Errorf("invalid %v: %w", f.env, err)
+			}
+		}
+	}
+	for _, f := range fields {
+		if fv, ok := flags[f.flag]; ok && fv.set {
+			if err := setValue(f.value, fv.raw); err != nil {
+				return Config{}, fmt.Errorf("invalid -%v: %w", f.flag, err)
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Validate checks if configuration values are valid.
+// Returned error lists all invalid values.
+func (c Config) Validate() error {
+	var invalid []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			invalid = append(invalid, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Broker == "kafka" || c.Broker == "memory", "broker must be kafka or memory, got %q", c.Broker)
+	check(c.Broker != "kafka" || c.Kafka.Host != "", "kafka.host must be set if broker is kafka")
+	check(c.Kafka.Codec == "gob" || c.Kafka.Codec == "json" || c.Kafka.Codec == "protobuf",
+		"kafka.codec must be gob, json or protobuf, got %q", c.Kafka.Codec)
+	check(c.Kafka.Topic != "", "kafka.topic must be set")
+	check(c.Kafka.DeadLetter() != c.Kafka.Topic, "kafka.dead_letter_topic must differ from kafka.topic")
+	check(c.Kafka.MaxInFlight >= 0, "kafka.max_in_flight must not be negative")
+	check(c.Database.Driver != "", "database.driver must be set")
+	check(c.Database.SQLitePath != "", "database.sqlite_path must be set")
+	check(c.Database.Driver != "cassandra" || c.Database.CassandraHost != "", "database.cassandra_host must be set if driver is cassandra")
+	check(c.HTTP.Router != "", "http.router must be set")
+	check(c.HTTP.Addr != "", "http.addr must be set")
+	check(c.HTTP.HealthAddr != "", "http.health_addr must be set")
+	check(c.Consumers.InsertGroup != "" && c.Consumers.RollupGroup != "" &&
+		c.Consumers.SessionsGroup != "" && c.Consumers.DayGroup != "", "consumers groups must be set")
+	check(c.Consumers.Inserters > 0, "consumers.inserters must be positive")
+	check(c.Consumers.InsertBatchSize > 0, "consumers.insert_batch_size must be positive")
+	check(c.Consumers.RetryAttempts > 0, "consumers.retry_attempts must be positive")
+	check(c.Consumers.RetryBackoff <= c.Consumers.RetryMaxBackoff, "consumers.retry_backoff must not exceed retry_max_backoff")
+	check(c.Visits.SessionGap > 0, "visits.session_gap must be positive")
+	check(c.Visits.MaxSessionVisits > 0, "visits.max_session_visits must be positive")
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"kafka.flush_timeout", c.Kafka.FlushTimeout},
+		{"database.cassandra_timeout", c.Database.CassandraTimeout},
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout},
+		{"http.idle_timeout", c.HTTP.IdleTimeout},
+		{"consumers.insert_batch_timeout", c.Consumers.InsertBatchTimeout},
+	} {
+		check(d.value > 0, "%v must be positive", d.name)
+	}
+
+	if invalid != nil {
+		return errors.New("invalid configuration: " + strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// Print writes configuration to w as YAML, which can be used as configuration file.
+func (c Config) Print(w io.Writer) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// field is configuration field, which can be set from environment variable or flag.
+type field struct {
+	value reflect.Value
+	env   string
+	flag  string
+	usage string
+}
+
+// configFields returns fields of c and its nested structs.
+func configFields(c *Config) []field {
+	var fields []field
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			f, sf := v.Field(i), v.Type().Field(i)
+			if f.Kind() == reflect.Struct {
+				walk(f)
+				continue
+			}
+			fields = append(fields, field{value: f, env: sf.Tag.Get("env"), flag: sf.Tag.Get("flag"), usage: sf.Tag.Get("usage")})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem())
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setValue parses raw into field value, lists are comma separated.
+func setValue(v reflect.Value, raw string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var values []string
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		v.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// formatValue formats field value as it is parsed by setValue.
+func formatValue(v reflect.Value) string {
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// flagValue keeps raw value of flag, which is applied after file and environment.
+type flagValue struct {
+	def string
+	raw string
+	set bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	if f.set {
+		return f.raw
+	}
+	return f.def
+}
+
+func (f *flagValue) Set(raw string) error {
+	f.raw, f.set = raw, true
+	return nil
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "kcp.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func lookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func load(args []string, env map[string]string) (Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return Load(fs, args, lookup(env))
+}
+
+func TestLoad(t *testing.T) {
+	file := writeFile(t, `
+broker: memory
+kafka:
+  codec: json
+  topic: file-topic
+http:
+  addr: ":8080"
+visits:
+  headers: [Accept]
+  session_gap: 10m
+`)
+
+	type test struct {
+		args   []string
+		env    map[string]string
+		expect func(*Config)
+	}
+
+	tests := map[string]test{
+		"defaults": {
+			env:    map[string]string{"KAFKA_HOST": "kafka:9092"},
+			expect: func(c *Config) { c.Kafka.Host = "kafka:9092" },
+		},
+		"file from flag": {
+			args: []string{"-config", file},
+			expect: func(c *Config) {
+				c.Broker, c.Kafka.Codec, c.Kafka.Topic, c.HTTP.Addr = "memory", "json", "file-topic", ":8080"
+				c.Visits.Headers, c.Visits.SessionGap = []string{"Accept"}, time.Minute*10
+			},
+		},
+		"env overrides file": {
+			env: map[string]string{EnvConfig: file, "KAFKA_TOPIC": "env-topic", "VISIT_HEADERS": "Accept, Accept-Language", "HTTP_ADDR": ""},
+			expect: func(c *Config) {
+				c.Broker, c.Kafka.Codec, c.Kafka.Topic, c.HTTP.Addr = "memory", "json", "env-topic", ":8080"
+				c.Visits.Headers, c.Visits.SessionGap = []string{"Accept", "Accept-Language"}, time.Minute*10
+			},
+		},
+		"flag overrides env": {
+			args: []string{"-config", file, "-kafka-topic", "flag-topic", "-session-gap", "1h", "-inserters", "4"},
+			env:  map[string]string{"KAFKA_TOPIC": "env-topic", "INSERTERS": "3"},
+			expect: func(c *Config) {
+				c.Broker, c.Kafka.Codec, c.Kafka.Topic, c.HTTP.Addr = "memory", "json", "flag-topic", ":8080"
+				c.Visits.Headers, c.Visits.SessionGap = []string{"Accept"}, time.Hour
+				c.Consumers.Inserters = 4
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		want := Default()
+		tt.expect(&want)
+		got, err := load(tt.args, tt.env)
+		if err != nil {
+			t.Errorf("%s: expected: %v, got: %v", name, nil, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected: %+v, got: %+v", name, want, got)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	type test struct {
+		args []string
+		env  map[string]string
+		err  string
+	}
+
+	tests := map[string]test{
+		"kafka host missing": {
+			err: "kafka.host must be set",
+		},
+		"all invalid values": {
+			args: []string{"-broker", "memory", "-kafka-codec", "xml", "-inserters", "0"},
+			err:  `kafka.codec must be gob, json or protobuf, got "xml"; consumers.inserters must be positive`,
+		},
+		"cassandra host missing": {
+			args: []string{"-broker", "memory", "-database-driver", "cassandra"},
+			err:  "database.cassandra_host must be set if driver is cassandra",
+		},
+		"dead letter topic same as topic": {
+			args: []string{"-broker", "memory", "-kafka-dead-letter-topic", "visits"},
+			err:  "kafka.dead_letter_topic must differ from kafka.topic",
+		},
+		"invalid env": {
+			env: map[string]string{"SESSION_GAP": "30"},
+			err: "invalid SESSION_GAP",
+		},
+		"invalid flag": {
+			args: []string{"-inserters", "two"},
+			err:  "invalid -inserters",
+		},
+		"unknown file field": {
+			args: []string{"-config", writeFile(t, "kafka:\n  hosts: kafka:9092\n")},
+			err:  "field hosts not found",
+		},
+		"missing file": {
+			args: []string{"-config", "missing.yaml"},
+			err:  "missing.yaml",
+		},
+	}
+
+	for name, tt := range tests {
+		_, err := load(tt.args, tt.env)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	tests := map[string]struct {
+		kafka Kafka
+		topic string
+	}{
+		"default":          {kafka: Default().Kafka, topic: "visits.dlq"},
+		"derived by topic": {kafka: Kafka{Topic: "staging-visits"}, topic: "staging-visits.dlq"},
+		"configured":       {kafka: Kafka{Topic: "visits", DeadLetterTopic: "failed-visits"}, topic: "failed-visits"},
+	}
+
+	for name, tt := range tests {
+		if got := tt.kafka.DeadLetter(); got != tt.topic {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.topic, got)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	want, err := load([]string{"-broker", "memory", "-trusted-proxies", "10.0.0.0/8", "-http-idle-timeout", "2m", "-visit-headers", "Accept"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := want.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := load([]string{"-config", writeFile(t, b.String())}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected: %+v, got: %+v", want, got)
+	}
+}
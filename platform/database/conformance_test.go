@@ -0,0 +1,735 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// Conformance suite is run against every registered storage driver.
+// Results of each driver are compared with Memory, which is reference implementation
+// of kcp.DbConnector, and with expected results where they are known.
+
+// conformance contains storage of tested driver and reference storage, which receive same calls.
+type conformance struct {
+	driver string
+	db     kcp.DbConnector
+	ref    kcp.DbConnector
+	// closeDb closes db, so that its methods fail.
+	closeDb func() error
+	// keyset reports whether pages of visits are ordered across pages,
+	// cassandra orders visits only within page.
+	keyset bool
+}
+
+var conformanceTests = []struct {
+	name string
+	run  func(t *testing.T, c conformance)
+}{
+	{name: "insert", run: testConformanceInsert},
+	{name: "visit filters", run: testConformanceVisitFilters},
+	{name: "pagination", run: testConformancePagination},
+	{name: "time offset", run: testConformanceTimeOffset},
+	{name: "time zone open upper bound", run: testConformanceZoneOpenBound},
+	{name: "rollups", run: testConformanceRollups},
+	{name: "sessions", run: testConformanceSessions},
+	{name: "errors", run: testConformanceErrors},
+	{name: "concurrency", run: testConformanceConcurrency},
+}
+
+func TestConformance(t *testing.T) {
+	for _, driver := range Drivers() {
+		for _, ct := range conformanceTests {
+			driver, ct := driver, ct
+			t.Run(driver+"/"+ct.name, func(t *testing.T) {
+				ct.run(t, openConformance(t, driver))
+			})
+		}
+	}
+}
+
+// openConformance opens empty storage of driver migrated to latest schema.
+// Cassandra is skipped if CASSANDRA_HOST is not set.
+func openConformance(t *testing.T, driver string) conformance {
+	opts := Options{SQLitePath: filepath.Join(t.TempDir(), "kcp.db")}
+	if driver == "cassandra" {
+		opts.CassandraHost = os.Getenv("CASSANDRA_HOST")
+		opts.CassandraTimeout = 10 * time.Second
+		if opts.CassandraHost == "" {
+			t.Skip("CASSANDRA_HOST is not set")
+		}
+	}
+
+	db, closeDb, err := Connect(driver, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeDb() })
+	schema, err := NewSchema(driver, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reverting all migrations empties storage, which is not removed with test.
+	if _, err := schema.Down(schema.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schema.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	return conformance{driver: driver, db: db, ref: NewMemory(), closeDb: closeDb, keyset: driver != "cassandra"}
+}
+
+// conformanceTime is Monday 10:00 UTC, other visits are relative to it.
+var conformanceTime = time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)
+
+func conformanceEvent(id, ip string, after time.Duration, method, path string) kcp.Event {
+	t := conformanceTime.Add(after)
+	return kcp.Event{ID: id, IP: ip, VisitedAt: t, Day: t.Weekday().String(), Method: method, Path: path}
+}
+
+// conformanceEvents returns visits of several ips, days, hours and requests.
+// Visits 1 and 8 have same time, visit 7 has no id.
+func conformanceEvents() []kcp.Event {
+	day := 24 * time.Hour
+	events := []kcp.Event{
+		conformanceEvent("e1", "1.1.1.1", 0, "GET", "/blog/kafka"),
+		conformanceEvent("e2", "1.1.1.1", 30*time.Minute, "GET", "/blog/kafka/consumers"),
+		conformanceEvent("e3", "1.1.1.2", time.Hour, "POST", "/signup"),
+		conformanceEvent("e4", "10.0.0.1", day, "GET", "/pricing"),
+		conformanceEvent("e5", "10.0.0.2", day+13*time.Hour, "GET", "/docs/api"),
+		conformanceEvent("e6", "2001:db8::1", 2*day, "GET", "/"),
+		conformanceEvent("", "1.1.1.2", 3*day, "GET", "/"),
+		conformanceEvent("e8", "1.1.1.1", 0, "GET", "/blog"),
+	}
+	events[0].UserAgent, events[1].UserAgent = "Mozilla/5.0 Firefox/84.0", "Mozilla/5.0 Firefox/84.0"
+	events[2].UserAgent = "curl/7.68.0"
+	events[0].Referrer, events[3].Referrer = "https://example.com/a", "https://other.org/"
+	events[0].AcceptLanguage = "en-US"
+	events[0].Headers = map[string]string{"Accept": "*/*", "Dnt": "1"}
+	return events
+}
+
+// insertConformanceEvents inserts conformance events into c.db and c.ref
+// one by one and in batch, with duplicates of events with ids.
+func insertConformanceEvents(t *testing.T, c conformance) []kcp.Event {
+	events := conformanceEvents()
+	for _, db := range []kcp.DbConnector{c.db, c.ref} {
+		if err := db.InsertEvents(events[:4]); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events[4:] {
+			if err := db.InsertEvent(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.InsertEvents([]kcp.Event{events[0], events[3]}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.InsertEvent(events[7]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return events
+}
+
+func testConformanceInsert(t *testing.T, c conformance) {
+	events := insertConformanceEvents(t, c)
+
+	got, err := c.db.GetEvents(kcp.VisitQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].VisitedAt.Before(got[i-1].VisitedAt) {
+			t.Errorf("expected events ordered by visited_at, got: %v before %v", got[i-1].VisitedAt, got[i].VisitedAt)
+		}
+	}
+	if want := sortEvents(events); !reflect.DeepEqual(sortEvents(got), want) {
+		t.Errorf("expected: %+v, got: %+v", want, sortEvents(got))
+	}
+
+	empty, err := c.db.GetEvents(kcp.VisitQuery{IPs: []string{"9.9.9.9"}})
+	if err != nil || len(empty) != 0 {
+		t.Errorf("expected: no events, got: %v, %v", empty, err)
+	}
+	if err := c.db.InsertEvents(nil); err != nil {
+		t.Errorf("expected: %v, got: %v", nil, err)
+	}
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// vilnius is time zone with daylight saving time, 2 hours ahead of UTC in winter.
+var vilnius = mustLocation("Europe/Vilnius")
+
+func mustLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// parsedQuery returns query parsed from url values as by http api.
+func parsedQuery(values url.Values) kcp.VisitQuery {
+	q, err := kcp.ParseVisitQuery(values)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+func testConformanceVisitFilters(t *testing.T, c conformance) {
+	insertConformanceEvents(t, c)
+	at := func(d time.Duration, inclusive bool) kcp.TimeBound {
+		return kcp.TimeBound{Time: conformanceTime.Add(d), Inclusive: inclusive}
+	}
+
+	tests := []struct {
+		name   string
+		query  kcp.VisitQuery
+		visits int
+	}{
+		{name: "all", query: kcp.VisitQuery{}, visits: 8},
+		{name: "ip", query: kcp.VisitQuery{IPs: []string{"1.1.1.1"}}, visits: 3},
+		{name: "ips", query: kcp.VisitQuery{IPs: []string{"1.1.1.2", "10.0.0.1"}}, visits: 3},
+		{name: "unknown ip", query: kcp.VisitQuery{IPs: []string{"9.9.9.9"}}, visits: 0},
+		{name: "network", query: kcp.VisitQuery{Networks: []*net.IPNet{mustCIDR("10.0.0.0/8")}}, visits: 2},
+		{name: "ipv6 network", query: kcp.VisitQuery{Networks: []*net.IPNet{mustCIDR("2001:db8::/32")}}, visits: 1},
+		{name: "ip or network", query: kcp.VisitQuery{IPs: []string{"1.1.1.2"}, Networks: []*net.IPNet{mustCIDR("10.0.0.0/8")}}, visits: 4},
+		{name: "gt excludes bound", query: kcp.VisitQuery{From: at(0, false)}, visits: 6},
+		{name: "gte includes bound", query: kcp.VisitQuery{From: at(0, true)}, visits: 8},
+		{name: "lt excludes bound", query: kcp.VisitQuery{To: at(time.Hour, false)}, visits: 3},
+		{name: "lte includes bound", query: kcp.VisitQuery{To: at(time.Hour, true)}, visits: 4},
+		{name: "time range", query: kcp.VisitQuery{From: at(30*time.Minute, true), To: at(24*time.Hour, false)}, visits: 2},
+		{name: "empty time range", query: kcp.VisitQuery{From: at(time.Hour, false), To: at(time.Hour, false)}, visits: 0},
+		{name: "date bound in time zone", query: parsedQuery(url.Values{"tz": {"Europe/Vilnius"}, "gte": {"2021-01-06"}}), visits: 3},
+		{name: "date range in time zone", query: parsedQuery(url.Values{"tz": {"Europe/Vilnius"}, "gte": {"2021-01-05"}, "lt": {"2021-01-06"}}), visits: 1},
+		{name: "lower bound with offset", query: parsedQuery(url.Values{"gte": {"2021-01-06T00:00:00+02:00"}}), visits: 3},
+		{name: "upper bound with offset", query: parsedQuery(url.Values{"lte": {"2021-01-04T12:30:00+02:00"}}), visits: 3},
+		{name: "weekday", query: kcp.VisitQuery{Weekdays: []time.Weekday{time.Monday}}, visits: 4},
+		{name: "weekdays", query: kcp.VisitQuery{Weekdays: []time.Weekday{time.Tuesday, time.Wednesday}}, visits: 3},
+		{name: "weekday in time zone", query: kcp.VisitQuery{Weekdays: []time.Weekday{time.Wednesday}, Location: vilnius}, visits: 2},
+		{name: "weekday without visits", query: kcp.VisitQuery{Weekdays: []time.Weekday{time.Sunday}}, visits: 0},
+		{name: "hour", query: kcp.VisitQuery{Hours: &kcp.HourRange{From: 10, To: 10}}, visits: 6},
+		{name: "hours over midnight", query: kcp.VisitQuery{Hours: &kcp.HourRange{From: 22, To: 1}}, visits: 1},
+		{name: "hour in time zone", query: kcp.VisitQuery{Hours: &kcp.HourRange{From: 1, To: 1}, Location: vilnius}, visits: 1},
+		{name: "path", query: kcp.VisitQuery{Paths: []string{"/"}}, visits: 2},
+		{name: "path prefix", query: kcp.VisitQuery{Paths: []string{"/blog/kafka*"}}, visits: 2},
+		{name: "method", query: kcp.VisitQuery{Methods: []string{"POST"}}, visits: 1},
+		{name: "referrer prefix", query: kcp.VisitQuery{Referrers: []string{"https://example.com/*"}}, visits: 1},
+		{name: "user agent", query: kcp.VisitQuery{UserAgent: "FIREFOX"}, visits: 2},
+		{name: "combined", query: kcp.VisitQuery{IPs: []string{"1.1.1.1"}, Paths: []string{"/blog/*"}, From: at(time.Minute, true)}, visits: 1},
+	}
+
+	for _, tt := range tests {
+		events, err := c.db.GetEvents(tt.query)
+		if err != nil {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, nil, err)
+			continue
+		}
+		if len(events) != tt.visits {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.visits, len(events))
+		}
+		want, _ := c.ref.GetEvents(tt.query)
+		if !reflect.DeepEqual(sortEvents(events), sortEvents(want)) {
+			t.Errorf("%s: expected: %+v, got: %+v", tt.name, sortEvents(want), sortEvents(events))
+		}
+
+		for _, order := range []kcp.Order{kcp.OrderAsc, kcp.OrderDesc} {
+			q := tt.query
+			q.Order = order
+			page, err := c.db.GetVisits(q)
+			if err != nil {
+				t.Errorf("%s %s: expected: %v, got: %v", tt.name, order, nil, err)
+				continue
+			}
+			wantPage, _ := c.ref.GetVisits(q)
+			if !visitsEqual(page.Visits, wantPage.Visits) || page.NextCursor != "" {
+				t.Errorf("%s %s: expected: %v, got: %v", tt.name, order, wantPage, page)
+			}
+		}
+	}
+}
+
+func testConformancePagination(t *testing.T, c conformance) {
+	insertConformanceEvents(t, c)
+
+	for _, order := range []kcp.Order{kcp.OrderAsc, kcp.OrderDesc} {
+		q := kcp.VisitQuery{Limit: 3, Order: order}
+		var times []time.Time
+		seen := make(kcp.VisitsByIP)
+		for pages := 0; ; pages++ {
+			if pages > 8 {
+				t.Fatalf("%s: expected pagination to end", order)
+			}
+			page, err := c.db.GetVisits(q)
+			if err != nil {
+				t.Fatalf("%s: expected: %v, got: %v", order, nil, err)
+			}
+			n := 0
+			for ip, ts := range page.Visits {
+				n += len(ts)
+				seen[ip] = append(seen[ip], ts...)
+			}
+			if n > q.Limit {
+				t.Errorf("%s: expected at most %v visits, got: %v", order, q.Limit, n)
+			}
+			times = append(times, pageTimes(page.Visits, order)...)
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+
+		all, _ := c.ref.GetVisits(kcp.VisitQuery{Order: order})
+		if !visitsEqual(sortVisits(seen), sortVisits(all.Visits)) {
+			t.Errorf("%s: expected: %v, got: %v", order, all.Visits, seen)
+		}
+		if !c.keyset {
+			continue
+		}
+		for i := 1; i < len(times); i++ {
+			if order == kcp.OrderAsc && times[i].Before(times[i-1]) || order == kcp.OrderDesc && times[i].After(times[i-1]) {
+				t.Errorf("%s: expected visits ordered across pages, got: %v", order, times)
+				break
+			}
+		}
+	}
+}
+
+// testConformanceTimeOffset checks that visits with times in other offset than UTC
+// are compared with bounds and cursors by instant of visit.
+func testConformanceTimeOffset(t *testing.T, c conformance) {
+	plus2 := time.FixedZone("+02:00", 2*60*60)
+	events := []kcp.Event{
+		conformanceEvent("e1", "1.1.1.1", 0, "GET", "/"),
+		// Visit at 11:00Z is stored as 13:00+02:00.
+		conformanceEvent("e2", "1.1.1.2", time.Hour, "GET", "/pricing"),
+	}
+	events[1].VisitedAt = events[1].VisitedAt.In(plus2)
+	for _, db := range []kcp.DbConnector{c.db, c.ref} {
+		if err := db.InsertEvent(events[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.InsertEvents(events[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := c.db.GetEvents(kcp.VisitQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := c.ref.GetEvents(kcp.VisitQuery{}); !reflect.DeepEqual(sortEvents(got), sortEvents(want)) {
+		t.Errorf("expected: %+v, got: %+v", want, got)
+	}
+
+	at := func(d time.Duration) kcp.TimeBound {
+		return kcp.TimeBound{Time: conformanceTime.Add(d), Inclusive: true}
+	}
+	tests := []struct {
+		name   string
+		query  kcp.VisitQuery
+		visits int
+	}{
+		{name: "lower bound before visit", query: kcp.VisitQuery{From: at(30 * time.Minute)}, visits: 1},
+		{name: "lower bound after visit", query: kcp.VisitQuery{From: at(90 * time.Minute)}, visits: 0},
+		{name: "upper bound before visit", query: kcp.VisitQuery{To: at(30 * time.Minute)}, visits: 1},
+		{name: "upper bound after visit", query: kcp.VisitQuery{To: at(90 * time.Minute)}, visits: 2},
+	}
+	for _, tt := range tests {
+		events, err := c.db.GetEvents(tt.query)
+		if err != nil {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, nil, err)
+			continue
+		}
+		if len(events) != tt.visits {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.visits, len(events))
+		}
+		page, err := c.db.GetVisits(tt.query)
+		if n := len(pageTimes(page.Visits, kcp.OrderAsc)); err != nil || n != tt.visits {
+			t.Errorf("%s: expected: %v, got: %v, %v", tt.name, tt.visits, n, err)
+		}
+	}
+
+	if !c.keyset {
+		return
+	}
+	for _, order := range []kcp.Order{kcp.OrderAsc, kcp.OrderDesc} {
+		var times []time.Time
+		q := kcp.VisitQuery{Limit: 1, Order: order}
+		for i := 0; i < 3; i++ {
+			page, err := c.db.GetVisits(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			times = append(times, pageTimes(page.Visits, order)...)
+			if q.Cursor = page.NextCursor; q.Cursor == "" {
+				break
+			}
+		}
+		want := []time.Time{conformanceTime, conformanceTime.Add(time.Hour)}
+		if order == kcp.OrderDesc {
+			want[0], want[1] = want[1], want[0]
+		}
+		if len(times) != 2 || !times[0].Equal(want[0]) || !times[1].Equal(want[1]) {
+			t.Errorf("%s: expected: %v, got: %v", order, want, times)
+		}
+	}
+}
+
+func testConformanceZoneOpenBound(t *testing.T, c conformance) {
+	summer := func(month time.Month) time.Duration {
+		return time.Date(2021, month, 1, 9, 0, 0, 0, time.UTC).Sub(conformanceTime)
+	}
+	// Visits are at 12:00 in Vilnius, 2 hours ahead of UTC in winter and 3 hours in summer.
+	events := []kcp.Event{
+		conformanceEvent("e1", "1.1.1.1", 0, "GET", "/"),
+		conformanceEvent("e2", "1.1.1.2", summer(time.June), "GET", "/"),
+		conformanceEvent("e3", "1.1.1.3", summer(time.July), "GET", "/"),
+	}
+	noon := &kcp.HourRange{From: 12, To: 12}
+	queries := map[string]kcp.VisitQuery{
+		"lower bound": {Hours: noon, Location: vilnius, From: kcp.TimeBound{Time: conformanceTime, Inclusive: true}},
+		"no bounds":   {Hours: noon, Location: vilnius},
+	}
+
+	// Visit stored after first queries is matched by next ones.
+	for i, e := range events {
+		if err := c.db.InsertEvent(e); err != nil {
+			t.Fatal(err)
+		}
+		for name, q := range queries {
+			got, err := c.db.GetEvents(q)
+			if err != nil || len(got) != i+1 {
+				t.Errorf("%s: expected: %v, got: %v, %v", name, i+1, len(got), err)
+			}
+			page, err := c.db.GetVisits(q)
+			if n := len(pageTimes(page.Visits, kcp.OrderAsc)); err != nil || n != i+1 {
+				t.Errorf("%s: expected: %v, got: %v, %v", name, i+1, n, err)
+			}
+		}
+	}
+}
+
+func testConformanceRollups(t *testing.T, c conformance) {
+	events := conformanceEvents()
+	for _, db := range []kcp.DbConnector{c.db, c.ref} {
+		for i, e := range events {
+			if err := db.UpdateRollups(e, kcp.StreamPosition{Topic: "visits", Partition: int32(i % 2), Offset: int64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Redelivered and older events are already applied.
+		for i, e := range events[:4] {
+			if err := db.UpdateRollups(e, kcp.StreamPosition{Topic: "visits", Partition: int32(i % 2), Offset: int64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Same offset of other topic is applied.
+		if err := db.UpdateRollups(events[0], kcp.StreamPosition{Topic: "replay", Offset: 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		query  kcp.StatsQuery
+		visits int64
+	}{
+		{name: "day", query: kcp.StatsQuery{GroupBy: kcp.GroupByDay}, visits: 9},
+		{name: "hour", query: kcp.StatsQuery{GroupBy: kcp.GroupByHour}, visits: 9},
+		{name: "weekday", query: kcp.StatsQuery{GroupBy: kcp.GroupByWeekday}, visits: 9},
+		{name: "ip", query: kcp.StatsQuery{GroupBy: kcp.GroupByIP}, visits: 9},
+		{name: "ip filter", query: kcp.StatsQuery{GroupBy: kcp.GroupByIP, VisitQuery: kcp.VisitQuery{IPs: []string{"1.1.1.1"}}}, visits: 4},
+		{name: "from bound", query: kcp.StatsQuery{GroupBy: kcp.GroupByDay, VisitQuery: kcp.VisitQuery{
+			From: kcp.TimeBound{Time: conformanceTime.Add(24 * time.Hour), Inclusive: true}}}, visits: 4},
+		{name: "weekday filter", query: kcp.StatsQuery{GroupBy: kcp.GroupByDay, VisitQuery: kcp.VisitQuery{Weekdays: []time.Weekday{time.Tuesday}}}, visits: 2},
+		{name: "hour in time zone", query: kcp.StatsQuery{GroupBy: kcp.GroupByHour, VisitQuery: kcp.VisitQuery{Location: vilnius}}, visits: 9},
+		{name: "date bound in time zone", query: kcp.StatsQuery{GroupBy: kcp.GroupByDay, VisitQuery: parsedQuery(url.Values{
+			"tz": {"Europe/Vilnius"}, "gte": {"2021-01-06"}})}, visits: 3},
+		{name: "weekday filter in time zone", query: kcp.StatsQuery{GroupBy: kcp.GroupByDay, VisitQuery: kcp.VisitQuery{
+			Weekdays: []time.Weekday{time.Wednesday}, Location: vilnius}}, visits: 2},
+		{name: "no visits", query: kcp.StatsQuery{GroupBy: kcp.GroupByDay, VisitQuery: kcp.VisitQuery{IPs: []string{"9.9.9.9"}}}, visits: 0},
+	}
+
+	for _, tt := range tests {
+		stats, err := c.db.GetVisitStats(tt.query)
+		if err != nil {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, nil, err)
+			continue
+		}
+		var visits int64
+		for _, s := range stats {
+			visits += s.Visits
+		}
+		if visits != tt.visits {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.visits, visits)
+		}
+		want, _ := c.ref.GetVisitStats(tt.query)
+		if !reflect.DeepEqual(utcStats(stats), utcStats(want)) {
+			t.Errorf("%s: expected: %+v, got: %+v", tt.name, want, stats)
+		}
+	}
+}
+
+func testConformanceSessions(t *testing.T, c conformance) {
+	firefox := "Mozilla/5.0 Firefox/84.0"
+	sessions := []kcp.Session{
+		{IP: "1.1.1.1", UserAgent: firefox, Start: conformanceTime, End: conformanceTime.Add(10 * time.Minute), Visits: 2, LastID: "e2"},
+		{IP: "1.1.1.1", UserAgent: firefox, Start: conformanceTime.Add(2 * time.Hour), End: conformanceTime.Add(2 * time.Hour), Visits: 1, LastID: "e4"},
+		{IP: "1.1.1.1", UserAgent: "curl/7.68.0", Start: conformanceTime.Add(time.Hour), End: conformanceTime.Add(time.Hour), Visits: 1},
+		{IP: "10.0.0.1", UserAgent: firefox, Start: conformanceTime.Add(24 * time.Hour), End: conformanceTime.Add(25 * time.Hour), Visits: 7},
+	}
+	updated := sessions[0]
+	updated.End, updated.Visits, updated.LastID = conformanceTime.Add(20*time.Minute), 3, "e3"
+
+	for _, db := range []kcp.DbConnector{c.db, c.ref} {
+		for _, s := range append(sessions, updated) {
+			if err := db.SaveSession(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	lastTests := []struct {
+		name      string
+		ip        string
+		userAgent string
+		want      kcp.Session
+	}{
+		{name: "latest of visitor", ip: "1.1.1.1", userAgent: firefox, want: sessions[1]},
+		{name: "other user agent", ip: "1.1.1.1", userAgent: "curl/7.68.0", want: sessions[2]},
+		{name: "unknown visitor", ip: "9.9.9.9", userAgent: firefox, want: kcp.Session{}},
+	}
+	for _, tt := range lastTests {
+		got, err := c.db.LastSession(tt.ip, tt.userAgent)
+		if err != nil {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, nil, err)
+			continue
+		}
+		if !reflect.DeepEqual(utcSession(got), tt.want) {
+			t.Errorf("%s: expected: %+v, got: %+v", tt.name, tt.want, got)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    kcp.SessionQuery
+		sessions int
+	}{
+		{name: "all", query: kcp.SessionQuery{}, sessions: 4},
+		{name: "ip", query: kcp.SessionQuery{VisitQuery: kcp.VisitQuery{IPs: []string{"1.1.1.1"}}}, sessions: 3},
+		{name: "start bound", query: kcp.SessionQuery{VisitQuery: kcp.VisitQuery{From: kcp.TimeBound{Time: conformanceTime.Add(time.Hour)}}}, sessions: 2},
+		{name: "start bound with offset", query: kcp.SessionQuery{VisitQuery: parsedQuery(url.Values{"gte": {"2021-01-04T13:00:00+02:00"}})}, sessions: 3},
+		{name: "start date in time zone", query: kcp.SessionQuery{VisitQuery: parsedQuery(url.Values{"tz": {"Europe/Vilnius"}, "gte": {"2021-01-05"}})}, sessions: 1},
+		{name: "user agent", query: kcp.SessionQuery{VisitQuery: kcp.VisitQuery{UserAgent: "curl"}}, sessions: 1},
+		{name: "no sessions", query: kcp.SessionQuery{VisitQuery: kcp.VisitQuery{IPs: []string{"9.9.9.9"}}}, sessions: 0},
+	}
+	for _, tt := range tests {
+		got, err := c.db.GetSessions(tt.query)
+		if err != nil {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, nil, err)
+			continue
+		}
+		if len(got) != tt.sessions {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.sessions, len(got))
+		}
+		want, _ := c.ref.GetSessions(tt.query)
+		for i := range got {
+			got[i] = utcSession(got[i])
+		}
+		if len(got) != 0 && !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected: %+v, got: %+v", tt.name, want, got)
+		}
+	}
+}
+
+func testConformanceErrors(t *testing.T, c conformance) {
+	var filterErr *kcp.FilterError
+	if _, err := c.db.GetVisits(kcp.VisitQuery{Limit: 1, Cursor: "not a cursor!"}); !errors.As(err, &filterErr) {
+		t.Errorf("invalid cursor: expected: %T, got: %v", filterErr, err)
+	}
+
+	if c.driver == "memory" {
+		// Memory storage can not fail.
+		return
+	}
+	if err := c.closeDb(); err != nil {
+		t.Fatal(err)
+	}
+	e := conformanceEvents()[0]
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{name: "InsertEvent", call: func() error { return c.db.InsertEvent(e) }},
+		{name: "InsertEvents", call: func() error { return c.db.InsertEvents([]kcp.Event{e}) }},
+		{name: "GetVisits", call: func() error { _, err := c.db.GetVisits(kcp.VisitQuery{}); return err }},
+		{name: "GetEvents", call: func() error { _, err := c.db.GetEvents(kcp.VisitQuery{}); return err }},
+		{name: "UpdateRollups", call: func() error { return c.db.UpdateRollups(e, kcp.StreamPosition{Topic: "visits"}) }},
+		{name: "GetVisitStats", call: func() error { _, err := c.db.GetVisitStats(kcp.StatsQuery{GroupBy: kcp.GroupByDay}); return err }},
+		{name: "GetSessions", call: func() error { _, err := c.db.GetSessions(kcp.SessionQuery{}); return err }},
+		{name: "LastSession", call: func() error { _, err := c.db.LastSession(e.IP, e.UserAgent); return err }},
+		{name: "SaveSession", call: func() error { return c.db.SaveSession(kcp.Session{IP: e.IP, Start: e.VisitedAt, End: e.VisitedAt}) }},
+	}
+	for _, tt := range calls {
+		if err := tt.call(); err == nil {
+			t.Errorf("%s of closed storage: expected error, got: %v", tt.name, err)
+		}
+	}
+}
+
+func testConformanceConcurrency(t *testing.T, c conformance) {
+	const workers, events = 8, 25
+	for _, db := range []kcp.DbConnector{c.db, c.ref} {
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				ip := fmt.Sprintf("10.0.1.%v", w)
+				for i := 0; i < events; i++ {
+					e := conformanceEvent(fmt.Sprintf("w%v-%v", w, i), ip, time.Duration(i)*time.Minute, "GET", "/")
+					pos := kcp.StreamPosition{Topic: "visits", Partition: int32(w), Offset: int64(i)}
+					s := kcp.Session{IP: ip, Start: conformanceTime, End: e.VisitedAt, Visits: int64(i + 1)}
+					if err := db.InsertEvent(e); err != nil {
+						errs <- err
+						return
+					}
+					if err := db.UpdateRollups(e, pos); err != nil {
+						errs <- err
+						return
+					}
+					if err := db.SaveSession(s); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("expected: %v, got: %v", nil, err)
+		}
+	}
+
+	got, err := c.db.GetEvents(kcp.VisitQuery{})
+	if err != nil || len(got) != workers*events {
+		t.Errorf("events: expected: %v, got: %v, %v", workers*events, len(got), err)
+	}
+	stats, err := c.db.GetVisitStats(kcp.StatsQuery{GroupBy: kcp.GroupByIP})
+	want, _ := c.ref.GetVisitStats(kcp.StatsQuery{GroupBy: kcp.GroupByIP})
+	if err != nil || !reflect.DeepEqual(utcStats(stats), utcStats(want)) {
+		t.Errorf("stats: expected: %+v, got: %+v, %v", want, stats, err)
+	}
+	sessions, err := c.db.GetSessions(kcp.SessionQuery{})
+	if err != nil || len(sessions) != workers {
+		t.Errorf("sessions: expected: %v, got: %v, %v", workers, len(sessions), err)
+	}
+	for _, s := range sessions {
+		if s.Visits != events {
+			t.Errorf("sessions: expected: %v, got: %v", events, s.Visits)
+		}
+	}
+}
+
+// sortEvents returns copy of events in UTC ordered by visited_at and id,
+// so that events with same time are compared regardless of their order.
+// Empty headers are same as no headers.
+func sortEvents(events []kcp.Event) []kcp.Event {
+	sorted := make([]kcp.Event, 0, len(events))
+	for _, e := range events {
+		e.VisitedAt = e.VisitedAt.UTC()
+		if len(e.Headers) == 0 {
+			e.Headers = nil
+		}
+		sorted = append(sorted, e)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].VisitedAt.Equal(sorted[j].VisitedAt) {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return sorted[i].VisitedAt.Before(sorted[j].VisitedAt)
+	})
+	return sorted
+}
+
+// visitsEqual reports whether visits contain same times of same ips.
+func visitsEqual(a, b kcp.VisitsByIP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ip, ts := range a {
+		if len(ts) != len(b[ip]) {
+			return false
+		}
+		for i, t := range ts {
+			if !t.Equal(b[ip][i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sortVisits returns visits with times of each ip in ascending order.
+func sortVisits(visits kcp.VisitsByIP) kcp.VisitsByIP {
+	sorted := make(kcp.VisitsByIP)
+	for ip, ts := range visits {
+		ts = append([]time.Time(nil), ts...)
+		sort.Slice(ts, func(i, j int) bool { return ts[i].Before(ts[j]) })
+		sorted[ip] = ts
+	}
+	return sorted
+}
+
+// pageTimes returns times of page visits in order of page.
+func pageTimes(visits kcp.VisitsByIP, order kcp.Order) []time.Time {
+	var times []time.Time
+	for _, ts := range visits {
+		times = append(times, ts...)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		if order == kcp.OrderDesc {
+			return times[i].After(times[j])
+		}
+		return times[i].Before(times[j])
+	})
+	return times
+}
+
+func utcStats(stats []kcp.VisitStats) []kcp.VisitStats {
+	utc := make([]kcp.VisitStats, 0, len(stats))
+	for _, s := range stats {
+		s.FirstSeen, s.LastSeen = s.FirstSeen.UTC(), s.LastSeen.UTC()
+		utc = append(utc, s)
+	}
+	return utc
+}
+
+func utcSession(s kcp.Session) kcp.Session {
+	if !s.Start.IsZero() {
+		s.Start, s.End = s.Start.UTC(), s.End.UTC()
+	}
+	return s
+}
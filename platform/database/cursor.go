@@ -0,0 +1,66 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// keysetCursor is position of last visit in page used for keyset pagination.
+type keysetCursor struct {
+	VisitedAt time.Time `json:"t"`
+	RowID     int64     `json:"id"`
+}
+
+// encodeCursor encodes keysetCursor into opaque string.
+func encodeCursor(c keysetCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor decodes cursor returned by encodeCursor.
+func decodeCursor(cursor string) (keysetCursor, error) {
+	var c keysetCursor
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return keysetCursor{}, invalidCursor(cursor)
+	}
+	return c, nil
+}
+
+// keysetCondition returns condition selecting visits after cursor in query order.
+func keysetCondition(q kcp.VisitQuery) (condition, error) {
+	c, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return condition{}, err
+	}
+	op := ">"
+	if q.Desc() {
+		op = "<"
+	}
+	return condition{
+		expr: "(visited_at " + op + " ? OR (visited_at = ? AND rowid " + op + " ?))",
+		args: []interface{}{c.VisitedAt, c.VisitedAt, c.RowID},
+	}, nil
+}
+
+// pageState returns cassandra paging state from cursor.
+func pageState(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalidCursor(cursor)
+	}
+	return b, nil
+}
+
+func invalidCursor(cursor string) error {
+	return &kcp.FilterError{Param: kcp.ParamCursor, Value: cursor, Reason: "invalid cursor"}
+}
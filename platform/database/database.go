@@ -1,8 +1,10 @@
 package database
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"os"
+	"sort"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -15,133 +17,487 @@ type Db struct {
 	*gocql.Session
 }
 
-// InsertEvent inserts kcp.Event into cassandra db
-func (db *Db) InsertEvent(e kcp.Event) error {
-	return db.Query(
-		"INSERT INTO kcp.visits (ip, visited_at, day) VALUES (?, ?, ?)",
+// cqlInsertVisit inserts visit, params are returned by cqlVisitArgs.
+const cqlInsertVisit = `
+	INSERT INTO kcp.visits (ip, visited_at, id, day, path, method, user_agent, referrer, accept_language, headers)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func cqlVisitArgs(e kcp.Event) []interface{} {
+	return []interface{}{
 		e.IP,
 		e.VisitedAt,
-		e.Day).Exec()
+		e.ID,
+		e.Day,
+		e.Path,
+		e.Method,
+		e.UserAgent,
+		e.Referrer,
+		e.AcceptLanguage,
+		e.Headers,
+	}
 }
 
-// GetVisits get visits grouped by ip
-func (db *Db) GetVisits() (kcp.VisitsByIP, error) {
-	iter := db.Query("SELECT ip, visited_at FROM kcp.visits").Iter()
+// InsertEvent inserts kcp.Event into cassandra db.
+// Event id is part of primary key, so inserting same event again overwrites it.
+func (db *Db) InsertEvent(e kcp.Event) error {
+	return db.Query(cqlInsertVisit, cqlVisitArgs(e)...).Exec()
+}
 
-	var ip string
-	var t time.Time
-	visits := make(kcp.VisitsByIP)
-	for iter.Scan(&ip, &t) {
-		visits[ip] = append(visits[ip], t)
+// InsertEvents inserts kcp.Events into cassandra db using unlogged batch per ip,
+// which is partition key of visits, so each batch is applied to single partition.
+// Batches are not atomic with each other, but inserting same events again
+// overwrites them, so failed batch can be retried as a whole.
+func (db *Db) InsertEvents(events []kcp.Event) error {
+	batches := make(map[string]*gocql.Batch)
+	var ips []string
+	for _, e := range events {
+		b, ok := batches[e.IP]
+		if !ok {
+			b = db.NewBatch(gocql.UnloggedBatch)
+			batches[e.IP] = b
+			ips = append(ips, e.IP)
+		}
+		b.Query(cqlInsertVisit, cqlVisitArgs(e)...)
+	}
+
+	for _, ip := range ips {
+		if err := db.ExecuteBatch(batches[ip]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateRollups applies event at stream position to hourly rollups,
+// if it is after last applied position of its partition.
+// Counter can not be part of lightweight transaction, so offset is moved after
+// rollups are updated, see counterRollup.
+func (db *Db) UpdateRollups(e kcp.Event, pos kcp.StreamPosition) error {
+	return counterRollup{
+		lastOffset: db.lastRollupOffset,
+		update:     db.updateRollups,
+		moveOffset: db.moveRollupOffset,
+	}.apply(e, pos)
+}
+
+// lastRollupOffset returns last applied offset of partition or -1 if none was applied.
+func (db *Db) lastRollupOffset(pos kcp.StreamPosition) (int64, error) {
+	var offset int64
+	err := db.Query(
+		"SELECT last_offset FROM kcp.rollup_offsets WHERE topic = ? AND topic_partition = ?",
+		pos.Topic, pos.Partition,
+	).Scan(&offset)
+	if err == gocql.ErrNotFound {
+		return -1, nil
+	}
+	return offset, err
+}
+
+// moveRollupOffset sets last applied offset of partition using lightweight transaction,
+// so offset is never moved back.
+func (db *Db) moveRollupOffset(pos kcp.StreamPosition) error {
+	if _, err := db.Query(`
+	INSERT INTO kcp.rollup_offsets (topic, topic_partition, last_offset)
+	VALUES (?, ?, -1) IF NOT EXISTS`,
+		pos.Topic, pos.Partition,
+	).MapScanCAS(map[string]interface{}{}); err != nil {
+		return err
 	}
+	_, err := db.Query(`
+	UPDATE kcp.rollup_offsets SET last_offset = ?
+	WHERE topic = ? AND topic_partition = ?
+	IF last_offset < ?`,
+		pos.Offset, pos.Topic, pos.Partition, pos.Offset,
+	).MapScanCAS(map[string]interface{}{})
+	return err
+}
+
+// updateRollups updates first and last seen time of event ip and increments its hourly visits counter.
+// Seen times are written using timestamp of visit (negated for first_seen),
+// so that cassandra keeps earliest first_seen and latest last_seen regardless of insert order,
+// and can be written again. Counter is incremented last, as it can not.
+func (db *Db) updateRollups(e kcp.Event) error {
+	t := e.VisitedAt.UTC()
+	day := t.Truncate(time.Hour * 24)
+	micros := t.UnixNano() / int64(time.Microsecond)
+
+	if err := db.Query(
+		"UPDATE kcp.visits_hourly_seen USING TIMESTAMP ? SET last_seen = ? WHERE day = ? AND hour = ? AND ip = ?",
+		micros, t, day, t.Hour(), e.IP).Exec(); err != nil {
+		return err
+	}
+	if err := db.Query(
+		"UPDATE kcp.visits_hourly_seen USING TIMESTAMP ? SET first_seen = ? WHERE day = ? AND hour = ? AND ip = ?",
+		-micros, t, day, t.Hour(), e.IP).Exec(); err != nil {
+		return err
+	}
+	return db.Query(
+		"UPDATE kcp.visits_hourly SET visits = visits + 1 WHERE day = ? AND hour = ? AND ip = ?",
+		day, t.Hour(), e.IP).Exec()
+}
+
+// GetVisits get page of visits matching query grouped by ip.
+// Filter by ip uses partition key, visited_at cluster key and single day secondary index.
+// Remaining filters, including networks and request filters, order and limit are applied
+// after reading rows, unless query is for single ip without networks, day and hour filters.
+//
+// If query has limit, single page of that size is read from cassandra and
+// its paging state is returned as cursor. Order applies only within ip then,
+// and page may contain less visits than limit if filters are applied after reading.
+func (db *Db) GetVisits(q kcp.VisitQuery) (kcp.VisitsPage, error) {
+	state, err := pageState(q.Cursor)
+	if err != nil {
+		return kcp.VisitsPage{}, err
+	}
+
+	stmt := "SELECT ip, visited_at, path, method, user_agent, referrer FROM kcp.visits"
+	where, params := joinConditions(cqlConditions(q))
+	if where != "" {
+		stmt = fmt.Sprintf("%v WHERE %v", stmt, where)
+	}
+	if len(q.IPs) == 1 && q.Networks == nil && q.Weekdays == nil && q.Hours == nil {
+		stmt = fmt.Sprintf("%v ORDER BY %v", stmt, sqlOrder(q))
+	}
+	if where != "" {
+		// Filtering without partition key or by secondary index requires ALLOW FILTERING.
+		stmt = fmt.Sprintf("%v ALLOW FILTERING", stmt)
+	}
+	query := db.Query(stmt, params...)
+	if q.Limit > 0 {
+		// Setting page state disables automatic paging, so only single page is read.
+		query = query.PageSize(q.Limit).PageState(state)
+	}
+	iter := query.Iter()
+
+	var e kcp.Event
+	var visits []visit
+	for iter.Scan(&e.IP, &e.VisitedAt, &e.Path, &e.Method, &e.UserAgent, &e.Referrer) {
+		if q.Match(e) {
+			visits = append(visits, visit{ip: e.IP, t: e.VisitedAt})
+		}
+	}
+	next := iter.PageState()
 	if err := iter.Close(); err != nil {
 		fmt.Println(err)
-		return nil, err
+		return kcp.VisitsPage{}, storageError(err)
+	}
+
+	page := kcp.VisitsPage{Visits: groupVisits(visits, q)}
+	if q.Limit > 0 && len(next) > 0 {
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(next)
 	}
-	return visits, nil
+	return page, nil
 }
 
-// GetVisitsByIP get filtered visits by ip.
-func (db *Db) GetVisitsByIP(ip, day string, gt, lt time.Time) (kcp.VisitsByIP, error) {
-	var params []interface{}
-	q := fmt.Sprint(`
-	SELECT visited_at 
-	FROM kcp.visits 
-	WHERE ip=?
-	`)
-	params = append(params, ip)
+// cqlConditions returns CQL conditions for query filters supported by cassandra.
+func cqlConditions(q kcp.VisitQuery) []condition {
+	var conds []condition
+	switch {
+	case q.Networks != nil:
+		// Ips in networks are matched after reading rows together with listed ips.
+	case len(q.IPs) == 0:
+	case len(q.IPs) == 1:
+		conds = append(conds, condition{expr: "ip = ?", args: []interface{}{q.IPs[0]}})
+	default:
+		conds = append(conds, condition{expr: "ip IN ?", args: []interface{}{q.IPs}})
+	}
+
+	conds = append(conds, timeConditions(q)...)
 
-	if !gt.IsZero() {
-		q = fmt.Sprintf("%v AND visited_at > ?", q)
-		params = append(params, gt)
+	// Secondary index supports only equality, stored day is in UTC.
+	if len(q.Weekdays) == 1 && q.IsUTC() {
+		conds = append(conds, condition{expr: "day = ?", args: []interface{}{q.Days()[0]}})
 	}
+	return conds
+}
 
-	if !lt.IsZero() {
-		q = fmt.Sprintf("%v AND visited_at < ?", q)
-		params = append(params, lt)
+// GetEvents get visit events matching query ordered by visited_at.
+// Filters not supported by cassandra are applied after reading rows.
+func (db *Db) GetEvents(q kcp.VisitQuery) ([]kcp.Event, error) {
+	stmt := `SELECT id, ip, visited_at, day, path, method, user_agent, referrer, accept_language, headers
+	FROM kcp.visits`
+	where, params := joinConditions(cqlConditions(q))
+	if where != "" {
+		stmt = fmt.Sprintf("%v WHERE %v ALLOW FILTERING", stmt, where)
 	}
+	iter := db.Query(stmt, params...).Iter()
 
-	if day != "" {
-		q = fmt.Sprintf("%v AND day = ?", q)
-		params = append(params, day)
+	var events []kcp.Event
+	for {
+		var e kcp.Event
+		if !iter.Scan(&e.ID, &e.IP, &e.VisitedAt, &e.Day, &e.Path, &e.Method,
+			&e.UserAgent, &e.Referrer, &e.AcceptLanguage, &e.Headers) {
+			break
+		}
+		if q.Match(e) {
+			events = append(events, e)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
-	iter := db.Query(q, params...).Iter()
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].VisitedAt.Before(events[j].VisitedAt)
+	})
+	return events, nil
+}
+
+// cqlSelectSession selects sessions, partition key is ip and user agent.
+const cqlSelectSession = "SELECT ip, user_agent, started_at, ended_at, visits, last_event_id FROM kcp.sessions"
+
+// GetSessions get stored sessions matching query ordered by start.
+// Sessions are partitioned by ip and user agent, so all of them are read and filtered after reading.
+func (db *Db) GetSessions(q kcp.SessionQuery) ([]kcp.Session, error) {
+	iter := db.Query(cqlSelectSession).Iter()
 
-	var t time.Time
-	visits := make(kcp.VisitsByIP)
-	for iter.Scan(&t) {
-		visits[ip] = append(visits[ip], t)
+	var s kcp.Session
+	var sessions []kcp.Session
+	for iter.Scan(&s.IP, &s.UserAgent, &s.Start, &s.End, &s.Visits, &s.LastID) {
+		if q.Match(s) {
+			sessions = append(sessions, s)
+		}
 	}
 	if err := iter.Close(); err != nil {
 		fmt.Println(err)
-		return nil, err
+		return nil, storageError(err)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	return sessions, nil
+}
+
+// LastSession get latest stored session of ip and user agent or zero Session if there is none.
+// Sessions of partition are ordered from latest start.
+func (db *Db) LastSession(ip, userAgent string) (kcp.Session, error) {
+	var s kcp.Session
+	err := db.Query(cqlSelectSession+" WHERE ip = ? AND user_agent = ? LIMIT 1", ip, userAgent).
+		Scan(&s.IP, &s.UserAgent, &s.Start, &s.End, &s.Visits, &s.LastID)
+	if err == gocql.ErrNotFound {
+		return kcp.Session{}, nil
 	}
-	return visits, nil
+	return s, err
+}
+
+// SaveSession inserts session or overwrites stored one with same ip, user agent and start.
+func (db *Db) SaveSession(s kcp.Session) error {
+	return db.Query(`
+	INSERT INTO kcp.sessions (ip, user_agent, started_at, ended_at, visits, last_event_id)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		s.IP, s.UserAgent, s.Start, s.End, s.Visits, s.LastID,
+	).Exec()
 }
 
-// CassConn returns connection to cassandra db or an error
-func CassConn() (*gocql.Session, error) {
-	cluster := gocql.NewCluster(os.Getenv("CASSANDRA_HOST"))
-	cluster.Timeout = time.Second * 2
-	session, err := cluster.CreateSession()
+// rollup contains visits of ip in single hour.
+type rollup struct {
+	hour   time.Time
+	ip     string
+	visits int64
+	first  time.Time
+	last   time.Time
+}
+
+// GetVisitStats get statistics of visits matching query grouped by query.
+// Stats are computed from hourly rollups, so time bounds are rounded to whole hours.
+func (db *Db) GetVisitStats(q kcp.StatsQuery) ([]kcp.VisitStats, error) {
+	rollups, err := db.readRollups(rollupDays(q.VisitQuery))
 	if err != nil {
 		return nil, err
 	}
 
-	if err := initDb(session); err != nil {
-		return nil, err
+	// Time bounds are checked against whole hour of rollup.
+	match := q.VisitQuery
+	match.From, match.To = kcp.TimeBound{}, kcp.TimeBound{}
+
+	agg := newStatsAggregator(q.GroupBy)
+	for _, r := range rollups {
+		end := r.hour.Add(time.Hour)
+		if !q.From.IsZero() && !end.After(q.From.Time) {
+			continue
+		}
+		if !q.To.IsZero() && (r.hour.After(q.To.Time) || !q.To.Inclusive && r.hour.Equal(q.To.Time)) {
+			continue
+		}
+		if !match.Match(kcp.Event{IP: r.ip, VisitedAt: r.hour}) {
+			continue
+		}
+		agg.add(q.GroupBy.Group(r.ip, r.hour, q.Loc()), r.ip, r.visits, r.first, r.last)
 	}
-	return session, nil
+	return agg.stats(), nil
 }
 
-func initDb(s *gocql.Session) error {
-	fmt.Println("Init database")
-	if err := s.Query(`DROP KEYSPACE IF EXISTS kcp`).Exec(); err != nil {
-		fmt.Println(err)
-		return err
+// maxRollupDays is max number of days queried one by one, more days are read by full scan.
+const maxRollupDays = 366
+
+// rollupDays returns days of rollup partitions matching query time bounds,
+// or nil if all partitions should be read.
+func rollupDays(q kcp.VisitQuery) []time.Time {
+	if q.From.IsZero() || q.To.IsZero() {
+		return nil
+	}
+	from := q.From.Time.UTC().Truncate(time.Hour * 24)
+	to := q.To.Time.UTC()
+	if to.Sub(from) > time.Hour*24*maxRollupDays {
+		return nil
 	}
+	var days []time.Time
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days
+}
 
-	if err := s.Query(`
-	CREATE  KEYSPACE IF NOT EXISTS kcp 
-	WITH REPLICATION = { 
-		'class' : 'SimpleStrategy',
-		'replication_factor' : 1 }`,
-	).Exec(); err != nil {
+// readRollups reads hourly rollups of days, all rollups are read if days is nil.
+func (db *Db) readRollups(days []time.Time) ([]rollup, error) {
+	if days == nil {
+		return db.readRollupPartition("", nil)
+	}
+	var rollups []rollup
+	for _, day := range days {
+		r, err := db.readRollupPartition(" WHERE day = ?", []interface{}{day})
+		if err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, r...)
+	}
+	return rollups, nil
+}
+
+// readRollupPartition reads rollups using where clause joining visit counters with seen times.
+func (db *Db) readRollupPartition(where string, params []interface{}) ([]rollup, error) {
+	type key struct {
+		hour time.Time
+		ip   string
+	}
+	byKey := make(map[key]*rollup)
+	var keys []key
+
+	var day time.Time
+	var hour int
+	var ip string
+	var visits int64
+	iter := db.Query("SELECT day, hour, ip, visits FROM kcp.visits_hourly"+where, params...).Iter()
+	for iter.Scan(&day, &hour, &ip, &visits) {
+		k := key{hour: day.UTC().Add(time.Hour * time.Duration(hour)), ip: ip}
+		byKey[k] = &rollup{hour: k.hour, ip: ip, visits: visits}
+		keys = append(keys, k)
+	}
+	if err := iter.Close(); err != nil {
 		fmt.Println(err)
-		return err
+		return nil, storageError(err)
 	}
 
-	if err := s.Query(`
-	CREATE TABLE kcp.visits(
-		ip text,
-		visited_at timestamp,
-		day text,
-		PRIMARY KEY (ip, visited_at))`,
-	).Exec(); err != nil {
+	var first, last time.Time
+	iter = db.Query("SELECT day, hour, ip, first_seen, last_seen FROM kcp.visits_hourly_seen"+where, params...).Iter()
+	for iter.Scan(&day, &hour, &ip, &first, &last) {
+		k := key{hour: day.UTC().Add(time.Hour * time.Duration(hour)), ip: ip}
+		if r, ok := byKey[k]; ok {
+			r.first, r.last = first, last
+		}
+	}
+	if err := iter.Close(); err != nil {
 		fmt.Println(err)
-		return err
+		return nil, storageError(err)
 	}
 
+	rollups := make([]rollup, 0, len(keys))
+	for _, k := range keys {
+		rollups = append(rollups, *byKey[k])
+	}
+	return rollups, nil
+}
+
+func init() {
+	Register("cassandra", Driver{
+		Open: func(o Options) (kcp.DbConnector, func() error, error) {
+			session, err := CassConn(o.CassandraHost, o.CassandraTimeout)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &Db{Session: session}, func() error {
+				session.Close()
+				return nil
+			}, nil
+		},
+		Migrations: cassandraMigrations,
+		Migrator: func(db kcp.DbConnector) Migrator {
+			return cassMigrator{db.(*Db).Session}
+		},
+	})
+}
+
+// CassConn returns connection to cassandra db at host using query timeout or an error.
+// Schema is migrated by cassandra Driver.
+func CassConn(host string, timeout time.Duration) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(host)
+	cluster.Timeout = timeout
+	return cluster.CreateSession()
+}
+
+// cassMigrator executes migrations of cassandra kcp keyspace.
+// Statements are not atomic, so failed migration is repeated when it is applied again.
+type cassMigrator struct {
+	*gocql.Session
+}
+
+// Version returns latest applied version, 0 if schema_version table does not exist.
+func (s cassMigrator) Version() (int, error) {
+	var table string
 	if err := s.Query(`
-	CREATE INDEX IF NOT EXISTS ON kcp.visits (day)`,
-	).Exec(); err != nil {
-		fmt.Println(err)
-		return err
+	SELECT table_name FROM system_schema.tables
+	WHERE keyspace_name = 'kcp' AND table_name = 'schema_version'`,
+	).Scan(&table); err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	iter := s.Query(`SELECT version FROM kcp.schema_version`).Iter()
+	var v, latest int
+	for iter.Scan(&v) {
+		if v > latest {
+			latest = v
+		}
+	}
+	return latest, iter.Close()
+}
+
+// Unversioned returns names of tables of kcp keyspace, if schema_version table does not exist.
+// Failed first migration leaves schema_version table, so its tables are not reported.
+func (s cassMigrator) Unversioned() ([]string, error) {
+	iter := s.Query(`SELECT table_name FROM system_schema.tables WHERE keyspace_name = 'kcp'`).Iter()
+	var table string
+	var tables []string
+	for iter.Scan(&table) {
+		if table == "schema_version" {
+			return nil, iter.Close()
+		}
+		tables = append(tables, table)
 	}
+	return tables, iter.Close()
+}
 
-	return initialData(s)
+// Up executes Up statements of migration and records its version.
+func (s cassMigrator) Up(m Migration) error {
+	for _, stmt := range append([]string{cqlCreateKeyspace, cqlCreateSchemaVersion}, m.Up...) {
+		if err := s.Query(stmt).Exec(); err != nil {
+			return err
+		}
+	}
+	return s.Query(`
+	INSERT INTO kcp.schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.Version, m.Name, time.Now().UTC(),
+	).Exec()
 }
 
-func initialData(s *gocql.Session) error {
-	for i := 0; i < 50; i++ {
-		if err := s.Query(
-			"INSERT INTO kcp.visits (ip, visited_at, day) VALUES (?, ?, ?)",
-			"172.19.0."+fmt.Sprint(i%5),
-			time.Now().UTC().AddDate(0, i%5, i),
-			time.Now().UTC().AddDate(0, i%5, i).Weekday().String(),
-		).Exec(); err != nil {
+// Down executes Down statements of migration and removes record of its version.
+func (s cassMigrator) Down(m Migration) error {
+	for _, stmt := range m.Down {
+		if err := s.Query(stmt).Exec(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return s.Query(`DELETE FROM kcp.schema_version WHERE version = ?`, m.Version).Exec()
 }
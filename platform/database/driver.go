@@ -0,0 +1,101 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// Options configures connection of storage driver, each driver uses its own options.
+type Options struct {
+	SQLitePath       string
+	CassandraHost    string
+	CassandraTimeout time.Duration
+}
+
+// Driver opens storage and migrates its schema.
+type Driver struct {
+	// Open connects to storage, returned function closes connection.
+	Open func(Options) (kcp.DbConnector, func() error, error)
+	// Migrations are schema migrations ordered by version, executed by Migrator.
+	Migrations []Migration
+	// Migrator returns Migrator of storage returned by Open, nil if storage has no schema.
+	Migrator func(kcp.DbConnector) Migrator
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Register makes storage driver available by name.
+// It panics if driver is registered twice, has no Open or has Migrations without Migrator.
+func Register(name string, d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if d.Open == nil || d.Migrations != nil && d.Migrator == nil {
+		panic("database: Register driver " + name + " is incomplete")
+	}
+	if _, ok := drivers[name]; ok {
+		panic("database: Register called twice for driver " + name)
+	}
+	drivers[name] = d
+}
+
+// Drivers returns sorted names of registered storage drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open connects to storage using driver registered by name and checks that its schema
+// is migrated to latest known version. Returned function closes connection.
+func Open(name string, opts Options) (kcp.DbConnector, func() error, error) {
+	db, closeDb, err := Connect(name, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSchema(name, db); err != nil {
+		closeDb()
+		return nil, nil, err
+	}
+	return db, closeDb, nil
+}
+
+// Connect connects to storage using driver registered by name without checking its schema,
+// e.g. to migrate it. Returned function closes connection.
+func Connect(name string, opts Options) (kcp.DbConnector, func() error, error) {
+	d, err := driver(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.Open(opts)
+}
+
+func checkSchema(name string, db kcp.DbConnector) error {
+	s, err := NewSchema(name, db)
+	if err != nil {
+		return err
+	}
+	return s.Check()
+}
+
+func driver(name string) (Driver, error) {
+	driversMu.RLock()
+	d, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return Driver{}, fmt.Errorf("unknown storage driver %q, registered: %v", name, strings.Join(Drivers(), ", "))
+	}
+	return d, nil
+}
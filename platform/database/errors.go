@@ -0,0 +1,31 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// storageError wraps err with kcp.ErrUnavailable, if db could not serve query,
+// because it is unreachable, timed out or locked. Other errors are returned as is.
+func storageError(err error) error {
+	var unavailable *gocql.RequestErrUnavailable
+	var readTimeout *gocql.RequestErrReadTimeout
+	var sqliteErr sqlite3.Error
+	switch {
+	case errors.Is(err, gocql.ErrNoConnections),
+		errors.Is(err, gocql.ErrSessionClosed),
+		errors.Is(err, gocql.ErrTimeoutNoResponse),
+		errors.Is(err, gocql.ErrConnectionClosed),
+		errors.As(err, &unavailable),
+		errors.As(err, &readTimeout):
+	case errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked):
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %v", kcp.ErrUnavailable, err)
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// condition is part of WHERE clause with its params.
+type condition struct {
+	expr string
+	args []interface{}
+}
+
+// joinConditions joins conditions with AND and returns their params.
+func joinConditions(conds []condition) (string, []interface{}) {
+	var exprs []string
+	var params []interface{}
+	for _, c := range conds {
+		exprs = append(exprs, c.expr)
+		params = append(params, c.args...)
+	}
+	return strings.Join(exprs, " AND "), params
+}
+
+// placeholders returns n comma separated placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// boundOperator returns comparison operator for lower or upper time bound.
+func boundOperator(b kcp.TimeBound, lower bool) string {
+	op := "<"
+	if lower {
+		op = ">"
+	}
+	if b.Inclusive {
+		op += "="
+	}
+	return op
+}
+
+// timeConditions returns conditions on visited_at shared by SQL and CQL.
+func timeConditions(q kcp.VisitQuery) []condition {
+	return boundConditions("visited_at", q)
+}
+
+// boundConditions returns conditions of query time bounds on column.
+// Bounds are bound in UTC, as SQLite compares stored UTC times as text.
+func boundConditions(column string, q kcp.VisitQuery) []condition {
+	var conds []condition
+	if !q.From.IsZero() {
+		conds = append(conds, condition{
+			expr: fmt.Sprintf("%v %v ?", column, boundOperator(q.From, true)),
+			args: []interface{}{q.From.Time.UTC()},
+		})
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, condition{
+			expr: fmt.Sprintf("%v %v ?", column, boundOperator(q.To, false)),
+			args: []interface{}{q.To.Time.UTC()},
+		})
+	}
+	return conds
+}
+
+// sqlConditions returns SQLite conditions matching query filters.
+func sqlConditions(q kcp.VisitQuery) []condition {
+	var conds []condition
+	if q.IPs != nil || q.Networks != nil {
+		conds = append(conds, ipsCondition(q))
+	}
+
+	conds = append(conds, timeConditions(q)...)
+
+	// Stored day is in UTC, weekdays of other time zones are computed from visited_at.
+	if q.Weekdays != nil && q.IsUTC() {
+		conds = append(conds, condition{
+			expr: fmt.Sprintf("day IN (%v)", placeholders(len(q.Weekdays))),
+			args: stringArgs(q.Days()),
+		})
+	} else if q.Weekdays != nil {
+		conds = append(conds, weekdaysCondition(sqlLocalTime("visited_at", q), q.Weekdays))
+	}
+
+	if q.Hours != nil {
+		conds = append(conds, hoursCondition(sqlLocalTime("visited_at", q), *q.Hours))
+	}
+
+	if q.Paths != nil {
+		conds = append(conds, patternsCondition("path", q.Paths))
+	}
+	if q.Methods != nil {
+		conds = append(conds, condition{
+			expr: fmt.Sprintf("method IN (%v)", placeholders(len(q.Methods))),
+			args: stringArgs(q.Methods),
+		})
+	}
+	if q.Referrers != nil {
+		conds = append(conds, patternsCondition("referrer", q.Referrers))
+	}
+	if q.UserAgent != "" {
+		conds = append(conds, condition{
+			expr: "instr(lower(user_agent), lower(?)) > 0",
+			args: []interface{}{q.UserAgent},
+		})
+	}
+	return conds
+}
+
+// ipsCondition returns SQLite condition matching ip to any of query ips or networks.
+// Networks are matched by range of normalised ip, see kcp.NormalizeIP.
+func ipsCondition(q kcp.VisitQuery) condition {
+	var exprs []string
+	var args []interface{}
+	if q.IPs != nil {
+		exprs = append(exprs, fmt.Sprintf("ip IN (%v)", placeholders(len(q.IPs))))
+		args = append(args, stringArgs(q.IPs)...)
+	}
+	for _, n := range q.Networks {
+		first, last := kcp.NetworkRange(n)
+		exprs = append(exprs, "ip_bin BETWEEN ? AND ?")
+		args = append(args, []byte(first), []byte(last))
+	}
+	return condition{expr: fmt.Sprintf("(%v)", strings.Join(exprs, " OR ")), args: args}
+}
+
+// patternsCondition returns SQLite condition matching column to any of patterns
+// exactly or by prefix, see kcp.IsPrefixPattern. Matching is case sensitive.
+func patternsCondition(column string, patterns []string) condition {
+	var exprs []string
+	var args []interface{}
+	for _, p := range patterns {
+		if prefix, ok := kcp.IsPrefixPattern(p); ok {
+			exprs = append(exprs, fmt.Sprintf("instr(%v, ?) = 1", column))
+			args = append(args, prefix)
+			continue
+		}
+		exprs = append(exprs, fmt.Sprintf("%v = ?", column))
+		args = append(args, p)
+	}
+	return condition{expr: fmt.Sprintf("(%v)", strings.Join(exprs, " OR ")), args: args}
+}
+
+// sqlOrder returns ORDER BY expression for query.
+func sqlOrder(q kcp.VisitQuery) string {
+	if q.Desc() {
+		return "visited_at DESC"
+	}
+	return "visited_at ASC"
+}
+
+// sqlPageConditions returns sqlConditions and keyset condition if query has cursor.
+func sqlPageConditions(q kcp.VisitQuery) ([]condition, error) {
+	conds := sqlConditions(q)
+	if q.Cursor == "" {
+		return conds, nil
+	}
+	c, err := keysetCondition(q)
+	if err != nil {
+		return nil, err
+	}
+	return append(conds, c), nil
+}
+
+// sqlPageOrder returns ORDER BY expression for query with rowid as tie breaker.
+func sqlPageOrder(q kcp.VisitQuery) string {
+	if q.Desc() {
+		return "visited_at DESC, rowid DESC"
+	}
+	return "visited_at ASC, rowid ASC"
+}
+
+// sqlLimit returns number of rows to select, one more than limit to know
+// if there is next page, or 0 if query has no limit.
+func sqlLimit(q kcp.VisitQuery) int {
+	if q.Limit == 0 {
+		return 0
+	}
+	return q.Limit + 1
+}
+
+func stringArgs(s []string) []interface{} {
+	args := make([]interface{}, len(s))
+	for i, v := range s {
+		args[i] = v
+	}
+	return args
+}
+
+// visit is single visit read from db.
+type visit struct {
+	rowID int64
+	ip    string
+	t     time.Time
+}
+
+// sqlPage groups visits read using sqlLimit into page.
+// If there are more visits than limit, last one is dropped
+// and cursor pointing to last visit in page is returned.
+func sqlPage(visits []visit, q kcp.VisitQuery) kcp.VisitsPage {
+	var cursor string
+	if q.Limit > 0 && len(visits) > q.Limit {
+		visits = visits[:q.Limit]
+		last := visits[len(visits)-1]
+		cursor = encodeCursor(keysetCursor{VisitedAt: last.t, RowID: last.rowID})
+	}
+
+	visitsByIP := make(kcp.VisitsByIP)
+	for _, v := range visits {
+		visitsByIP[v.ip] = append(visitsByIP[v.ip], v.t)
+	}
+	return kcp.VisitsPage{Visits: visitsByIP, NextCursor: cursor}
+}
+
+// groupVisits sorts visits by query order, applies limit and groups them by ip.
+func groupVisits(visits []visit, q kcp.VisitQuery) kcp.VisitsByIP {
+	sort.SliceStable(visits, func(i, j int) bool {
+		if q.Desc() {
+			return visits[i].t.After(visits[j].t)
+		}
+		return visits[i].t.Before(visits[j].t)
+	})
+	if q.Limit > 0 && len(visits) > q.Limit {
+		visits = visits[:q.Limit]
+	}
+
+	visitsByIP := make(kcp.VisitsByIP)
+	for _, v := range visits {
+		visitsByIP[v.ip] = append(visitsByIP[v.ip], v.t)
+	}
+	return visitsByIP
+}
@@ -1,11 +1,13 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
 	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/SarunasBucius/kafka-cass-practise/kcp"
 )
@@ -17,76 +19,247 @@ type Gorm struct {
 
 // Visit contains fields for visit row in db.
 type Visit struct {
-	VisitedAt time.Time
-	IP        string
-	Day       string
+	EventID   *string   `gorm:"uniqueIndex"`
+	VisitedAt time.Time `gorm:"index"`
+	IP        string    `gorm:"index"`
+	// IPBin contains normalised ip for range queries.
+	IPBin          []byte `gorm:"index"`
+	Day            string
+	Path           string
+	Method         string
+	UserAgent      string
+	Referrer       string
+	AcceptLanguage string
+	// Headers contains allowed request headers as JSON object.
+	Headers *string
 }
 
-// SQLiteGormConn returns connection to gorm SQLite db or an error.
-func SQLiteGormConn() (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open("./kcp.db"), &gorm.Config{})
+// newVisit returns Visit row of event.
+func newVisit(e kcp.Event) (Visit, error) {
+	headers, err := headersJSON(e.Headers)
 	if err != nil {
-		return nil, err
+		return Visit{}, err
 	}
+	return Visit{
+		EventID:        eventID(e),
+		VisitedAt:      e.VisitedAt.UTC(),
+		IP:             e.IP,
+		IPBin:          ipBin(e.IP),
+		Day:            e.Day,
+		Path:           e.Path,
+		Method:         e.Method,
+		UserAgent:      e.UserAgent,
+		Referrer:       e.Referrer,
+		AcceptLanguage: e.AcceptLanguage,
+		Headers:        headers,
+	}, nil
+}
 
-	if err := initSQLiteGorm(db); err != nil {
-		return nil, err
-	}
-	return db, nil
+// VisitHourly contains fields for hourly rollup of visits from ip.
+type VisitHourly struct {
+	Hour      time.Time `gorm:"primaryKey;autoIncrement:false"`
+	IP        string    `gorm:"primaryKey"`
+	Visits    int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// TableName returns name of rollup table.
+func (VisitHourly) TableName() string {
+	return "visits_hourly"
 }
 
-func initSQLiteGorm(db *gorm.DB) error {
-	return db.AutoMigrate(&Visit{})
+// RollupOffset contains last offset of partition applied to rollups.
+type RollupOffset struct {
+	Topic          string `gorm:"primaryKey"`
+	TopicPartition int32  `gorm:"primaryKey;autoIncrement:false"`
+	LastOffset     int64
 }
 
-// InsertEvent inserts kcp.Event into db.
+// VisitSession contains fields for session of visits from ip and user agent.
+type VisitSession struct {
+	IP        string    `gorm:"primaryKey"`
+	UserAgent string    `gorm:"primaryKey"`
+	StartedAt time.Time `gorm:"primaryKey;autoIncrement:false;index"`
+	EndedAt   time.Time
+	Visits    int64
+}
+
+// TableName returns name of sessions table.
+func (VisitSession) TableName() string {
+	return "sessions"
+}
+
+func init() {
+	Register("gorm-sqlite", Driver{
+		Open: func(o Options) (kcp.DbConnector, func() error, error) {
+			db, err := SQLiteGormConn(o.SQLitePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			sqlDB, err := db.DB()
+			if err != nil {
+				return nil, nil, err
+			}
+			return &Gorm{DB: db}, sqlDB.Close, nil
+		},
+		Migrations: sqliteMigrations,
+		Migrator: func(db kcp.DbConnector) Migrator {
+			sqlDB, _ := db.(*Gorm).DB.DB()
+			return sqliteMigrator{sqlDB}
+		},
+	})
+}
+
+// SQLiteGormConn returns connection to gorm SQLite db at path or an error.
+// Schema is migrated by gorm-sqlite Driver using migrations of sqlite driver.
+func SQLiteGormConn(path string) (*gorm.DB, error) {
+	return gorm.Open(sqlite.Open(path), &gorm.Config{})
+}
+
+// InsertEvent inserts kcp.Event into db, duplicate event is ignored.
 func (db *Gorm) InsertEvent(e kcp.Event) error {
-	return db.Create(&Visit{
-		VisitedAt: e.VisitedAt,
-		IP:        e.IP,
-		Day:       e.Day,
-	}).Error
+	v, err := newVisit(e)
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&v).Error
 }
 
-// GetVisits get visits grouped by ip.
-func (db *Gorm) GetVisits() (kcp.VisitsByIP, error) {
-	visits := make(kcp.VisitsByIP)
-	rows, err := db.Model(&Visit{}).Select("ip", "visited_at").Rows()
+// insertBatchSize is max number of visits inserted by single statement.
+const insertBatchSize = 100
+
+// InsertEvents inserts kcp.Events into db in single transaction, duplicate events are ignored.
+func (db *Gorm) InsertEvents(events []kcp.Event) error {
+	visits := make([]Visit, 0, len(events))
+	for _, e := range events {
+		v, err := newVisit(e)
+		if err != nil {
+			return err
+		}
+		visits = append(visits, v)
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&visits, insertBatchSize).Error
+}
+
+// queryRow executes raw statement selecting single row.
+func (db *Gorm) queryRow(stmt string, args ...interface{}) *sql.Row {
+	return db.Raw(stmt, args...).Row()
+}
+
+// GetVisits get page of visits matching query grouped by ip.
+// Pages are selected using keyset pagination on visited_at and rowid.
+func (db *Gorm) GetVisits(q kcp.VisitQuery) (kcp.VisitsPage, error) {
+	q, err := sqlVisitsZoneBounds(db.queryRow, q)
+	if err != nil {
+		fmt.Println(err)
+		return kcp.VisitsPage{}, storageError(err)
+	}
+	conds, err := sqlPageConditions(q)
+	if err != nil {
+		return kcp.VisitsPage{}, err
+	}
+
+	tx := db.Model(&Visit{})
+	for _, c := range conds {
+		tx = tx.Where(c.expr, c.args...)
+	}
+	tx = tx.Order(sqlPageOrder(q))
+	if limit := sqlLimit(q); limit > 0 {
+		tx = tx.Limit(limit)
+	}
+
+	rows, err := tx.Select("rowid", "ip", "visited_at").Rows()
 	if err != nil {
 		fmt.Println(err)
-		return nil, err
+		return kcp.VisitsPage{}, storageError(err)
 	}
+	defer rows.Close()
+
+	var visits []visit
 	for rows.Next() {
-		var visit Visit
-		if err := db.ScanRows(rows, &visit); err != nil {
+		var v visit
+		if err := rows.Scan(&v.rowID, &v.ip, &v.t); err != nil {
 			fmt.Println(err)
-			return nil, err
+			return kcp.VisitsPage{}, err
 		}
-		visits[visit.IP] = append(visits[visit.IP], visit.VisitedAt)
+		visits = append(visits, v)
+	}
+	if err := rows.Err(); err != nil {
+		return kcp.VisitsPage{}, err
 	}
+	return sqlPage(visits, q), nil
+}
 
-	return visits, nil
+// UpdateRollups applies event at stream position to hourly rollups,
+// if it is after last applied position of its partition.
+func (db *Gorm) UpdateRollups(e kcp.Event, pos kcp.StreamPosition) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return applyRollup(func(stmt string, args ...interface{}) (int64, error) {
+			res := tx.Exec(stmt, args...)
+			return res.RowsAffected, res.Error
+		}, e, pos)
+	})
 }
 
-// GetVisitsByIP get filtered visits by ip.
-func (db *Gorm) GetVisitsByIP(ip, day string, gt, lt time.Time) (kcp.VisitsByIP, error) {
-	var visits []Visit
+// GetVisitStats get statistics of visits matching query from rollups grouped by query.
+func (db *Gorm) GetVisitStats(q kcp.StatsQuery) ([]kcp.VisitStats, error) {
+	vq, err := sqlZoneBounds(db.queryRow, "visits_hourly", "hour", q.VisitQuery)
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
+	}
+	q.VisitQuery = vq
+	stmt, params := sqlStatsStatement(q)
+	rows, err := db.Raw(stmt, params...).Rows()
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
+	}
+	defer rows.Close()
+	return scanStats(rows, q.GroupBy)
+}
 
-	tx := db.DB
-	if !gt.IsZero() {
-		tx = tx.Where("visited_at > ?", gt)
+// GetEvents get visit events matching query ordered by visited_at.
+func (db *Gorm) GetEvents(q kcp.VisitQuery) ([]kcp.Event, error) {
+	q, err := sqlVisitsZoneBounds(db.queryRow, q)
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
-	if !lt.IsZero() {
-		tx = tx.Where("visited_at < ?", lt)
+	stmt, params := sqlEventsStatement(q)
+	rows, err := db.Raw(stmt, params...).Rows()
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
-	if day != "" {
-		tx = tx.Where("day = ?", day)
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+// GetSessions get stored sessions matching query ordered by start.
+func (db *Gorm) GetSessions(q kcp.SessionQuery) ([]kcp.Session, error) {
+	stmt, params := sqlSessionsStatement(q)
+	rows, err := db.Raw(stmt, params...).Rows()
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
-	res := tx.Find(&visits)
+	defer rows.Close()
+	return scanSessions(rows)
+}
 
-	visitsByIP := make(kcp.VisitsByIP)
-	for _, v := range visits {
-		visitsByIP[v.IP] = append(visitsByIP[v.IP], v.VisitedAt)
+// LastSession get latest stored session of ip and user agent or zero Session if there is none.
+func (db *Gorm) LastSession(ip, userAgent string) (kcp.Session, error) {
+	rows, err := db.Raw(sqlLastSession, ip, userAgent).Rows()
+	if err != nil {
+		return kcp.Session{}, err
 	}
-	return visitsByIP, res.Error
+	defer rows.Close()
+	return lastSession(rows)
+}
+
+// SaveSession inserts session or updates stored one with same ip, user agent and start.
+func (db *Gorm) SaveSession(s kcp.Session) error {
+	return db.Exec(sqlUpsertSession, sqlSessionArgs(s)...).Error
 }
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+func init() {
+	Register("memory", Driver{
+		Open: func(Options) (kcp.DbConnector, func() error, error) {
+			return NewMemory(), func() error { return nil }, nil
+		},
+	})
+}
+
+// Memory stores visits, rollups and sessions in memory, data is lost on restart.
+// It is safe for concurrent use.
+type Memory struct {
+	mu sync.Mutex
+	// events are ordered by insertion, index of event is its row id.
+	events   []kcp.Event
+	eventIDs map[string]struct{}
+	rollups  map[rollupKey]*kcp.VisitStats
+	offsets  map[partitionKey]int64
+	sessions map[sessionKey]kcp.Session
+}
+
+// rollupKey identifies hourly rollup of ip.
+type rollupKey struct {
+	hour time.Time
+	ip   string
+}
+
+// partitionKey identifies partition of stream.
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// sessionKey identifies stored session.
+type sessionKey struct {
+	ip        string
+	userAgent string
+	start     time.Time
+}
+
+// NewMemory returns empty Memory storage.
+func NewMemory() *Memory {
+	return &Memory{
+		eventIDs: make(map[string]struct{}),
+		rollups:  make(map[rollupKey]*kcp.VisitStats),
+		offsets:  make(map[partitionKey]int64),
+		sessions: make(map[sessionKey]kcp.Session),
+	}
+}
+
+// InsertEvent inserts kcp.Event, duplicate event is ignored.
+func (db *Memory) InsertEvent(e kcp.Event) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.insertEvent(e)
+	return nil
+}
+
+// InsertEvents inserts kcp.Events, duplicate events are ignored.
+func (db *Memory) InsertEvents(events []kcp.Event) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, e := range events {
+		db.insertEvent(e)
+	}
+	return nil
+}
+
+func (db *Memory) insertEvent(e kcp.Event) {
+	if e.ID != "" {
+		if _, ok := db.eventIDs[e.ID]; ok {
+			return
+		}
+		db.eventIDs[e.ID] = struct{}{}
+	}
+	e.VisitedAt = e.VisitedAt.UTC()
+	db.events = append(db.events, e)
+}
+
+// GetVisits get page of visits matching query grouped by ip.
+// Pages are selected using keyset pagination on visited_at and row id.
+func (db *Memory) GetVisits(q kcp.VisitQuery) (kcp.VisitsPage, error) {
+	var after func(visit) bool
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return kcp.VisitsPage{}, err
+		}
+		after = func(v visit) bool {
+			if q.Desc() {
+				return v.t.Before(c.VisitedAt) || v.t.Equal(c.VisitedAt) && v.rowID < c.RowID
+			}
+			return v.t.After(c.VisitedAt) || v.t.Equal(c.VisitedAt) && v.rowID > c.RowID
+		}
+	}
+
+	db.mu.Lock()
+	var visits []visit
+	for i, e := range db.events {
+		v := visit{rowID: int64(i + 1), ip: e.IP, t: e.VisitedAt}
+		if q.Match(e) && (after == nil || after(v)) {
+			visits = append(visits, v)
+		}
+	}
+	db.mu.Unlock()
+
+	sort.SliceStable(visits, func(i, j int) bool {
+		if q.Desc() {
+			return visits[i].t.After(visits[j].t) || visits[i].t.Equal(visits[j].t) && visits[i].rowID > visits[j].rowID
+		}
+		return visits[i].t.Before(visits[j].t)
+	})
+	if limit := sqlLimit(q); limit > 0 && len(visits) > limit {
+		visits = visits[:limit]
+	}
+	return sqlPage(visits, q), nil
+}
+
+// GetEvents get visit events matching query ordered by visited_at.
+func (db *Memory) GetEvents(q kcp.VisitQuery) ([]kcp.Event, error) {
+	db.mu.Lock()
+	var events []kcp.Event
+	for _, e := range db.events {
+		if q.Match(e) {
+			events = append(events, e)
+		}
+	}
+	db.mu.Unlock()
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].VisitedAt.Before(events[j].VisitedAt)
+	})
+	return events, nil
+}
+
+// UpdateRollups applies event at stream position to hourly rollups,
+// if it is after last applied position of its partition.
+func (db *Memory) UpdateRollups(e kcp.Event, pos kcp.StreamPosition) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	p := partitionKey{topic: pos.Topic, partition: pos.Partition}
+	if last, ok := db.offsets[p]; ok && last >= pos.Offset {
+		// Event was already applied.
+		return nil
+	}
+	db.offsets[p] = pos.Offset
+
+	t := e.VisitedAt.UTC()
+	k := rollupKey{hour: t.Truncate(time.Hour), ip: e.IP}
+	r, ok := db.rollups[k]
+	if !ok {
+		r = &kcp.VisitStats{FirstSeen: t, LastSeen: t}
+		db.rollups[k] = r
+	}
+	r.Visits++
+	if t.Before(r.FirstSeen) {
+		r.FirstSeen = t
+	}
+	if t.After(r.LastSeen) {
+		r.LastSeen = t
+	}
+	return nil
+}
+
+// GetVisitStats get statistics of visits matching query from rollups grouped by query.
+// Time bounds are checked against whole hour of rollup, like in SQL storage.
+func (db *Memory) GetVisitStats(q kcp.StatsQuery) ([]kcp.VisitStats, error) {
+	rq := q.VisitQuery
+	if !q.From.IsZero() {
+		rq.From = kcp.TimeBound{Time: q.From.Time.UTC().Truncate(time.Hour), Inclusive: true}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a := newStatsAggregator(q.GroupBy)
+	for k, r := range db.rollups {
+		if rq.Match(kcp.Event{IP: k.ip, VisitedAt: k.hour}) {
+			a.add(q.GroupBy.Group(k.ip, k.hour, q.Loc()), k.ip, r.Visits, r.FirstSeen, r.LastSeen)
+		}
+	}
+	return a.stats(), nil
+}
+
+// GetSessions get stored sessions matching query ordered by start.
+func (db *Memory) GetSessions(q kcp.SessionQuery) ([]kcp.Session, error) {
+	db.mu.Lock()
+	var sessions []kcp.Session
+	for _, s := range db.sessions {
+		if q.Match(s) {
+			sessions = append(sessions, s)
+		}
+	}
+	db.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	return sessions, nil
+}
+
+// LastSession get latest stored session of ip and user agent or zero Session if there is none.
+func (db *Memory) LastSession(ip, userAgent string) (kcp.Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var last kcp.Session
+	for k, s := range db.sessions {
+		if k.ip == ip && k.userAgent == userAgent && s.Start.After(last.Start) {
+			last = s
+		}
+	}
+	return last, nil
+}
+
+// SaveSession inserts session or updates stored one with same ip, user agent and start.
+func (db *Memory) SaveSession(s kcp.Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s.Start, s.End = s.Start.UTC(), s.End.UTC()
+	db.sessions[sessionKey{ip: s.IP, userAgent: s.UserAgent, start: s.Start}] = s
+	return nil
+}
@@ -0,0 +1,207 @@
+package database
+
+// Schema migrations of storages, new migration is appended with next version.
+// Applied migrations must not be changed, as their versions are recorded in storage.
+// Schema created before migrations is not adopted, as its tables may lack columns of later versions,
+// so first migration is refused if storage has tables, but no recorded version (see ErrUnversionedSchema).
+
+// sqlCreateSchemaVersion creates SQLite table recording applied migrations.
+const sqlCreateSchemaVersion = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version integer not null primary key,
+		name text not null,
+		applied_at TIMESTAMP not null
+		)`
+
+// sqliteMigrations are migrations of SQLite db shared by sqlite and gorm-sqlite drivers.
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create visits",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS visits (
+		id integer not null primary key,
+		event_id text,
+		ip text,
+		ip_bin blob,
+		day text,
+		visited_at TIMESTAMP,
+		path text,
+		method text,
+		user_agent text,
+		referrer text,
+		accept_language text,
+		headers text
+		)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS visits_event_id ON visits (event_id)`,
+			`CREATE INDEX IF NOT EXISTS visits_visited_at ON visits (visited_at)`,
+			`CREATE INDEX IF NOT EXISTS visits_ip_visited_at ON visits (ip, visited_at)`,
+			`CREATE INDEX IF NOT EXISTS visits_ip_bin ON visits (ip_bin)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS visits`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create rollups",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS visits_hourly (
+		hour TIMESTAMP not null,
+		ip text not null,
+		visits integer not null,
+		first_seen TIMESTAMP,
+		last_seen TIMESTAMP,
+		primary key (hour, ip)
+		)`, `
+	CREATE TABLE IF NOT EXISTS rollup_offsets (
+		topic text not null,
+		topic_partition integer not null,
+		last_offset integer not null,
+		primary key (topic, topic_partition)
+		)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS rollup_offsets`,
+			`DROP TABLE IF EXISTS visits_hourly`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create sessions",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS sessions (
+		ip text not null,
+		user_agent text not null,
+		started_at TIMESTAMP not null,
+		ended_at TIMESTAMP not null,
+		visits integer not null,
+		primary key (ip, user_agent, started_at)
+		)`,
+			`CREATE INDEX IF NOT EXISTS sessions_started_at ON sessions (started_at)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS sessions`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add last event id of sessions",
+		Up: []string{
+			`ALTER TABLE sessions ADD COLUMN last_event_id text`,
+		},
+		// SQLite does not support dropping columns, so table is copied without it.
+		Down: []string{`
+	CREATE TABLE sessions_v3 (
+		ip text not null,
+		user_agent text not null,
+		started_at TIMESTAMP not null,
+		ended_at TIMESTAMP not null,
+		visits integer not null,
+		primary key (ip, user_agent, started_at)
+		)`,
+			`INSERT INTO sessions_v3 SELECT ip, user_agent, started_at, ended_at, visits FROM sessions`,
+			`DROP TABLE sessions`,
+			`ALTER TABLE sessions_v3 RENAME TO sessions`,
+			`CREATE INDEX IF NOT EXISTS sessions_started_at ON sessions (started_at)`,
+		},
+	},
+}
+
+// CQL statements creating keyspace and table recording applied migrations,
+// keyspace is kept when all migrations are reverted.
+const (
+	cqlCreateKeyspace = `
+	CREATE KEYSPACE IF NOT EXISTS kcp
+	WITH REPLICATION = {
+		'class' : 'SimpleStrategy',
+		'replication_factor' : 1 }`
+	cqlCreateSchemaVersion = `
+	CREATE TABLE IF NOT EXISTS kcp.schema_version(
+		version int,
+		name text,
+		applied_at timestamp,
+		PRIMARY KEY (version))`
+)
+
+// cassandraMigrations are migrations of cassandra kcp keyspace.
+var cassandraMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create visits",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS kcp.visits(
+		ip text,
+		visited_at timestamp,
+		id text,
+		day text,
+		path text,
+		method text,
+		user_agent text,
+		referrer text,
+		accept_language text,
+		headers map<text, text>,
+		PRIMARY KEY (ip, visited_at, id))`,
+			`CREATE INDEX IF NOT EXISTS ON kcp.visits (day)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS kcp.visits`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create rollups",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS kcp.visits_hourly(
+		day date,
+		hour int,
+		ip text,
+		visits counter,
+		PRIMARY KEY (day, hour, ip))`, `
+	CREATE TABLE IF NOT EXISTS kcp.visits_hourly_seen(
+		day date,
+		hour int,
+		ip text,
+		first_seen timestamp,
+		last_seen timestamp,
+		PRIMARY KEY (day, hour, ip))`, `
+	CREATE TABLE IF NOT EXISTS kcp.rollup_offsets(
+		topic text,
+		topic_partition int,
+		last_offset bigint,
+		PRIMARY KEY (topic, topic_partition))`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS kcp.rollup_offsets`,
+			`DROP TABLE IF EXISTS kcp.visits_hourly_seen`,
+			`DROP TABLE IF EXISTS kcp.visits_hourly`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create sessions",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS kcp.sessions(
+		ip text,
+		user_agent text,
+		started_at timestamp,
+		ended_at timestamp,
+		visits bigint,
+		PRIMARY KEY ((ip, user_agent), started_at))
+	WITH CLUSTERING ORDER BY (started_at DESC)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS kcp.sessions`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add last event id of sessions",
+		Up: []string{
+			`ALTER TABLE kcp.sessions ADD last_event_id text`,
+		},
+		Down: []string{
+			`ALTER TABLE kcp.sessions DROP last_event_id`,
+		},
+	},
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// SQL statements applying event to rollups. Executed in single transaction,
+// rollups are updated only if offset of event is after last applied offset of its partition.
+const (
+	sqlInsertOffset = `
+	INSERT OR IGNORE INTO rollup_offsets (topic, topic_partition, last_offset)
+	VALUES (?, ?, -1)`
+	sqlUpdateOffset = `
+	UPDATE rollup_offsets SET last_offset = ?
+	WHERE topic = ? AND topic_partition = ? AND last_offset < ?`
+	sqlUpsertHourly = `
+	INSERT INTO visits_hourly (hour, ip, visits, first_seen, last_seen)
+	VALUES (?, ?, 1, ?, ?)
+	ON CONFLICT (hour, ip) DO UPDATE SET
+		visits = visits + 1,
+		first_seen = min(first_seen, excluded.first_seen),
+		last_seen = max(last_seen, excluded.last_seen)`
+)
+
+// execFunc executes statement and returns number of affected rows.
+type execFunc func(stmt string, args ...interface{}) (int64, error)
+
+// applyRollup applies event to SQL rollups using exec of transaction.
+func applyRollup(exec execFunc, e kcp.Event, pos kcp.StreamPosition) error {
+	if _, err := exec(sqlInsertOffset, pos.Topic, pos.Partition); err != nil {
+		return err
+	}
+	n, err := exec(sqlUpdateOffset, pos.Offset, pos.Topic, pos.Partition, pos.Offset)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Event was already applied.
+		return nil
+	}
+
+	t := e.VisitedAt.UTC()
+	_, err = exec(sqlUpsertHourly, t.Truncate(time.Hour), e.IP, t, t)
+	return err
+}
+
+// counterRollup applies event to rollups of storage, which can not update them
+// and offset of partition in single transaction (e.g. cassandra counters).
+type counterRollup struct {
+	// lastOffset returns last applied offset of partition of pos or -1 if there is none.
+	lastOffset func(pos kcp.StreamPosition) (int64, error)
+	// update updates rollups of event.
+	update func(e kcp.Event) error
+	// moveOffset sets last applied offset of partition to offset of pos.
+	moveOffset func(pos kcp.StreamPosition) error
+}
+
+// apply applies event at stream position to rollups, if it is after last applied offset.
+// Offset is moved only after rollups are updated, so event, which failed to update them,
+// is applied again when it is retried. Event is counted twice only if moving offset fails
+// after rollups were updated.
+func (r counterRollup) apply(e kcp.Event, pos kcp.StreamPosition) error {
+	last, err := r.lastOffset(pos)
+	if err != nil {
+		return err
+	}
+	if pos.Offset <= last {
+		// Event was already applied.
+		return nil
+	}
+	if err := r.update(e); err != nil {
+		return err
+	}
+	return r.moveOffset(pos)
+}
+
+// rollupConditions returns SQLite conditions of visits_hourly matching query filters.
+// Time bounds are checked against whole hour of rollup.
+func rollupConditions(q kcp.VisitQuery) []condition {
+	var conds []condition
+	if q.IPs != nil {
+		conds = append(conds, condition{
+			expr: fmt.Sprintf("ip IN (%v)", placeholders(len(q.IPs))),
+			args: stringArgs(q.IPs),
+		})
+	}
+	if !q.From.IsZero() {
+		conds = append(conds, condition{
+			expr: "hour >= ?",
+			args: []interface{}{q.From.Time.UTC().Truncate(time.Hour)},
+		})
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, condition{
+			expr: fmt.Sprintf("hour %v ?", boundOperator(q.To, false)),
+			args: []interface{}{q.To.Time.UTC()},
+		})
+	}
+	if q.Weekdays != nil {
+		conds = append(conds, weekdaysCondition(sqlLocalTime("hour", q), q.Weekdays))
+	}
+	if q.Hours != nil {
+		conds = append(conds, hoursCondition(sqlLocalTime("hour", q), *q.Hours))
+	}
+	return conds
+}
+
+// hoursCondition returns condition matching hour of the day of local time expression.
+func hoursCondition(local condition, hours kcp.HourRange) condition {
+	hour := fmt.Sprintf("CAST(strftime('%%H', %v) AS INTEGER)", local.expr)
+	if hours.From > hours.To {
+		args := append(append([]interface{}{}, local.args...), hours.From)
+		return condition{
+			expr: fmt.Sprintf("(%v >= ? OR %v <= ?)", hour, hour),
+			args: append(append(args, local.args...), hours.To),
+		}
+	}
+	args := append(append([]interface{}{}, local.args...), hours.From, hours.To)
+	return condition{expr: fmt.Sprintf("%v BETWEEN ? AND ?", hour), args: args}
+}
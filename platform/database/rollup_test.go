@@ -0,0 +1,73 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// fakeCounters stores counters and offsets of counterRollup, first fails updates fail.
+type fakeCounters struct {
+	visits  map[string]int64
+	offsets map[int32]int64
+	fails   int
+}
+
+func (f *fakeCounters) rollup() counterRollup {
+	return counterRollup{
+		lastOffset: func(pos kcp.StreamPosition) (int64, error) {
+			if offset, ok := f.offsets[pos.Partition]; ok {
+				return offset, nil
+			}
+			return -1, nil
+		},
+		update: func(e kcp.Event) error {
+			if f.fails > 0 {
+				f.fails--
+				return errors.New("counter write timed out")
+			}
+			f.visits[e.IP]++
+			return nil
+		},
+		moveOffset: func(pos kcp.StreamPosition) error {
+			f.offsets[pos.Partition] = pos.Offset
+			return nil
+		},
+	}
+}
+
+func TestCounterRollup(t *testing.T) {
+	f := &fakeCounters{visits: make(map[string]int64), offsets: make(map[int32]int64), fails: 2}
+	r := f.rollup()
+	e := kcp.Event{IP: "1.1.1.1", VisitedAt: time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)}
+	pos := kcp.StreamPosition{Topic: "visits", Partition: 1, Offset: 5}
+
+	// Failed counter writes are retried until event is counted.
+	for i := 0; i < 2; i++ {
+		if err := r.apply(e, pos); err == nil {
+			t.Errorf("attempt %v: expected: %v, got: %v", i, "counter error", err)
+		}
+	}
+	if err := r.apply(e, pos); err != nil {
+		t.Errorf("expected: %v, got: %v", nil, err)
+	}
+	// Redelivered and older events are not counted again.
+	for _, offset := range []int64{5, 4} {
+		if err := r.apply(e, kcp.StreamPosition{Topic: "visits", Partition: 1, Offset: offset}); err != nil {
+			t.Errorf("offset %v: expected: %v, got: %v", offset, nil, err)
+		}
+	}
+	// Offset of other partition is independent.
+	if err := r.apply(e, kcp.StreamPosition{Topic: "visits", Partition: 2, Offset: 0}); err != nil {
+		t.Errorf("expected: %v, got: %v", nil, err)
+	}
+
+	if f.visits["1.1.1.1"] != 2 {
+		t.Errorf("expected: %v, got: %v", 2, f.visits["1.1.1.1"])
+	}
+	if f.offsets[1] != 5 || f.offsets[2] != 0 {
+		t.Errorf("expected: %v, got: %v", map[int32]int64{1: 5, 2: 0}, f.offsets)
+	}
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// Migration changes schema of storage from previous version to Version, Down reverts it.
+// Statements are executed one by one, so each of them must be single statement.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Migrator executes migrations on storage and records applied versions in schema_version table.
+type Migrator interface {
+	// Version returns latest applied version, 0 if no migration was applied.
+	Version() (int, error)
+	// Up executes Up statements of migration and records its version.
+	Up(Migration) error
+	// Down executes Down statements of migration and removes record of its version.
+	Down(Migration) error
+	// Unversioned returns names of tables created without migrations,
+	// which exist while schema_version table does not.
+	Unversioned() ([]string, error)
+}
+
+// ErrUnknownSchema is returned if schema of storage was migrated by newer version of kcp,
+// which knows migrations this version does not.
+var ErrUnknownSchema = errors.New("unknown newer schema")
+
+// ErrUnversionedSchema is returned if storage has tables created before migrations,
+// which are not adopted, as they may lack columns added by migrations.
+var ErrUnversionedSchema = errors.New("schema without recorded version")
+
+// Schema migrates schema of storage using migrations of its driver.
+type Schema struct {
+	migrations []Migration
+	migrator   Migrator
+}
+
+// NewSchema returns Schema of storage db opened by driver registered by name.
+func NewSchema(name string, db kcp.DbConnector) (*Schema, error) {
+	d, err := driver(name)
+	if err != nil {
+		return nil, err
+	}
+	if d.Migrator == nil {
+		return &Schema{}, nil
+	}
+	return &Schema{migrations: d.Migrations, migrator: d.Migrator(db)}, nil
+}
+
+// Migrations returns migrations of schema ordered by version.
+func (s *Schema) Migrations() []Migration {
+	return s.migrations
+}
+
+// Latest returns version of latest known migration, 0 if storage has no schema.
+func (s *Schema) Latest() int {
+	if len(s.migrations) == 0 {
+		return 0
+	}
+	return s.migrations[len(s.migrations)-1].Version
+}
+
+// Version returns version of storage schema.
+func (s *Schema) Version() (int, error) {
+	if s.migrator == nil {
+		return 0, nil
+	}
+	return s.migrator.Version()
+}
+
+// Check returns error if storage schema is not at latest known version,
+// wrapping ErrUnknownSchema if it is newer.
+func (s *Schema) Check() error {
+	v, err := s.knownVersion()
+	if err != nil {
+		return err
+	}
+	if v < s.Latest() {
+		return fmt.Errorf("schema version %v is older than %v, run kcp migrate up", v, s.Latest())
+	}
+	return nil
+}
+
+// Up applies migrations after current version up to version to, latest if to is 0.
+// Returns applied migrations, which are applied until first failure.
+// Returns error wrapping ErrUnversionedSchema if storage has tables, but no recorded version.
+func (s *Schema) Up(to int) ([]Migration, error) {
+	v, err := s.knownVersion()
+	if err != nil {
+		return nil, err
+	}
+	if v == 0 && s.migrator != nil {
+		tables, err := s.migrator.Unversioned()
+		if err != nil {
+			return nil, err
+		}
+		if len(tables) > 0 {
+			return nil, fmt.Errorf("%w: tables %v exist, drop them or move them away before kcp migrate up", ErrUnversionedSchema, strings.Join(tables, ", "))
+		}
+	}
+	if to == 0 {
+		to = s.Latest()
+	}
+	if to > s.Latest() {
+		return nil, fmt.Errorf("unknown schema version %v, latest is %v", to, s.Latest())
+	}
+
+	var applied []Migration
+	for _, m := range s.migrations {
+		if m.Version <= v || m.Version > to {
+			continue
+		}
+		if err := s.migrator.Up(m); err != nil {
+			return applied, fmt.Errorf("migration %v %v failed: %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// Down reverts steps latest applied migrations.
+// Returns reverted migrations, which are reverted until first failure.
+func (s *Schema) Down(steps int) ([]Migration, error) {
+	v, err := s.knownVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	for i := len(s.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		m := s.migrations[i]
+		if m.Version > v {
+			continue
+		}
+		if err := s.migrator.Down(m); err != nil {
+			return reverted, fmt.Errorf("migration %v %v failed to revert: %w", m.Version, m.Name, err)
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// knownVersion returns version of storage schema or error wrapping ErrUnknownSchema,
+// if it is newer than latest known migration.
+func (s *Schema) knownVersion() (int, error) {
+	v, err := s.Version()
+	if err != nil {
+		return 0, err
+	}
+	if v > s.Latest() {
+		return 0, fmt.Errorf("%w: version %v is newer than latest known %v, upgrade kcp", ErrUnknownSchema, v, s.Latest())
+	}
+	return v, nil
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchemaUpUnversioned(t *testing.T) {
+	db, closeDb, err := Connect("sqlite", Options{SQLitePath: filepath.Join(t.TempDir(), "kcp.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDb()
+	schema, err := NewSchema("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Visits table created before migrations, without columns added later.
+	legacy := `CREATE TABLE visits (id integer not null primary key, ip text, day text, visited_at TIMESTAMP)`
+	if _, err := db.(*SQLite).Exec(legacy); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := schema.Up(0)
+	if !errors.Is(err, ErrUnversionedSchema) || len(applied) != 0 {
+		t.Errorf("expected: %v, got: %v applied, %v", ErrUnversionedSchema, len(applied), err)
+	}
+
+	if _, err := db.(*SQLite).Exec(`DROP TABLE visits`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schema.Up(0); err != nil {
+		t.Fatalf("expected: %v, got: %v", nil, err)
+	}
+	// Reverted schema keeps schema_version table, so it is migrated up again.
+	if _, err := schema.Down(schema.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schema.Up(0); err != nil {
+		t.Errorf("expected: %v, got: %v", nil, err)
+	}
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// seedTopic is stream topic of seeded visits, so their rollup offsets
+// do not interfere with offsets of visits topic.
+const seedTopic = "seed"
+
+// Seed inserts sample visits from 5 ips spread over following months,
+// updates their rollups and sessions.
+func Seed(db kcp.DbConnector) error {
+	// Offsets increase with every seed, so rollups of repeated seed are updated too.
+	offset := time.Now().UnixNano()
+	var events []kcp.Event
+	for i := 0; i < 50; i++ {
+		visitedAt := time.Now().UTC().AddDate(0, i%5, i)
+		e := kcp.Event{
+			ID:        xid.New().String(),
+			IP:        "172.19.0." + fmt.Sprint(i%5),
+			VisitedAt: visitedAt,
+			Day:       visitedAt.Weekday().String(),
+		}
+		if err := db.InsertEvent(e); err != nil {
+			return err
+		}
+		// Seeded visits are not produced to stream, so rollups are updated directly.
+		pos := kcp.StreamPosition{Topic: seedTopic, Offset: offset + int64(i)}
+		if err := db.UpdateRollups(e, pos); err != nil {
+			return err
+		}
+		events = append(events, e)
+	}
+	// Sessions are computed from all events, as they are not inserted in order of visit.
+	for _, session := range kcp.Sessionize(events, kcp.DefaultSessionGap) {
+		if err := db.SaveSession(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// SQL statements of sessions table.
+const (
+	sqlUpsertSession = `
+	INSERT INTO sessions (ip, user_agent, started_at, ended_at, visits, last_event_id)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (ip, user_agent, started_at) DO UPDATE SET
+		ended_at = excluded.ended_at,
+		visits = excluded.visits,
+		last_event_id = excluded.last_event_id`
+	sqlLastSession = `
+	SELECT ip, user_agent, started_at, ended_at, visits, coalesce(last_event_id, '') FROM sessions
+	WHERE ip = ? AND user_agent = ?
+	ORDER BY started_at DESC LIMIT 1`
+)
+
+// sqlSessionArgs returns params of sqlUpsertSession.
+func sqlSessionArgs(s kcp.Session) []interface{} {
+	return []interface{}{s.IP, s.UserAgent, s.Start.UTC(), s.End.UTC(), s.Visits, s.LastID}
+}
+
+// sqlSessionsStatement returns statement and its params selecting stored sessions matching query.
+// Time bounds are checked against start of session.
+func sqlSessionsStatement(q kcp.SessionQuery) (string, []interface{}) {
+	var conds []condition
+	if q.IPs != nil {
+		conds = append(conds, condition{
+			expr: fmt.Sprintf("ip IN (%v)", placeholders(len(q.IPs))),
+			args: stringArgs(q.IPs),
+		})
+	}
+	conds = append(conds, boundConditions("started_at", q.VisitQuery)...)
+	if q.UserAgent != "" {
+		conds = append(conds, condition{
+			expr: "instr(lower(user_agent), lower(?)) > 0",
+			args: []interface{}{q.UserAgent},
+		})
+	}
+
+	stmt := "SELECT ip, user_agent, started_at, ended_at, visits, coalesce(last_event_id, '') FROM sessions"
+	where, params := joinConditions(conds)
+	if where != "" {
+		stmt = fmt.Sprintf("%v WHERE %v", stmt, where)
+	}
+	return stmt + " ORDER BY started_at ASC", params
+}
+
+// scanSessions scans rows selected by sqlSessionsStatement or sqlLastSession.
+func scanSessions(rows *sql.Rows) ([]kcp.Session, error) {
+	var sessions []kcp.Session
+	for rows.Next() {
+		var s kcp.Session
+		if err := rows.Scan(&s.IP, &s.UserAgent, &s.Start, &s.End, &s.Visits, &s.LastID); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// lastSession returns first of scanned sessions or zero Session if there are none.
+func lastSession(rows *sql.Rows) (kcp.Session, error) {
+	sessions, err := scanSessions(rows)
+	if err != nil || len(sessions) == 0 {
+		return kcp.Session{}, err
+	}
+	return sessions[0], nil
+}
+
+// sqlEventsStatement returns statement and its params selecting visits matching query
+// ordered by visited_at. Request fields of visits inserted before they were added are empty.
+func sqlEventsStatement(q kcp.VisitQuery) (string, []interface{}) {
+	stmt := `
+	SELECT coalesce(event_id, ''), ip, visited_at, coalesce(day, ''), coalesce(path, ''), coalesce(method, ''),
+		coalesce(user_agent, ''), coalesce(referrer, ''), coalesce(accept_language, ''), headers
+	FROM visits`
+	where, params := joinConditions(sqlConditions(q))
+	if where != "" {
+		stmt = fmt.Sprintf("%v WHERE %v", stmt, where)
+	}
+	return stmt + " ORDER BY visited_at ASC", params
+}
+
+// scanEvents scans rows selected by sqlEventsStatement.
+func scanEvents(rows *sql.Rows) ([]kcp.Event, error) {
+	var events []kcp.Event
+	for rows.Next() {
+		var e kcp.Event
+		var headers *string
+		if err := rows.Scan(&e.ID, &e.IP, &e.VisitedAt, &e.Day, &e.Path, &e.Method,
+			&e.UserAgent, &e.Referrer, &e.AcceptLanguage, &headers); err != nil {
+			return nil, err
+		}
+		if headers != nil {
+			if err := json.Unmarshal([]byte(*headers), &e.Headers); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
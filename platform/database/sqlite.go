@@ -2,8 +2,8 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"os"
 	"time"
 
 	// Register to sql package.
@@ -17,104 +17,326 @@ type SQLite struct {
 	*sql.DB
 }
 
-// InsertEvent inserts kcp.Event into db.
+// sqlInsertVisit inserts visit, visit with the same event id is not inserted again.
+const sqlInsertVisit = `
+	INSERT INTO visits (event_id, ip, ip_bin, visited_at, day, path, method, user_agent, referrer, accept_language, headers)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (event_id) DO NOTHING`
+
+// InsertEvent inserts kcp.Event into db, duplicate event is ignored.
 func (db *SQLite) InsertEvent(e kcp.Event) error {
-	_, err := db.Exec(
-		"INSERT INTO visits (ip, visited_at, day) VALUES (?, ?, ?)",
-		e.IP,
-		e.VisitedAt,
-		e.Day)
+	args, err := sqlVisitArgs(e)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(sqlInsertVisit, args...)
 	return err
 }
 
-// GetVisits get visits grouped by ip.
-func (db *SQLite) GetVisits() (kcp.VisitsByIP, error) {
-	rows, err := db.Query("SELECT ip, visited_at FROM visits")
+// sqlVisitArgs returns params of sqlInsertVisit.
+func sqlVisitArgs(e kcp.Event) ([]interface{}, error) {
+	headers, err := headersJSON(e.Headers)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
+	}
+	return []interface{}{
+		eventID(e),
+		e.IP,
+		ipBin(e.IP),
+		// Times are stored in UTC, as SQLite compares them as text.
+		e.VisitedAt.UTC(),
+		e.Day,
+		e.Path,
+		e.Method,
+		e.UserAgent,
+		e.Referrer,
+		e.AcceptLanguage,
+		headers,
+	}, nil
+}
+
+// headersJSON returns headers encoded as JSON object or nil if there are none.
+func headersJSON(headers map[string]string) (*string, error) {
+	if len(headers) == 0 {
 		return nil, nil
 	}
+	b, err := json.Marshal(headers)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	return &s, nil
+}
+
+// ipBin returns normalised ip stored for range queries, see kcp.NormalizeIP,
+// or nil if ip is not valid.
+func ipBin(ip string) []byte {
+	return kcp.NormalizeIP(ip)
+}
+
+// eventID returns id of event or nil if it is empty,
+// so that events without id are stored as NULL and do not conflict.
+func eventID(e kcp.Event) *string {
+	if e.ID == "" {
+		return nil
+	}
+	return &e.ID
+}
+
+// InsertEvents inserts kcp.Events into db in single transaction, duplicate events are ignored.
+func (db *SQLite) InsertEvents(events []kcp.Event) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(sqlInsertVisit)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		args, err := sqlVisitArgs(e)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetVisits get page of visits matching query grouped by ip.
+// Pages are selected using keyset pagination on visited_at and rowid.
+func (db *SQLite) GetVisits(q kcp.VisitQuery) (kcp.VisitsPage, error) {
+	q, err := sqlVisitsZoneBounds(db.QueryRow, q)
+	if err != nil {
+		fmt.Println(err)
+		return kcp.VisitsPage{}, storageError(err)
+	}
+	conds, err := sqlPageConditions(q)
+	if err != nil {
+		return kcp.VisitsPage{}, err
+	}
+
+	stmt := "SELECT rowid, ip, visited_at FROM visits"
+	where, params := joinConditions(conds)
+	if where != "" {
+		stmt = fmt.Sprintf("%v WHERE %v", stmt, where)
+	}
+	stmt = fmt.Sprintf("%v ORDER BY %v", stmt, sqlPageOrder(q))
+	if limit := sqlLimit(q); limit > 0 {
+		stmt = fmt.Sprintf("%v LIMIT ?", stmt)
+		params = append(params, limit)
+	}
 
-	var ip string
-	var t time.Time
-	visits := make(kcp.VisitsByIP)
+	rows, err := db.Query(stmt, params...)
+	if err != nil {
+		fmt.Println(err)
+		return kcp.VisitsPage{}, storageError(err)
+	}
+	defer rows.Close()
+
+	var visits []visit
 	for rows.Next() {
-		if err := rows.Scan(&ip, &t); err != nil {
+		var v visit
+		if err := rows.Scan(&v.rowID, &v.ip, &v.t); err != nil {
 			fmt.Println(err)
-			return nil, err
+			return kcp.VisitsPage{}, err
 		}
-		visits[ip] = append(visits[ip], t)
+		visits = append(visits, v)
 	}
-
-	return visits, nil
+	if err := rows.Err(); err != nil {
+		return kcp.VisitsPage{}, err
+	}
+	return sqlPage(visits, q), nil
 }
 
-// GetVisitsByIP get filtered visits by ip.
-func (db *SQLite) GetVisitsByIP(ip, day string, gt, lt time.Time) (kcp.VisitsByIP, error) {
-	var params []interface{}
-	q := fmt.Sprint(`
-	SELECT visited_at
-	FROM visits
-	WHERE ip=?
-	`)
-	params = append(params, ip)
+// UpdateRollups applies event at stream position to hourly rollups,
+// if it is after last applied position of its partition.
+func (db *SQLite) UpdateRollups(e kcp.Event, pos kcp.StreamPosition) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := applyRollup(func(stmt string, args ...interface{}) (int64, error) {
+		res, err := tx.Exec(stmt, args...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}, e, pos); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
 
-	if !gt.IsZero() {
-		q = fmt.Sprintf("%v AND visited_at > ?", q)
-		params = append(params, gt)
+// GetVisitStats get statistics of visits matching query from rollups grouped by query.
+func (db *SQLite) GetVisitStats(q kcp.StatsQuery) ([]kcp.VisitStats, error) {
+	vq, err := sqlZoneBounds(db.QueryRow, "visits_hourly", "hour", q.VisitQuery)
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
-	if !lt.IsZero() {
-		q = fmt.Sprintf("%v AND visited_at < ?", q)
-		params = append(params, lt)
+	q.VisitQuery = vq
+	stmt, params := sqlStatsStatement(q)
+	rows, err := db.Query(stmt, params...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
-	if day != "" {
-		q = fmt.Sprintf("%v AND day = ?", q)
-		params = append(params, day)
+	defer rows.Close()
+	return scanStats(rows, q.GroupBy)
+}
+
+// GetEvents get visit events matching query ordered by visited_at.
+func (db *SQLite) GetEvents(q kcp.VisitQuery) ([]kcp.Event, error) {
+	q, err := sqlVisitsZoneBounds(db.QueryRow, q)
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
+	}
+	stmt, params := sqlEventsStatement(q)
+	rows, err := db.Query(stmt, params...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
 
-	rows, err := db.Query(q, params...)
+// GetSessions get stored sessions matching query ordered by start.
+func (db *SQLite) GetSessions(q kcp.SessionQuery) ([]kcp.Session, error) {
+	stmt, params := sqlSessionsStatement(q)
+	rows, err := db.Query(stmt, params...)
 	if err != nil {
-		return nil, err
+		fmt.Println(err)
+		return nil, storageError(err)
 	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
 
-	var t time.Time
-	visits := make(kcp.VisitsByIP)
-	for rows.Next() {
-		if err := rows.Scan(&t); err != nil {
-			return nil, err
-		}
-		visits[ip] = append(visits[ip], t)
+// LastSession get latest stored session of ip and user agent or zero Session if there is none.
+func (db *SQLite) LastSession(ip, userAgent string) (kcp.Session, error) {
+	rows, err := db.Query(sqlLastSession, ip, userAgent)
+	if err != nil {
+		return kcp.Session{}, err
 	}
-	return visits, nil
+	defer rows.Close()
+	return lastSession(rows)
+}
+
+// SaveSession inserts session or updates stored one with same ip, user agent and start.
+func (db *SQLite) SaveSession(s kcp.Session) error {
+	_, err := db.Exec(sqlUpsertSession, sqlSessionArgs(s)...)
+	return err
 }
 
-// SQLiteConn returns connection to SQLite db or an error
-func SQLiteConn() (*sql.DB, error) {
-	os.Remove("./kcp.db")
+func init() {
+	Register("sqlite", Driver{
+		Open: func(o Options) (kcp.DbConnector, func() error, error) {
+			db, err := SQLiteConn(o.SQLitePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &SQLite{DB: db}, db.Close, nil
+		},
+		Migrations: sqliteMigrations,
+		Migrator: func(db kcp.DbConnector) Migrator {
+			return sqliteMigrator{db.(*SQLite).DB}
+		},
+	})
+}
 
-	db, err := sql.Open("sqlite3", "./kcp.db")
+// SQLiteConn returns connection to SQLite db at path or an error.
+// Schema is migrated by sqlite Driver.
+func SQLiteConn(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
-	if err := initSQLite(db); err != nil {
+	return db, nil
+}
+
+// sqliteMigrator executes migrations of SQLite db in transaction.
+type sqliteMigrator struct {
+	*sql.DB
+}
+
+// Version returns latest applied version, 0 if schema_version table does not exist.
+func (db sqliteMigrator) Version() (int, error) {
+	var tables int
+	if err := db.QueryRow(`
+	SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`,
+	).Scan(&tables); err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow(`SELECT coalesce(max(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// Unversioned returns names of tables, if schema_version table does not exist.
+func (db sqliteMigrator) Unversioned() ([]string, error) {
+	rows, err := db.Query(`
+	SELECT name FROM sqlite_master
+	WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+	AND NOT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version')
+	ORDER BY name`)
+	if err != nil {
 		return nil, err
 	}
-	return db, nil
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
 }
 
-func initSQLite(db *sql.DB) error {
-	sqlStmt := `
-	CREATE TABLE visits (
-		id integer not null primary key,
-		ip text,
-		day text,
-		visited_at TIMESTAMP
-		);`
-	if _, err := db.Exec(sqlStmt); err != nil {
-		fmt.Println(sqlStmt)
-		fmt.Println(err)
+// Up executes Up statements of migration and records its version.
+func (db sqliteMigrator) Up(m Migration) error {
+	return db.migrate(m.Up, `
+	INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.Version, m.Name, time.Now().UTC())
+}
+
+// Down executes Down statements of migration and removes record of its version.
+func (db sqliteMigrator) Down(m Migration) error {
+	return db.migrate(m.Down, `
+	DELETE FROM schema_version WHERE version = ?`,
+		m.Version)
+}
+
+// migrate executes statements and then record statement with args in single transaction,
+// schema_version table is created if it does not exist.
+func (db sqliteMigrator) migrate(statements []string, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range append([]string{sqlCreateSchemaVersion}, statements...) {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
 		return err
 	}
-	return nil
+	return tx.Commit()
 }
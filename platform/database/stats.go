@@ -0,0 +1,144 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// sqlGroupExpr returns SQLite expression of group of visits_hourly rollup and its params.
+// Rollup hour is converted to query time zone, whole hour of rollup is assigned to
+// group of its start in time zones with offsets not in whole hours.
+func sqlGroupExpr(q kcp.StatsQuery) condition {
+	local := sqlLocalTime("hour", q.VisitQuery)
+	switch q.GroupBy {
+	case kcp.GroupByHour:
+		return condition{expr: fmt.Sprintf("strftime('%%H', %v)", local.expr), args: local.args}
+	case kcp.GroupByWeekday:
+		return condition{expr: fmt.Sprintf("strftime('%%w', %v)", local.expr), args: local.args}
+	case kcp.GroupByIP:
+		return condition{expr: "ip"}
+	default:
+		return condition{expr: fmt.Sprintf("date(%v)", local.expr), args: local.args}
+	}
+}
+
+// sqlStatsStatement returns statement and its params selecting stats from visits_hourly rollups.
+func sqlStatsStatement(q kcp.StatsQuery) (string, []interface{}) {
+	group := sqlGroupExpr(q)
+	stmt := fmt.Sprintf(`
+	SELECT %v AS grp, SUM(visits), COUNT(DISTINCT ip), MIN(first_seen), MAX(last_seen)
+	FROM visits_hourly`, group.expr)
+	where, params := joinConditions(rollupConditions(q.VisitQuery))
+	params = append(append([]interface{}{}, group.args...), params...)
+	if where != "" {
+		stmt = fmt.Sprintf("%v WHERE %v", stmt, where)
+	}
+	return fmt.Sprintf("%v GROUP BY grp ORDER BY grp", stmt), params
+}
+
+// scanStats scans rows selected by sqlStatsStatement.
+func scanStats(rows *sql.Rows, g kcp.GroupBy) ([]kcp.VisitStats, error) {
+	stats := []kcp.VisitStats{}
+	for rows.Next() {
+		var s kcp.VisitStats
+		var first, last string
+		if err := rows.Scan(&s.Group, &s.Visits, &s.UniqueIPs, &first, &last); err != nil {
+			return nil, err
+		}
+		var err error
+		if s.FirstSeen, err = parseSQLiteTime(first); err != nil {
+			return nil, err
+		}
+		if s.LastSeen, err = parseSQLiteTime(last); err != nil {
+			return nil, err
+		}
+		if g == kcp.GroupByWeekday {
+			day, err := strconv.Atoi(s.Group)
+			if err != nil {
+				return nil, err
+			}
+			s.Group = time.Weekday(day).String()
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// parseSQLiteTime parses time stored by sqlite3 driver,
+// which is returned as string by aggregate functions.
+func parseSQLiteTime(s string) (time.Time, error) {
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unexpected time format %q", s)
+}
+
+// statsAggregator aggregates visit stats in memory.
+type statsAggregator struct {
+	groupBy kcp.GroupBy
+	groups  map[string]*kcp.VisitStats
+	ips     map[string]map[string]struct{}
+}
+
+func newStatsAggregator(g kcp.GroupBy) *statsAggregator {
+	return &statsAggregator{
+		groupBy: g,
+		groups:  make(map[string]*kcp.VisitStats),
+		ips:     make(map[string]map[string]struct{}),
+	}
+}
+
+// add adds number of visits from ip seen between first and last to group.
+func (a *statsAggregator) add(group, ip string, visits int64, first, last time.Time) {
+	s, ok := a.groups[group]
+	if !ok {
+		s = &kcp.VisitStats{Group: group, FirstSeen: first, LastSeen: last}
+		a.groups[group] = s
+		a.ips[group] = make(map[string]struct{})
+	}
+	s.Visits += visits
+	if first.Before(s.FirstSeen) {
+		s.FirstSeen = first
+	}
+	if last.After(s.LastSeen) {
+		s.LastSeen = last
+	}
+	if _, ok := a.ips[group][ip]; !ok {
+		a.ips[group][ip] = struct{}{}
+		s.UniqueIPs++
+	}
+}
+
+// stats returns aggregated stats ordered by group,
+// weekdays are ordered from Sunday.
+func (a *statsAggregator) stats() []kcp.VisitStats {
+	stats := []kcp.VisitStats{}
+	for _, s := range a.groups {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if a.groupBy == kcp.GroupByWeekday {
+			return weekdayIndex(stats[i].Group) < weekdayIndex(stats[j].Group)
+		}
+		return stats[i].Group < stats[j].Group
+	})
+	return stats
+}
+
+func weekdayIndex(day string) int {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if d.String() == day {
+			return int(d)
+		}
+	}
+	return -1
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// zoneHorizon is time after now until which offsets of time zone are selected if query has no upper bound.
+// Visits are stored at time they happen, so later times are not expected.
+const zoneHorizon = time.Hour * 24
+
+// zoneOffset is offset from UTC in seconds of time zone, which is in effect until given time.
+type zoneOffset struct {
+	until  time.Time
+	offset int
+}
+
+// zoneOffsets returns offsets of loc in effect between from and to ordered by time.
+// Last offset has zero until, as it is in effect after to.
+func zoneOffsets(loc *time.Location, from, to time.Time) []zoneOffset {
+	var offsets []zoneOffset
+	_, offset := from.In(loc).Zone()
+	for day := from.Unix(); day < to.Unix(); {
+		next := day + 24*60*60
+		if _, o := time.Unix(next, 0).In(loc).Zone(); o == offset {
+			day = next
+			continue
+		}
+
+		// Offset changed during the day, find first second of new offset.
+		lo, hi := day, next
+		for hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+			if _, o := time.Unix(mid, 0).In(loc).Zone(); o == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		offsets = append(offsets, zoneOffset{until: time.Unix(hi, 0).UTC(), offset: offset})
+		_, offset = time.Unix(hi, 0).In(loc).Zone()
+		day = hi
+	}
+	return append(offsets, zoneOffset{offset: offset})
+}
+
+// sqlLocalTime returns SQLite expression of UTC time in column converted to query time zone.
+// Offset of time zone changes (e.g. for daylight saving time), so offset is selected
+// by comparing column with times of changes between query time bounds.
+// Column is returned as is if query time zone is UTC. Missing lower bound is expected
+// to be set by sqlZoneBounds, otherwise every change since 1970 is selected.
+// Missing upper bound selects changes until zoneHorizon after now.
+func sqlLocalTime(column string, q kcp.VisitQuery) condition {
+	if q.IsUTC() {
+		return condition{expr: column}
+	}
+
+	from, to := q.From.Time, q.To.Time
+	if from.IsZero() {
+		from = time.Unix(0, 0)
+	}
+	if to.IsZero() {
+		to = time.Now().Add(zoneHorizon)
+	}
+	offsets := zoneOffsets(q.Loc(), from, to)
+	if len(offsets) == 1 {
+		return condition{expr: fmt.Sprintf("datetime(%v, ?)", column), args: []interface{}{sqlModifier(offsets[0].offset)}}
+	}
+
+	var expr strings.Builder
+	var args []interface{}
+	fmt.Fprintf(&expr, "datetime(%v, CASE", column)
+	for _, o := range offsets[:len(offsets)-1] {
+		fmt.Fprintf(&expr, " WHEN %v < ? THEN ?", column)
+		args = append(args, o.until, sqlModifier(o.offset))
+	}
+	expr.WriteString(" ELSE ? END)")
+	args = append(args, sqlModifier(offsets[len(offsets)-1].offset))
+	return condition{expr: expr.String(), args: args}
+}
+
+// queryRowFunc executes statement selecting single row.
+type queryRowFunc func(stmt string, args ...interface{}) *sql.Row
+
+// sqlZoneBounds returns query with missing lower time bound set to first time in column
+// of table if query time zone is not UTC, so sqlLocalTime selects only offsets in effect
+// since first stored time. Bound is inclusive, so it does not exclude stored rows,
+// and is not set if table is empty. Upper bound is kept as is, so rows stored
+// while query runs are not excluded by last stored time.
+func sqlZoneBounds(queryRow queryRowFunc, table, column string, q kcp.VisitQuery) (kcp.VisitQuery, error) {
+	if q.IsUTC() || !q.From.IsZero() {
+		return q, nil
+	}
+	var first sql.NullString
+	stmt := fmt.Sprintf("SELECT min(%v) FROM %v", column, table)
+	if err := queryRow(stmt).Scan(&first); err != nil {
+		return kcp.VisitQuery{}, err
+	}
+	if !first.Valid {
+		return q, nil
+	}
+	from, err := parseSQLiteTime(first.String)
+	if err != nil {
+		return kcp.VisitQuery{}, err
+	}
+	q.From = kcp.TimeBound{Time: from, Inclusive: true}
+	return q, nil
+}
+
+// sqlVisitsZoneBounds returns query with bounds set by sqlZoneBounds,
+// if visited_at is converted to local time by day or hour filters.
+func sqlVisitsZoneBounds(queryRow queryRowFunc, q kcp.VisitQuery) (kcp.VisitQuery, error) {
+	if q.Weekdays == nil && q.Hours == nil {
+		return q, nil
+	}
+	return sqlZoneBounds(queryRow, "visits", "visited_at", q)
+}
+
+// sqlModifier returns SQLite date modifier adding offset in seconds.
+func sqlModifier(offset int) string {
+	return fmt.Sprintf("%+d seconds", offset)
+}
+
+// weekdaysCondition returns condition matching day of the week of local time expression.
+func weekdaysCondition(local condition, weekdays []time.Weekday) condition {
+	var days []string
+	for _, d := range weekdays {
+		days = append(days, strconv.Itoa(int(d)))
+	}
+	return condition{
+		expr: fmt.Sprintf("strftime('%%w', %v) IN (%v)", local.expr, placeholders(len(days))),
+		args: append(append([]interface{}{}, local.args...), stringArgs(days)...),
+	}
+}
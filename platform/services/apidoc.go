@@ -0,0 +1,175 @@
+package services
+
+import (
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// ref returns schema referring to component schema of OpenAPI document.
+func ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// intPtr returns pointer to n, e.g. for Schema.Minimum.
+func intPtr(n int) *int {
+	return &n
+}
+
+var (
+	stringSchema  = &Schema{Type: "string"}
+	timeSchema    = &Schema{Type: "string", Format: "date-time"}
+	integerSchema = &Schema{Type: "integer", Format: "int64"}
+	numberSchema  = &Schema{Type: "number", Format: "double"}
+	weekdays      = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+)
+
+// schemas are component schemas of OpenAPI document.
+var schemas = map[string]*Schema{
+	"Problem": {
+		Type:        "object",
+		Description: "Error response as defined by RFC 7807",
+		Properties: map[string]*Schema{
+			"type":       stringSchema,
+			"title":      stringSchema,
+			"status":     {Type: "integer"},
+			"detail":     stringSchema,
+			"instance":   stringSchema,
+			"param":      {Type: "string", Description: "Query parameter, which failed validation"},
+			"request_id": stringSchema,
+		},
+		Required: []string{"type", "title", "status"},
+	},
+	"VisitsPage": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"visits": {
+				Type:                 "object",
+				Description:          "Times of visits by ip",
+				AdditionalProperties: &Schema{Type: "array", Items: timeSchema},
+			},
+			"next_cursor": {Type: "string", Description: "Cursor of next page, empty on last page"},
+		},
+		Required: []string{"visits"},
+	},
+	"VisitStats": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"group":      stringSchema,
+			"visits":     integerSchema,
+			"unique_ips": integerSchema,
+			"first_seen": timeSchema,
+			"last_seen":  timeSchema,
+		},
+		Required: []string{"group", "visits", "unique_ips", "first_seen", "last_seen"},
+	},
+	"Session": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"ip":         stringSchema,
+			"user_agent": stringSchema,
+			"start":      timeSchema,
+			"end":        timeSchema,
+			"duration":   {Type: "number", Format: "double", Description: "Duration in seconds"},
+			"visits":     integerSchema,
+		},
+		Required: []string{"ip", "start", "end", "duration", "visits"},
+	},
+	"SessionStats": {
+		Type:        "object",
+		Description: "Aggregates of sessions, durations are in seconds",
+		Properties: map[string]*Schema{
+			"sessions":     integerSchema,
+			"visits":       integerSchema,
+			"unique_ips":   integerSchema,
+			"bounces":      integerSchema,
+			"avg_visits":   numberSchema,
+			"avg_duration": numberSchema,
+			"max_duration": numberSchema,
+		},
+		Required: []string{"sessions", "visits", "unique_ips", "bounces", "avg_visits", "avg_duration", "max_duration"},
+	},
+	"SessionsPage": {
+		Type: "object",
+		Properties: map[string]*Schema{
+			"sessions": {Type: "array", Items: ref("Session")},
+			"stats":    ref("SessionStats"),
+		},
+		Required: []string{"sessions", "stats"},
+	},
+	"VisitedPage": {
+		Type:        "object",
+		Description: "Visited page, query parameters are used if both are set",
+		Properties: map[string]*Schema{
+			"path":   {Type: "string", Description: "Absolute path or url of page, query and fragment are dropped"},
+			"method": {Type: "string", Description: "Request method of page, GET by default"},
+		},
+	},
+	"UploadedImage": {
+		Type:       "object",
+		Properties: map[string]*Schema{"filename": stringSchema},
+		Required:   []string{"filename"},
+	},
+}
+
+// queryParam returns optional query parameter.
+func queryParam(name, description string, schema *Schema) Param {
+	return Param{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+// arrayParam returns query parameter, which can be repeated or comma separated.
+func arrayParam(name, description string, items *Schema) Param {
+	return queryParam(name, description+", can be repeated or comma separated", &Schema{Type: "array", Items: items})
+}
+
+// requiredPathParam returns required path parameter.
+func requiredPathParam(name, description string, schema *Schema) Param {
+	return Param{Name: name, In: "path", Description: description, Required: true, Schema: schema}
+}
+
+const timeParamDescription = "date yyyy-mm-dd containing at least year, RFC 3339 timestamp, " +
+	"Unix epoch seconds or time relative to now, e.g. now-1h"
+
+// visitParams are query parameters parsed by kcp.ParseVisitQuery.
+var visitParams = []Param{
+	arrayParam(kcp.ParamIP, "IP of visit", stringSchema),
+	queryParam(kcp.ParamTimeZone, "IANA time zone of dates, days and hours, UTC by default", stringSchema),
+	queryParam(kcp.ParamGt, "Visited after time, "+timeParamDescription, stringSchema),
+	queryParam(kcp.ParamLt, "Visited before time, "+timeParamDescription, stringSchema),
+	queryParam(kcp.ParamGte, "Visited at or after time, can not be combined with gt", stringSchema),
+	queryParam(kcp.ParamLte, "Visited at or before time, can not be combined with lt", stringSchema),
+	arrayParam(kcp.ParamDay, "Day of the week", &Schema{Type: "string", Enum: weekdays}),
+	queryParam(kcp.ParamHourFrom, "First hour of the day, inclusive", &Schema{Type: "integer", Minimum: intPtr(0), Maximum: intPtr(23)}),
+	queryParam(kcp.ParamHourTo, "Last hour of the day, inclusive", &Schema{Type: "integer", Minimum: intPtr(0), Maximum: intPtr(23)}),
+	arrayParam(kcp.ParamPath, "Request path, matches prefix if it ends with *", stringSchema),
+	arrayParam(kcp.ParamMethod, "Request method", stringSchema),
+	queryParam(kcp.ParamReferrer, "Referrer of request, can be repeated, matches prefix if it ends with *", &Schema{Type: "array", Items: stringSchema}),
+	queryParam(kcp.ParamUserAgent, "Part of user agent, case insensitive", stringSchema),
+	queryParam(kcp.ParamLimit, "Max number of visits in page", &Schema{Type: "integer", Minimum: intPtr(0)}),
+	queryParam(kcp.ParamOrder, "Order by visited_at", &Schema{Type: "string", Enum: []string{string(kcp.OrderAsc), string(kcp.OrderDesc)}}),
+	queryParam(kcp.ParamCursor, "Cursor of next page, requires limit", stringSchema),
+}
+
+// postVisitParams are query parameters of visit tracking request.
+var postVisitParams = []Param{
+	queryParam(kcp.ParamPath, "Absolute path or url of visited page, Referer header path by default", stringSchema),
+	queryParam(kcp.ParamMethod, "Request method of visited page, GET by default", stringSchema),
+}
+
+// withParams returns visitParams followed by params.
+func withParams(params ...Param) []Param {
+	return append(append([]Param{}, visitParams...), params...)
+}
+
+var (
+	networkParams = withParams(arrayParam(kcp.ParamCIDR, "CIDR network of visit ip", stringSchema))
+	statsParams   = withParams(queryParam(kcp.ParamGroupBy, "Grouping of stats, day by default", &Schema{
+		Type: "string",
+		Enum: []string{string(kcp.GroupByDay), string(kcp.GroupByHour), string(kcp.GroupByWeekday), string(kcp.GroupByIP)},
+	}))
+	sessionParams = withParams(
+		queryParam(kcp.ParamGap, "Inactivity gap of sessions computed from visits, e.g. 30m", stringSchema),
+		queryParam(kcp.ParamSource, "Source of sessions, visits by default", &Schema{
+			Type: "string",
+			Enum: []string{string(kcp.SourceVisits), string(kcp.SourceStream)},
+		}),
+	)
+)
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPResolver resolves ip of client that made request.
+// Forwarding headers are used only if request came from trusted proxy,
+// otherwise ip of remote address is returned.
+type ClientIPResolver struct {
+	TrustedProxies []*net.IPNet
+}
+
+// NewClientIPResolver returns resolver trusting proxies in given CIDRs.
+// Single ip without prefix length is trusted as /32 or /128.
+func NewClientIPResolver(proxies []string) (ClientIPResolver, error) {
+	var res ClientIPResolver
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return ClientIPResolver{}, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			res.TrustedProxies = append(res.TrustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return ClientIPResolver{}, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		res.TrustedProxies = append(res.TrustedProxies, n)
+	}
+	return res, nil
+}
+
+// ClientIP returns ip of client that made request.
+//
+// If remote address is trusted proxy, client ip is taken from first present header of:
+//  * Forwarded (RFC 7239) - for parameters
+//  * X-Forwarded-For - comma separated list of addresses
+//  * X-Real-IP - single address
+//
+// Forwarded and X-Forwarded-For lists are walked from right to left skipping trusted
+// proxies, so client can not spoof its ip by adding addresses to the header.
+// Returned ip is in canonical form without port, ipv4 mapped ipv6 addresses
+// are returned as ipv4. If remote address is not an ip it is returned as is.
+func (res ClientIPResolver) ClientIP(r *http.Request) string {
+	remote := parseIP(r.RemoteAddr)
+	if remote == nil {
+		return r.RemoteAddr
+	}
+	if !res.trusted(remote) {
+		return remote.String()
+	}
+
+	if v := r.Header.Values("Forwarded"); len(v) > 0 {
+		return res.fromChain(forwardedFor(v), remote).String()
+	}
+	if v := r.Header.Values("X-Forwarded-For"); len(v) > 0 {
+		return res.fromChain(splitHeader(v), remote).String()
+	}
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return remote.String()
+}
+
+// fromChain returns rightmost address of chain that is not trusted proxy.
+// If all addresses are trusted the leftmost one is returned.
+// Walk stops at address that is not an ip (e.g. obfuscated identifier),
+// last valid address is returned then.
+func (res ClientIPResolver) fromChain(chain []string, remote net.IP) net.IP {
+	ip := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		next := parseIP(chain[i])
+		if next == nil {
+			break
+		}
+		ip = next
+		if !res.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (res ClientIPResolver) trusted(ip net.IP) bool {
+	for _, n := range res.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns values of for parameters of Forwarded header elements.
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, elem := range splitHeader(values) {
+		for _, pair := range strings.Split(elem, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				chain = append(chain, strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+	return chain
+}
+
+// splitHeader splits comma separated header values.
+func splitHeader(values []string) []string {
+	var res []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			res = append(res, strings.TrimSpace(s))
+		}
+	}
+	return res
+}
+
+// parseIP parses ip that may have port, be in brackets or have ipv6 zone.
+// Returns nil if addr is not an ip.
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	type test struct {
+		proxies []string
+		remote  string
+		headers map[string][]string
+		ip      string
+	}
+
+	trusted := []string{"10.0.0.0/8", "fd00::/8", "192.168.1.1"}
+	tests := map[string]test{
+		"ipv4 with port":               {remote: "1.1.1.1:1234", ip: "1.1.1.1"},
+		"ipv4 without port":            {remote: "1.1.1.1", ip: "1.1.1.1"},
+		"ipv6 with port":               {remote: "[2001:db8::1]:1234", ip: "2001:db8::1"},
+		"ipv6 without port":            {remote: "2001:db8::1", ip: "2001:db8::1"},
+		"ipv6 in brackets":             {remote: "[2001:db8::1]", ip: "2001:db8::1"},
+		"ipv6 non canonical":           {remote: "[2001:DB8:0:0::1]:1234", ip: "2001:db8::1"},
+		"ipv6 with zone":               {remote: "[fe80::1%eth0]:1234", ip: "fe80::1"},
+		"ipv4 mapped ipv6":             {remote: "[::ffff:1.1.1.1]:1234", ip: "1.1.1.1"},
+		"remote not ip":                {remote: "pipe", ip: "pipe"},
+		"no trusted proxies":           {remote: "10.0.0.1:1234", headers: map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, ip: "10.0.0.1"},
+		"spoofed xff untrusted remote": {proxies: trusted, remote: "2.2.2.2:1234", headers: map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, ip: "2.2.2.2"},
+		"spoofed real ip untrusted":    {proxies: trusted, remote: "2.2.2.2:1234", headers: map[string][]string{"X-Real-Ip": {"1.1.1.1"}}, ip: "2.2.2.2"},
+		"xff single hop":               {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, ip: "1.1.1.1"},
+		"xff trusted hops skipped": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"X-Forwarded-For": {"1.1.1.1, 2.2.2.2, 192.168.1.1", "10.0.0.2"},
+		}, ip: "2.2.2.2"},
+		"xff spoofed by client": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"X-Forwarded-For": {"10.0.0.3, 2.2.2.2, 10.0.0.2"},
+		}, ip: "2.2.2.2"},
+		"xff all trusted":   {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, ip: "10.0.0.3"},
+		"xff ipv6 hops":     {proxies: trusted, remote: "[fd00::1]:1234", headers: map[string][]string{"X-Forwarded-For": {"2001:db8::1, fd00::2"}}, ip: "2001:db8::1"},
+		"xff with ports":    {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{"X-Forwarded-For": {"[2001:db8::1]:4711, 10.0.0.2:80"}}, ip: "2001:db8::1"},
+		"xff invalid entry": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{"X-Forwarded-For": {"1.1.1.1, garbage, 10.0.0.2"}}, ip: "10.0.0.2"},
+		"real ip":           {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{"X-Real-Ip": {"1.1.1.1"}}, ip: "1.1.1.1"},
+		"forwarded before xff": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"Forwarded":       {"for=1.1.1.1"},
+			"X-Forwarded-For": {"2.2.2.2"},
+		}, ip: "1.1.1.1"},
+		"forwarded quoted ipv6": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"Forwarded": {`for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`},
+		}, ip: "2001:db8::1"},
+		"forwarded parameters case": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"Forwarded": {"proto=http;For=1.1.1.1;by=10.0.0.1"},
+		}, ip: "1.1.1.1"},
+		"forwarded obfuscated client": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"Forwarded": {"for=_hidden, for=10.0.0.2"},
+		}, ip: "10.0.0.2"},
+		"forwarded unknown client": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"Forwarded": {"for=unknown"},
+		}, ip: "10.0.0.1"},
+		"forwarded unknown hop": {proxies: trusted, remote: "10.0.0.1:1234", headers: map[string][]string{
+			"Forwarded": {"for=1.1.1.1, for=unknown, for=10.0.0.2"},
+		}, ip: "10.0.0.2"},
+		"forwarded spoofed untrusted": {proxies: trusted, remote: "2.2.2.2:1234", headers: map[string][]string{
+			"Forwarded": {"for=1.1.1.1"},
+		}, ip: "2.2.2.2"},
+	}
+
+	for name, tt := range tests {
+		res, err := NewClientIPResolver(tt.proxies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/api/visits", nil)
+		r.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			r.Header[k] = v
+		}
+		if got := res.ClientIP(r); got != tt.ip {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.ip, got)
+		}
+	}
+}
+
+func TestNewClientIPResolver(t *testing.T) {
+	type test struct {
+		proxies []string
+		valid   bool
+	}
+
+	tests := map[string]test{
+		"empty":        {proxies: nil, valid: true},
+		"cidrs":        {proxies: []string{"10.0.0.0/8", "fd00::/8"}, valid: true},
+		"single ips":   {proxies: []string{"192.168.1.1", "::1"}, valid: true},
+		"invalid ip":   {proxies: []string{"192.168.1"}, valid: false},
+		"invalid cidr": {proxies: []string{"10.0.0.0/33"}, valid: false},
+	}
+
+	for name, tt := range tests {
+		if _, err := NewClientIPResolver(tt.proxies); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid: %v, got: %v", name, tt.valid, err)
+		}
+	}
+}
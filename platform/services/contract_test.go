@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// stubHandler returns err or fixed results and records ip of last GetVisitsByIP call.
+type stubHandler struct {
+	err error
+	ip  string
+}
+
+var stubTime = time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+
+func (h *stubHandler) ProduceVisit(r kcp.VisitRequest) error {
+	return h.err
+}
+
+func (h *stubHandler) GetVisits(q kcp.VisitQuery) (kcp.VisitsPage, error) {
+	return kcp.VisitsPage{Visits: kcp.VisitsByIP{"1.1.1.1": {stubTime}}}, h.err
+}
+
+func (h *stubHandler) GetVisitsByIP(ip string, q kcp.VisitQuery) (kcp.VisitsPage, error) {
+	h.ip = ip
+	return kcp.VisitsPage{Visits: kcp.VisitsByIP{ip: {stubTime}}}, h.err
+}
+
+func (h *stubHandler) GetVisitsByNetworks(cidrs []string, q kcp.VisitQuery) (kcp.VisitsPage, error) {
+	return kcp.VisitsPage{Visits: kcp.VisitsByIP{"10.0.0.1": {stubTime}}}, h.err
+}
+
+func (h *stubHandler) GetVisitStats(q kcp.StatsQuery) ([]kcp.VisitStats, error) {
+	return []kcp.VisitStats{{Group: "2021-01-01", Visits: 1, UniqueIPs: 1, FirstSeen: stubTime, LastSeen: stubTime}}, h.err
+}
+
+func (h *stubHandler) GetSessions(q kcp.SessionQuery) (kcp.SessionsPage, error) {
+	s := kcp.Session{IP: "1.1.1.1", Start: stubTime, End: stubTime, Visits: 1}
+	return kcp.SessionsPage{Sessions: []kcp.Session{s}, Stats: kcp.SummarizeSessions([]kcp.Session{s})}, h.err
+}
+
+// response is part of recorded response, which must be same for every router.
+type response struct {
+	status      int
+	contentType string
+	requestID   string
+	body        string
+}
+
+func serve(router http.Handler, method, target string) response {
+	r := httptest.NewRequest(method, target, &bytes.Buffer{})
+	r.Header.Set(RequestIDHeader, "request-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return response{
+		status:      w.Code,
+		contentType: w.Header().Get("Content-Type"),
+		requestID:   w.Header().Get(RequestIDHeader),
+		body:        w.Body.String(),
+	}
+}
+
+func TestRoutersContract(t *testing.T) {
+	type test struct {
+		name   string
+		method string
+		target string
+		err    error
+		status int
+	}
+
+	tests := []test{
+		{name: "post visit", method: "POST", target: "/api/visits", status: 200},
+		{name: "post visit unavailable", method: "POST", target: "/api/visits", err: kcp.ErrUnavailable, status: 503},
+		{name: "post visit page", method: "POST", target: "/api/visits?path=%2Fpricing&method=GET", status: 200},
+		{name: "post visit unknown parameter", method: "POST", target: "/api/visits?page=%2Fpricing", status: 400},
+		{name: "get visits", method: "GET", target: "/api/visits?limit=1", status: 200},
+		{name: "get visits invalid filter", method: "GET", target: "/api/visits?gt=abc", status: 400},
+		{name: "get visits error", method: "GET", target: "/api/visits", err: fmt.Errorf("db failed"), status: 500},
+		{name: "get visits by ip", method: "GET", target: "/api/visits/1.1.1.1", status: 200},
+		{name: "get visits by ip not found", method: "GET", target: "/api/visits/1.1.1.1", err: kcp.ErrNotFound, status: 404},
+		{name: "get visits by networks", method: "GET", target: "/api/networks/visits?cidr=10.0.0.0/8", status: 200},
+		{name: "get visit stats", method: "GET", target: "/api/stats/visits?group_by=day", status: 200},
+		{name: "get visit stats invalid group", method: "GET", target: "/api/stats/visits?group_by=year", status: 400},
+		{name: "get sessions", method: "GET", target: "/api/sessions", status: 200},
+		{name: "get sessions unavailable", method: "GET", target: "/api/sessions", err: kcp.ErrUnavailable, status: 503},
+		{name: "upload image without file", method: "POST", target: "/api/upload-image", status: 400},
+		{name: "load image invalid name", method: "GET", target: "/api/load-image/cat.gif", status: 404},
+		{name: "load missing image", method: "GET", target: "/api/load-image/00000000000000000000.png", status: 404},
+		{name: "get visits unknown parameter", method: "GET", target: "/api/visits?from=2020", status: 400},
+		{name: "get visits malformed parameter", method: "GET", target: "/api/visits?limit=ten", status: 400},
+		{name: "get openapi", method: "GET", target: "/api/openapi.json", status: 200},
+		{name: "unknown route", method: "GET", target: "/api/unknown", status: 404},
+		{name: "method not allowed", method: "DELETE", target: "/api/visits", status: 405},
+	}
+
+	for _, tt := range tests {
+		ginStub, muxStub := &stubHandler{err: tt.err}, &stubHandler{err: tt.err}
+		got := serve(GinRoutes(ginStub, ClientIPResolver{}), tt.method, tt.target)
+		want := serve(SetRoutes(muxStub, ClientIPResolver{}), tt.method, tt.target)
+		if got != want {
+			t.Errorf("%s: expected: %+v, got: %+v", tt.name, want, got)
+		}
+		if got.status != tt.status {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, tt.status, got.status)
+		}
+		if got.requestID != "request-1" {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, "request-1", got.requestID)
+		}
+		if ginStub.ip != muxStub.ip {
+			t.Errorf("%s: expected: %v, got: %v", tt.name, muxStub.ip, ginStub.ip)
+		}
+	}
+
+	// Every route must be covered by contract.
+	for _, route := range Routes(&stubHandler{}, ClientIPResolver{}) {
+		path := regexp.MustCompile("^" + routeParam.ReplaceAllString(route.Path, "[^/?]+") + `(\?|$)`)
+		var covered bool
+		for _, tt := range tests {
+			if tt.method == route.Method && path.MatchString(tt.target) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			t.Errorf("%s %s: expected route to be covered by contract", route.Method, route.Path)
+		}
+	}
+}
+
+func TestRoutersPathParam(t *testing.T) {
+	for _, name := range Routers() {
+		stub := &stubHandler{}
+		router, err := NewRouter(name, stub, ClientIPResolver{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		serve(router, "GET", "/api/visits/2001:db8::1")
+		if stub.ip != "2001:db8::1" {
+			t.Errorf("%s: expected: %v, got: %v", name, "2001:db8::1", stub.ip)
+		}
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	if got := Routers(); !reflect.DeepEqual(got, []string{"gin", "mux"}) {
+		t.Errorf("expected: %v, got: %v", []string{"gin", "mux"}, got)
+	}
+	if _, err := NewRouter("chi", &stubHandler{}, ClientIPResolver{}); err == nil {
+		t.Errorf("expected: %v, got: %v", "unknown router error", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	type test struct {
+		header string
+		keep   bool
+	}
+
+	tests := map[string]test{
+		"kept":      {header: "abc-123", keep: true},
+		"generated": {header: "", keep: false},
+		"invalid":   {header: "a b", keep: false},
+	}
+
+	for name, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(RequestIDHeader, tt.header)
+		w := httptest.NewRecorder()
+		setRequestID(w, r)
+		got := w.Header().Get(RequestIDHeader)
+		if (got == tt.header) != tt.keep || got == "" {
+			t.Errorf("%s: expected kept: %v, got: %v", name, tt.keep, got)
+		}
+		if r.Header.Get(RequestIDHeader) != got {
+			t.Errorf("%s: expected: %v, got: %v", name, got, r.Header.Get(RequestIDHeader))
+		}
+	}
+}
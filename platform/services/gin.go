@@ -2,56 +2,59 @@ package services
 
 import (
 	"net/http"
-	"strings"
+	"regexp"
 
 	"github.com/gin-gonic/gin"
 )
 
-type ginHandler struct {
-	Handler
+func init() {
+	RegisterRouter("gin", func(h Handler, ips ClientIPResolver) http.Handler {
+		return GinRoutes(h, ips)
+	})
 }
 
-// GinRoutes sets routes for http.ListenAndServe.
-func GinRoutes(h Handler) *gin.Engine {
-	hgin := ginHandler{Handler: h}
+// GinRoutes sets Routes on gin engine for http.ListenAndServe.
+// Client ip of visits is resolved using ips.
+func GinRoutes(h Handler, ips ClientIPResolver) *gin.Engine {
 	r := gin.Default()
-	r.GET("/api/visits", hgin.getVisitsHandler)
-	r.POST("/api/visits", hgin.postVisitHandler)
-	r.GET("/api/visits/:ip", hgin.getVisitsByIPHandler)
+	r.Use(func(c *gin.Context) {
+		setRequestID(c.Writer, c.Request)
+		c.Next()
+	})
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(func(c *gin.Context) {
+		abortWithProblem(c, errRouteNotFound)
+	})
+	r.NoMethod(func(c *gin.Context) {
+		abortWithProblem(c, errMethodNotAllowed)
+	})
+	for _, route := range Routes(h, ips) {
+		r.Handle(route.Method, ginPath(route.Path), ginHandler(route.Handler))
+	}
 	return r
 }
 
-func (h ginHandler) getVisitsHandler(c *gin.Context) {
-	filter := make(map[string]string)
-	for f, val := range c.Request.URL.Query() {
-		filter[f] = val[0]
-	}
-	visits, err := h.GetVisits(filter)
-	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-	c.JSON(200, visits)
+// routeParam matches path parameter of Route.
+var routeParam = regexp.MustCompile(`{([^/{}]+)}`)
+
+// ginPath returns path of Route in gin syntax, e.g. /api/visits/:ip.
+func ginPath(path string) string {
+	return routeParam.ReplaceAllString(path, ":$1")
 }
 
-func (h ginHandler) postVisitHandler(c *gin.Context) {
-	ip := strings.Split(c.Request.RemoteAddr, ":")[0]
-	if err := h.ProduceVisit(ip); err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+// ginHandler passes path parameters matched by gin to handler.
+func ginHandler(handler http.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		params := make(map[string]string, len(c.Params))
+		for _, p := range c.Params {
+			params[p.Key] = p.Value
+		}
+		handler(c.Writer, withPathParams(c.Request, params))
 	}
 }
 
-func (h ginHandler) getVisitsByIPHandler(c *gin.Context) {
-	ip := c.Param("ip")
-	filter := make(map[string]string)
-	for f, val := range c.Request.URL.Query() {
-		filter[f] = val[0]
-	}
-	visits, err := h.GetVisitsByIP(ip, filter)
-	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-	c.JSON(200, visits)
+// abortWithProblem responds with problem caused by err and stops handling request.
+func abortWithProblem(c *gin.Context, err error) {
+	writeProblem(c.Writer, c.Request, err)
+	c.Abort()
 }
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func postVisitHandler(h Handler, ips ClientIPResolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, err := visitRequest(r, ips)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		if err := h.ProduceVisit(v); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+	}
+}
+
+func getVisitsHandler(h Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := kcp.ParseVisitQuery(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		visits, err := h.GetVisits(q)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		writeJSON(w, r, visits)
+	}
+}
+
+func getVisitsByIPHandler(h Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := kcp.ParseVisitQuery(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		visits, err := h.GetVisitsByIP(pathParam(r, "ip"), q)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		writeJSON(w, r, visits)
+	}
+}
+
+func getVisitsByNetworksHandler(h Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		q, err := kcp.ParseVisitQuery(values)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		visits, err := h.GetVisitsByNetworks(values[kcp.ParamCIDR], q)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		writeJSON(w, r, visits)
+	}
+}
+
+func getVisitStatsHandler(h Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := kcp.ParseStatsQuery(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		stats, err := h.GetVisitStats(q)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		writeJSON(w, r, stats)
+	}
+}
+
+func getSessionsHandler(h Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := kcp.ParseSessionQuery(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		sessions, err := h.GetSessions(q)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		writeJSON(w, r, sessions)
+	}
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// HealthPath is path of health check served by HealthHandler.
+const HealthPath = "/healthz"
+
+// ErrStopped is status of component, which stopped running.
+var ErrStopped = errors.New("stopped")
+
+// Health contains statuses of components of running role, e.g. http server or consumers.
+// Role is healthy if all components are healthy. Zero value is ready to use.
+type Health struct {
+	mu       sync.Mutex
+	statuses map[string]error
+}
+
+// Set sets status of component, nil if it is healthy.
+func (h *Health) Set(component string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.statuses == nil {
+		h.statuses = make(map[string]error)
+	}
+	h.statuses[component] = err
+}
+
+// Status returns statuses of components by name and whether all of them are healthy.
+func (h *Health) Status() (map[string]string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	statuses := make(map[string]string)
+	healthy := true
+	for name, err := range h.statuses {
+		statuses[name] = "ok"
+		if err != nil {
+			statuses[name] = err.Error()
+			healthy = false
+		}
+	}
+	return statuses, healthy
+}
+
+// ServeHTTP responds with statuses of components,
+// status code is 200 if all of them are healthy and 503 otherwise.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses, healthy := h.Status()
+	body := struct {
+		Status     string            `json:"status"`
+		Components map[string]string `json:"components"`
+	}{Status: "ok", Components: statuses}
+	code := http.StatusOK
+	if !healthy {
+		body.Status, code = "unavailable", http.StatusServiceUnavailable
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// HealthHandler returns handler serving health on HealthPath.
+func HealthHandler(h *Health) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(HealthPath, h)
+	return mux
+}
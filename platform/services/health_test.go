@@ -0,0 +1,52 @@
+package services
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	type test struct {
+		statuses map[string]error
+		code     int
+		body     string
+	}
+
+	tests := map[string]test{
+		"no components": {
+			code: 200,
+			body: `{"status":"ok","components":{}}`,
+		},
+		"healthy": {
+			statuses: map[string]error{"http": nil, "inserter-1": nil},
+			code:     200,
+			body:     `{"status":"ok","components":{"http":"ok","inserter-1":"ok"}}`,
+		},
+		"stopped component": {
+			statuses: map[string]error{"http": nil, "inserter-1": ErrStopped},
+			code:     503,
+			body:     `{"status":"unavailable","components":{"http":"ok","inserter-1":"stopped"}}`,
+		},
+		"shutting down": {
+			statuses: map[string]error{"shutdown": errors.New("shutting down")},
+			code:     503,
+			body:     `{"status":"unavailable","components":{"shutdown":"shutting down"}}`,
+		},
+	}
+
+	for name, tt := range tests {
+		h := &Health{}
+		for component, err := range tt.statuses {
+			h.Set(component, err)
+		}
+		w := httptest.NewRecorder()
+		HealthHandler(h).ServeHTTP(w, httptest.NewRequest("GET", HealthPath, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.code, w.Code)
+		}
+		if w.Body.String() != tt.body {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.body, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/rs/xid"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// imageNamePattern matches name of uploaded image.
+const imageNamePattern = "^[0-9a-v]{20}\\.(?:jpeg|png)$"
+
+// Set max file size to 5MB.
+const maxFileSize = 1024 * 1024 * 5
+
+func uploadImageHandler(w http.ResponseWriter, r *http.Request) {
+	// Set limit for file size.
+	if r.ContentLength > maxFileSize {
+		writeProblem(w, r, fmt.Errorf("%w: file size too big", errInvalidImage))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
+
+	// Get image from request.
+	fr, _, err := r.FormFile("image")
+	if err != nil {
+		writeProblem(w, r, fmt.Errorf("%w: %v", errInvalidImage, err))
+		return
+	}
+	defer fr.Close()
+
+	// Create dir images in case one does not exists.
+	// Could move to Routes() to create and not check every request.
+	// Leaving here to not spread the code.
+	if err := os.MkdirAll("images", os.ModeDir); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	// Peek first 512 bytes to detect content type.
+	sniff, err := bufio.NewReader(fr).Peek(512)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	var ext string
+	switch mime := http.DetectContentType(sniff); mime {
+	case "image/jpeg":
+		ext = ".jpeg"
+	case "image/png":
+		ext = ".png"
+	default:
+		writeProblem(w, r, fmt.Errorf("%w: wrong file type", errInvalidImage))
+		return
+	}
+
+	// Create file name by generating unique name and adding extension
+	// determined by http.DetectContentType.
+	fname := xid.New().String() + ext
+
+	// Required to read after peeking.
+	// TODO: find out why this is needed.
+	fr.Seek(0, 0)
+
+	// Create new file using name generated above.
+	fs, err := os.Create("images/" + fname)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	defer fs.Close()
+
+	// Copy content from request file to system file.
+	if _, err := io.Copy(fs, fr); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	// Respond with JSON containing filename.
+	resp := map[string]string{"filename": fname}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+}
+
+func loadImageHandler(w http.ResponseWriter, r *http.Request) {
+	fn := pathParam(r, "filename")
+
+	// Check if name is valid.
+	// Name without ext is 20 chars, containing all lowercase sequence of a to v letters and 0 to 9 numbers ([0-9a-v]{20}).
+	// https://github.com/rs/xid
+	// Valid extensions are jpeg and png.
+	if ok, err := regexp.Match(
+		imageNamePattern,
+		[]byte(fn),
+	); !ok || err != nil {
+		writeProblem(w, r, fmt.Errorf("%w: image %v", kcp.ErrNotFound, fn))
+		return
+	}
+
+	http.ServeFile(w, r, "./images/"+fn)
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// Operation describes Route in OpenAPI document.
+// Query parameters of request are validated against Params before they reach handler.
+type Operation struct {
+	ID       string
+	Summary  string
+	Params   []Param
+	Body     *Content
+	Response *Content
+}
+
+// Content is body of request or successful response, Response is nil if it has no body.
+// Optional is set if request can be sent without body.
+type Content struct {
+	MediaType string
+	Schema    *Schema
+	Optional  bool
+}
+
+// Param is OpenAPI parameter, In is query or path.
+type Param struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// Schema is subset of OpenAPI schema object used to describe api.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *int               `json:"minimum,omitempty"`
+	Maximum              *int               `json:"maximum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+}
+
+// OpenAPIPath is path of route serving OpenAPI document.
+const OpenAPIPath = "/api/openapi.json"
+
+// OpenAPI returns OpenAPI 3 document describing routes.
+// Every operation responds with Problem on error.
+func OpenAPI(routes []Route) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, r := range routes {
+		op := map[string]interface{}{
+			"operationId": r.Operation.ID,
+			"summary":     r.Operation.Summary,
+			"responses":   openAPIResponses(r.Operation),
+		}
+		if r.Operation.Params != nil {
+			op["parameters"] = r.Operation.Params
+		}
+		if b := r.Operation.Body; b != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": !b.Optional,
+				"content":  map[string]interface{}{b.MediaType: map[string]interface{}{"schema": b.Schema}},
+			}
+		}
+		if paths[r.Path] == nil {
+			paths[r.Path] = make(map[string]interface{})
+		}
+		paths[r.Path][strings.ToLower(r.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "kcp",
+			"version": "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// openAPIResponses returns responses of operation.
+func openAPIResponses(op Operation) map[string]interface{} {
+	ok := map[string]interface{}{"description": "OK"}
+	if op.Response != nil {
+		ok["content"] = map[string]interface{}{op.Response.MediaType: map[string]interface{}{"schema": op.Response.Schema}}
+	}
+	problem := map[string]interface{}{
+		"description": "Error",
+		"content":     map[string]interface{}{ProblemContentType: map[string]interface{}{"schema": ref("Problem")}},
+	}
+	return map[string]interface{}{"200": ok, "default": problem}
+}
+
+// validateQuery returns handler, which responds with Problem if query has parameter
+// not described by params, repeated parameter, which is not array, or value not matching
+// type, range or enum of parameter schema. Format of values is validated by kcp.
+func validateQuery(params []Param, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := queryError(params, r.URL.Query()); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// queryError returns *kcp.FilterError of first invalid query parameter by name.
+func queryError(params []Param, values url.Values) error {
+	byName := make(map[string]Param)
+	for _, p := range params {
+		if p.In == "query" {
+			byName[p.Name] = p
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p, ok := byName[name]
+		if !ok {
+			return &kcp.FilterError{Param: name, Value: values.Get(name), Reason: "unknown parameter"}
+		}
+		s, vs := p.Schema, values[name]
+		if s.Type == "array" {
+			s = s.Items
+			// Array values can be comma separated.
+			var split []string
+			for _, v := range vs {
+				split = append(split, strings.Split(v, ",")...)
+			}
+			vs = split
+		} else if len(vs) > 1 {
+			return &kcp.FilterError{Param: name, Value: vs[1], Reason: "must not be repeated"}
+		}
+		for _, v := range vs {
+			if reason := s.invalid(strings.TrimSpace(v)); reason != "" {
+				return &kcp.FilterError{Param: name, Value: v, Reason: reason}
+			}
+		}
+	}
+	return nil
+}
+
+// invalid returns reason why value does not match schema or empty string if it matches.
+// Empty value is treated as missing parameter.
+func (s *Schema) invalid(v string) string {
+	if v == "" {
+		return ""
+	}
+	if s.Type == "integer" {
+		n, err := strconv.Atoi(v)
+		switch {
+		case err != nil:
+			return "must be integer"
+		case s.Minimum != nil && n < *s.Minimum:
+			return fmt.Sprintf("must be at least %v", *s.Minimum)
+		case s.Maximum != nil && n > *s.Maximum:
+			return fmt.Sprintf("must be at most %v", *s.Maximum)
+		}
+	}
+	if s.Enum == nil {
+		return ""
+	}
+	for _, e := range s.Enum {
+		if strings.EqualFold(v, e) {
+			return ""
+		}
+	}
+	return "must be one of " + strings.Join(s.Enum, ", ")
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+func TestOpenAPI(t *testing.T) {
+	routes := Routes(&stubHandler{}, ClientIPResolver{})
+	doc := OpenAPI(routes)
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := doc["paths"].(map[string]map[string]interface{})
+	ids := make(map[string]bool)
+	for _, r := range routes {
+		if _, ok := paths[r.Path][strings.ToLower(r.Method)]; !ok {
+			t.Errorf("%s %s: expected operation in document", r.Method, r.Path)
+		}
+		if r.Operation.ID == "" || ids[r.Operation.ID] {
+			t.Errorf("%s %s: expected unique operation id, got: %q", r.Method, r.Path, r.Operation.ID)
+		}
+		ids[r.Operation.ID] = true
+
+		// Every path parameter must be described.
+		for _, m := range routeParam.FindAllStringSubmatch(r.Path, -1) {
+			var described bool
+			for _, p := range r.Operation.Params {
+				described = described || p.In == "path" && p.Name == m[1] && p.Required
+			}
+			if !described {
+				t.Errorf("%s %s: expected path parameter %v", r.Method, r.Path, m[1])
+			}
+		}
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	type test struct {
+		values url.Values
+		param  string
+	}
+
+	tests := map[string]test{
+		"valid":              {values: url.Values{"ip": {"1.1.1.1,2.2.2.2", "3.3.3.3"}, "limit": {"10"}, "order": {"DESC"}}},
+		"empty value":        {values: url.Values{"limit": {""}}},
+		"array enum":         {values: url.Values{"day": {"Monday, Friday"}}},
+		"unknown":            {values: url.Values{"from": {"2020"}}, param: "from"},
+		"repeated":           {values: url.Values{"limit": {"1", "2"}}, param: kcp.ParamLimit},
+		"not integer":        {values: url.Values{"hour_from": {"9am"}}, param: kcp.ParamHourFrom},
+		"below minimum":      {values: url.Values{"limit": {"-1"}}, param: kcp.ParamLimit},
+		"above maximum":      {values: url.Values{"hour_to": {"24"}}, param: kcp.ParamHourTo},
+		"not in enum":        {values: url.Values{"order": {"up"}}, param: kcp.ParamOrder},
+		"array not in enum":  {values: url.Values{"day": {"Monday,Mday"}}, param: kcp.ParamDay},
+		"path param unknown": {values: url.Values{"filename": {"a.png"}}, param: "filename"},
+	}
+
+	params := append([]Param{requiredPathParam("filename", "", stringSchema)}, visitParams...)
+	for name, tt := range tests {
+		err := queryError(params, tt.values)
+		if tt.param == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+			}
+			continue
+		}
+		var ferr *kcp.FilterError
+		if !errors.As(err, &ferr) || ferr.Param != tt.param {
+			t.Errorf("%s: expected invalid %v, got: %v", name, tt.param, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/rs/xid"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+// RequestIDHeader is header of request ID, it is kept from request if valid
+// or generated otherwise, and is set in response.
+const RequestIDHeader = "X-Request-Id"
+
+// ProblemContentType is media type of Problem responses.
+const ProblemContentType = "application/problem+json"
+
+// Problem is body of error response as defined by RFC 7807.
+// Param is query parameter, which failed validation.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Param     string `json:"param,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Errors of requests handled by services, which are not returned by Handler.
+var (
+	errRouteNotFound    = fmt.Errorf("%w: no route matches request path", kcp.ErrNotFound)
+	errMethodNotAllowed = errors.New("method not allowed")
+	errInvalidImage     = errors.New("invalid image")
+	errInvalidBody      = errors.New("invalid request body")
+)
+
+// problemStatuses maps errors to status of response, first matching error is used.
+var problemStatuses = []struct {
+	err    error
+	status int
+}{
+	{kcp.ErrInvalidFilter, http.StatusBadRequest},
+	{errInvalidImage, http.StatusBadRequest},
+	{errInvalidBody, http.StatusBadRequest},
+	{kcp.ErrNotFound, http.StatusNotFound},
+	{errMethodNotAllowed, http.StatusMethodNotAllowed},
+	{kcp.ErrUnavailable, http.StatusServiceUnavailable},
+}
+
+// unavailableDetail is detail of 503 problems, as their cause is not exposed.
+const unavailableDetail = "Service is temporarily unavailable, retry later"
+
+// NewProblem returns Problem describing err of request r.
+// Status is selected by error err matches:
+//  * kcp.ErrInvalidFilter - 400, param and detail are set from *kcp.FilterError
+//  * kcp.ErrNotFound - 404, detail names missing resource
+//  * kcp.ErrUnavailable - 503, detail is fixed message
+//  * other errors - 500, or status of problemStatuses (e.g. 400 for invalid image),
+//     error is not exposed in detail
+func NewProblem(r *http.Request, err error) Problem {
+	p := Problem{
+		Type:      "about:blank",
+		Status:    http.StatusInternalServerError,
+		Instance:  r.URL.Path,
+		RequestID: r.Header.Get(RequestIDHeader),
+	}
+	for _, s := range problemStatuses {
+		if errors.Is(err, s.err) {
+			p.Status = s.status
+			break
+		}
+	}
+	p.Title = http.StatusText(p.Status)
+
+	var ferr *kcp.FilterError
+	switch {
+	case errors.As(err, &ferr):
+		p.Detail, p.Param = err.Error(), ferr.Param
+	case errors.Is(err, kcp.ErrNotFound):
+		p.Detail = err.Error()
+	case p.Status == http.StatusServiceUnavailable:
+		p.Detail = unavailableDetail
+	}
+	return p
+}
+
+// writeProblem writes problem of request r caused by err.
+// Errors of status 500 and 503 are printed, as they are not exposed in response.
+func writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	p := NewProblem(r, err)
+	if p.Status == http.StatusInternalServerError || p.Status == http.StatusServiceUnavailable {
+		fmt.Println(err)
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// validRequestID matches request ID kept from request.
+var validRequestID = regexp.MustCompile(`^[0-9A-Za-z._:-]{1,64}$`)
+
+// setRequestID sets request ID of request r in its header and response header,
+// request ID is generated if it is missing or invalid.
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = xid.New().String()
+		r.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+}
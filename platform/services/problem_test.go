@@ -0,0 +1,68 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SarunasBucius/kafka-cass-practise/kcp"
+)
+
+func TestNewProblem(t *testing.T) {
+	type test struct {
+		err  error
+		want Problem
+	}
+
+	ferr := &kcp.FilterError{Param: kcp.ParamLimit, Value: "ten", Reason: "must be integer"}
+	tests := map[string]test{
+		"invalid filter": {
+			err:  ferr,
+			want: Problem{Status: 400, Title: "Bad Request", Detail: ferr.Error(), Param: kcp.ParamLimit},
+		},
+		"wrapped invalid filter": {
+			err:  fmt.Errorf("parse query: %w", ferr),
+			want: Problem{Status: 400, Title: "Bad Request", Detail: "parse query: " + ferr.Error(), Param: kcp.ParamLimit},
+		},
+		"invalid image": {
+			err:  fmt.Errorf("%w: multipart: NextPart: EOF", errInvalidImage),
+			want: Problem{Status: 400, Title: "Bad Request"},
+		},
+		"invalid body": {
+			err:  fmt.Errorf("%w: unexpected EOF", errInvalidBody),
+			want: Problem{Status: 400, Title: "Bad Request"},
+		},
+		"not found": {
+			err:  errRouteNotFound,
+			want: Problem{Status: 404, Title: "Not Found", Detail: errRouteNotFound.Error()},
+		},
+		"method not allowed": {
+			err:  errMethodNotAllowed,
+			want: Problem{Status: 405, Title: "Method Not Allowed"},
+		},
+		"unavailable": {
+			err:  fmt.Errorf("%w: gocql: no hosts available in the pool", kcp.ErrUnavailable),
+			want: Problem{Status: 503, Title: "Service Unavailable", Detail: unavailableDetail},
+		},
+		"internal": {
+			err:  errors.New("sql: database is closed"),
+			want: Problem{Status: 500, Title: "Internal Server Error"},
+		},
+	}
+
+	for name, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/visits?limit=ten", nil)
+		r.Header.Set(RequestIDHeader, "request-1")
+		want := tt.want
+		want.Type, want.Instance, want.RequestID = "about:blank", "/api/visits", "request-1"
+		if got := NewProblem(r, tt.err); got != want {
+			t.Errorf("%s: expected: %+v, got: %+v", name, want, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/visits", nil)
+	if got := NewProblem(r, errMethodNotAllowed); got.RequestID != "" {
+		t.Errorf("expected: %q, got: %q", "", got.RequestID)
+	}
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Router returns http.Handler serving Routes of h, client ip of visits is resolved using ips.
+type Router func(h Handler, ips ClientIPResolver) http.Handler
+
+var (
+	routersMu sync.RWMutex
+	routers   = make(map[string]Router)
+)
+
+// RegisterRouter makes router available by name.
+// It panics if router is nil or registered twice.
+func RegisterRouter(name string, r Router) {
+	routersMu.Lock()
+	defer routersMu.Unlock()
+	if r == nil {
+		panic("services: RegisterRouter router " + name + " is nil")
+	}
+	if _, ok := routers[name]; ok {
+		panic("services: RegisterRouter called twice for router " + name)
+	}
+	routers[name] = r
+}
+
+// Routers returns sorted names of registered routers.
+func Routers() []string {
+	routersMu.RLock()
+	defer routersMu.RUnlock()
+	var names []string
+	for name := range routers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewRouter returns http.Handler of router registered by name serving Routes of h.
+func NewRouter(name string, h Handler, ips ClientIPResolver) (http.Handler, error) {
+	routersMu.RLock()
+	r, ok := routers[name]
+	routersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown router %q, registered: %v", name, strings.Join(Routers(), ", "))
+	}
+	return r(h, ips), nil
+}
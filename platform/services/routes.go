@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"net/http"
+)
+
+// Route is http route served same way by every router.
+// Path parameters are written in braces (e.g. /api/visits/{ip})
+// and are read by handler using pathParam.
+type Route struct {
+	Method    string
+	Path      string
+	Handler   http.HandlerFunc
+	Operation Operation
+}
+
+// Routes returns routes of http api handled by h and route serving their OpenAPI document.
+// Query parameters of routes with operation parameters are validated before handler is called,
+// other routes (e.g. image upload) ignore query.
+// Client ip of visits is resolved using ips.
+func Routes(h Handler, ips ClientIPResolver) []Route {
+	routes := []Route{
+		{
+			Method:  http.MethodPost,
+			Path:    "/api/visits",
+			Handler: postVisitHandler(h, ips),
+			Operation: Operation{
+				ID:      "postVisit",
+				Summary: "Produce visit of client to page, page path falls back to path of Referer header",
+				Params:  postVisitParams,
+				Body:    &Content{MediaType: "application/json", Schema: ref("VisitedPage"), Optional: true},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/api/visits",
+			Handler: getVisitsHandler(h),
+			Operation: Operation{
+				ID:       "getVisits",
+				Summary:  "Get page of visits grouped by ip",
+				Params:   visitParams,
+				Response: &Content{MediaType: "application/json", Schema: ref("VisitsPage")},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/api/visits/{ip}",
+			Handler: getVisitsByIPHandler(h),
+			Operation: Operation{
+				ID:       "getVisitsByIP",
+				Summary:  "Get page of visits of ip",
+				Params:   append([]Param{requiredPathParam("ip", "IP of visit", stringSchema)}, visitParams...),
+				Response: &Content{MediaType: "application/json", Schema: ref("VisitsPage")},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/api/networks/visits",
+			Handler: getVisitsByNetworksHandler(h),
+			Operation: Operation{
+				ID:       "getVisitsByNetworks",
+				Summary:  "Get page of visits of ips in CIDR networks or listed ips",
+				Params:   networkParams,
+				Response: &Content{MediaType: "application/json", Schema: ref("VisitsPage")},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/api/stats/visits",
+			Handler: getVisitStatsHandler(h),
+			Operation: Operation{
+				ID:       "getVisitStats",
+				Summary:  "Get statistics of visits from hourly rollups",
+				Params:   statsParams,
+				Response: &Content{MediaType: "application/json", Schema: &Schema{Type: "array", Items: ref("VisitStats")}},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/api/sessions",
+			Handler: getSessionsHandler(h),
+			Operation: Operation{
+				ID:       "getSessions",
+				Summary:  "Get sessions of visits and their stats",
+				Params:   sessionParams,
+				Response: &Content{MediaType: "application/json", Schema: ref("SessionsPage")},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/api/upload-image",
+			Handler: uploadImageHandler,
+			Operation: Operation{
+				ID:      "uploadImage",
+				Summary: "Upload jpeg or png image up to 5MB",
+				Body: &Content{MediaType: "multipart/form-data", Schema: &Schema{
+					Type:       "object",
+					Properties: map[string]*Schema{"image": {Type: "string", Format: "binary"}},
+					Required:   []string{"image"},
+				}},
+				Response: &Content{MediaType: "application/json", Schema: ref("UploadedImage")},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/api/load-image/{filename}",
+			Handler: loadImageHandler,
+			Operation: Operation{
+				ID:      "loadImage",
+				Summary: "Load uploaded image",
+				Params: []Param{requiredPathParam("filename", "File name returned by uploadImage", &Schema{
+					Type:    "string",
+					Pattern: imageNamePattern,
+				})},
+				Response: &Content{MediaType: "application/octet-stream", Schema: &Schema{Type: "string", Format: "binary"}},
+			},
+		},
+	}
+	routes = append(routes, Route{
+		Method: http.MethodGet,
+		Path:   OpenAPIPath,
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, r, OpenAPI(routes))
+		},
+		Operation: Operation{
+			ID:       "getOpenAPI",
+			Summary:  "Get OpenAPI document of api",
+			Response: &Content{MediaType: "application/json", Schema: &Schema{Type: "object"}},
+		},
+	})
+
+	for i := range routes {
+		if routes[i].Operation.Params != nil {
+			routes[i].Handler = validateQuery(routes[i].Operation.Params, routes[i].Handler)
+		}
+	}
+	return routes
+}
+
+type pathParamsKey struct{}
+
+// withPathParams returns request carrying path parameters matched by router.
+func withPathParams(r *http.Request, params map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+}
+
+// pathParam returns path parameter of request set by router adapter.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
@@ -2,6 +2,10 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"sync"
 	"time"
@@ -11,17 +15,64 @@ import (
 
 // Handler contains methods to handle request.
 type Handler interface {
-	ProduceVisit(ip string) error
-	GetVisits(filter map[string]string) (kcp.VisitsByIP, error)
-	GetVisitsByIP(ip string, filter map[string]string) (kcp.VisitsByIP, error)
+	ProduceVisit(r kcp.VisitRequest) error
+	GetVisits(q kcp.VisitQuery) (kcp.VisitsPage, error)
+	GetVisitsByIP(ip string, q kcp.VisitQuery) (kcp.VisitsPage, error)
+	GetVisitsByNetworks(cidrs []string, q kcp.VisitQuery) (kcp.VisitsPage, error)
+	GetVisitStats(q kcp.StatsQuery) ([]kcp.VisitStats, error)
+	GetSessions(q kcp.SessionQuery) (kcp.SessionsPage, error)
+}
+
+// visitedPage is optional JSON body of visit tracking request.
+type visitedPage struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+}
+
+// maxVisitBodySize is max size of visit tracking request body.
+const maxVisitBodySize = 4096
+
+// visitRequest returns request of visit from http request.
+// Path and method of visited page are read from query or JSON body, query is used
+// if both are set. kcp falls back to Referer header if path is missing.
+func visitRequest(r *http.Request, ips ClientIPResolver) (kcp.VisitRequest, error) {
+	var page visitedPage
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		err := json.NewDecoder(io.LimitReader(r.Body, maxVisitBodySize)).Decode(&page)
+		if err != nil && err != io.EOF {
+			return kcp.VisitRequest{}, fmt.Errorf("%w: %v", errInvalidBody, err)
+		}
+	}
+	query := r.URL.Query()
+	if v := query.Get(kcp.ParamPath); v != "" {
+		page.Path = v
+	}
+	if v := query.Get(kcp.ParamMethod); v != "" {
+		page.Method = v
+	}
+	return kcp.VisitRequest{
+		IP:      ips.ClientIP(r),
+		Method:  page.Method,
+		Path:    page.Path,
+		Headers: r.Header,
+	}, nil
+}
+
+// ServerConfig configures http server of ListenHTTP.
+type ServerConfig struct {
+	Addr         string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
 }
 
 // ListenHTTP listens and serves http requests.
-func ListenHTTP(ctx context.Context, h http.Handler, cancel context.CancelFunc, wg *sync.WaitGroup) {
+func ListenHTTP(ctx context.Context, h http.Handler, cfg ServerConfig, cancel context.CancelFunc, wg *sync.WaitGroup) {
 	srv := &http.Server{
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
+		Addr:         cfg.Addr,
+		WriteTimeout: cfg.WriteTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
 		Handler:      h,
 	}
 	go func() {
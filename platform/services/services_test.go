@@ -0,0 +1,51 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVisitRequest(t *testing.T) {
+	type test struct {
+		target      string
+		contentType string
+		body        string
+		path        string
+		method      string
+		err         error
+	}
+
+	tests := map[string]test{
+		"json body":          {target: "/api/visits", contentType: "application/json", body: `{"path":"/pricing","method":"GET"}`, path: "/pricing", method: "GET"},
+		"json with charset":  {target: "/api/visits", contentType: "application/json; charset=utf-8", body: `{"path":"/blog/kafka"}`, path: "/blog/kafka"},
+		"query":              {target: "/api/visits?path=%2Fsignup&method=POST", path: "/signup", method: "POST"},
+		"query before body":  {target: "/api/visits?path=%2Fsignup", contentType: "application/json", body: `{"path":"/pricing","method":"POST"}`, path: "/signup", method: "POST"},
+		"empty json body":    {target: "/api/visits", contentType: "application/json"},
+		"beacon text body":   {target: "/api/visits", contentType: "text/plain", body: `{"path":"/pricing"}`},
+		"malformed json":     {target: "/api/visits", contentType: "application/json", body: `{"path":`, err: errInvalidBody},
+		"body over max size": {target: "/api/visits", contentType: "application/json", body: `{"path":"/` + strings.Repeat("a", maxVisitBodySize) + `"}`, err: errInvalidBody},
+	}
+
+	for name, tt := range tests {
+		r := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		r.Header.Set("Referer", "https://example.com/")
+		v, err := visitRequest(r, ClientIPResolver{})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected: %v, got: %v", name, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if v.Path != tt.path || v.Method != tt.method {
+			t.Errorf("%s: expected: %v %v, got: %v %v", name, tt.method, tt.path, v.Method, v.Path)
+		}
+		if http.Header(v.Headers).Get("Referer") != "https://example.com/" {
+			t.Errorf("%s: expected: %v, got: %v", name, "https://example.com/", http.Header(v.Headers).Get("Referer"))
+		}
+	}
+}